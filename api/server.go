@@ -2,14 +2,20 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"strings"
 	"time"
 
+	"github.com/DSpeichert/netbootd/blob"
+	"github.com/DSpeichert/netbootd/cache"
 	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/program"
 	"github.com/DSpeichert/netbootd/store"
+	"github.com/DSpeichert/netbootd/templates"
+	"github.com/DSpeichert/netbootd/upstream"
 	"github.com/gorilla/mux"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -20,13 +26,29 @@ type Server struct {
 	router     *mux.Router
 	httpServer *http.Server
 
-	logger zerolog.Logger
-	store  *store.Store
+	logger    zerolog.Logger
+	store     *store.Store
+	cache     *cache.Cache
+	upstreams *upstream.Pool
+	programs  *program.Runner
+	blobs     *blob.Store
+	templates *templates.Library
+}
+
+// Deps are the services managed through the API besides manifests.
+type Deps struct {
+	// Cache of proxy mounts, nil if caching is disabled.
+	Cache     *cache.Cache
+	Upstreams *upstream.Pool
+	Programs  *program.Runner
+	// Blobs is nil if the blob store is disabled.
+	Blobs     *blob.Store
+	Templates *templates.Library
 }
 
 // NewServer set up HTTP API server instance
 // If authorization is passed, requires privileged operation callers to present Authorization header with this content.
-func NewServer(store *store.Store, authorization, rootPath string) (server *Server, err error) {
+func NewServer(store *store.Store, deps Deps, authorization, rootPath string) (server *Server, err error) {
 	r := mux.NewRouter()
 
 	server = &Server{
@@ -38,8 +60,13 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 			MaxHeaderBytes: 1 << 20,
 			IdleTimeout:    10 * time.Second,
 		},
-		logger: log.With().Str("service", "api").Logger(),
-		store:  store,
+		logger:    log.With().Str("service", "api").Logger(),
+		store:     store,
+		cache:     deps.Cache,
+		upstreams: deps.Upstreams,
+		programs:  deps.Programs,
+		blobs:     deps.Blobs,
+		templates: deps.Templates,
 	}
 
 	// custom server header
@@ -79,6 +106,7 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 			return
 		}
 		var b []byte
+		var err error
 		if strings.Contains(r.Header.Get("Accept"), "application/json") {
 			w.Header().Set("Content-Type", "applications/json")
 			b, err = json.Marshal(m)
@@ -102,6 +130,7 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 		}
 
 		var b []byte
+		var err error
 		if strings.Contains(r.Header.Get("Accept"), "application/json") {
 			w.Header().Set("Content-Type", "applications/json")
 			b, err = json.Marshal(store.GetAll())
@@ -126,6 +155,7 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 
 		buf, _ := ioutil.ReadAll(r.Body)
 		var m manifest.Manifest
+		var err error
 		if r.Header.Get("Content-Type") == "application/json" {
 			m, err = manifest.ManifestFromJson(buf, rootPath)
 			if err != nil {
@@ -139,8 +169,30 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 				return
 			}
 		}
-		err = store.PutManifest(m)
-		if err != nil {
+		// manifests submitted over the network may only run programs allowed by the server configuration
+		for _, command := range m.ExecCommands() {
+			if err := server.programs.Allowed(command); err != nil {
+				http.Error(w, "manifest references program not allowed by --exec-commands: "+command, http.StatusBadRequest)
+				return
+			}
+		}
+		put := func() error {
+			return store.PutManifest(m)
+		}
+		if digests := m.Blobs(); len(digests) == 0 {
+			err = put()
+		} else if server.blobs == nil {
+			http.Error(w, "manifest references blobs, but blob store is disabled", http.StatusBadRequest)
+			return
+		} else {
+			// blobs can't be collected between checking them and storing the manifest
+			err = server.blobs.Reference(digests, put)
+		}
+		var unavailable *blob.UnavailableError
+		if errors.As(err, &unavailable) {
+			http.Error(w, unavailable.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
 			http.Error(w, "error storing manifest: "+err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -160,6 +212,117 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 		w.WriteHeader(http.StatusNoContent)
 	}).Methods("DELETE")
 
+	// GET /api/manifests/{id}/profile
+	r.HandleFunc("/api/manifests/{id}/profile", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		vars := mux.Vars(r)
+		m := store.Find(vars["id"])
+		if m == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		state := struct {
+			Profiles      []string `json:"profiles" yaml:"profiles"`
+			ActiveProfile string   `json:"activeProfile" yaml:"activeProfile"`
+			NextBoot      string   `json:"nextBoot" yaml:"nextBoot"`
+		}{m.ProfileNames(), m.ActiveProfile, store.NextBootProfile(m.ID)}
+		var b []byte
+		var err error
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "applications/json")
+			b, err = json.Marshal(state)
+		} else {
+			w.Header().Set("Content-Type", "text/yaml")
+			b, err = yaml.Marshal(state)
+		}
+		if err != nil {
+			http.Error(w, "error marshalling profile: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}).Methods("GET")
+
+	// PUT /api/manifests/{id}/profile/{profile}
+	r.HandleFunc("/api/manifests/{id}/profile/{profile}", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if store.Find(vars["id"]) == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := store.SetActiveProfile(vars["id"], vars["profile"]); err != nil {
+			http.Error(w, "error setting profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT")
+
+	// DELETE /api/manifests/{id}/profile
+	r.HandleFunc("/api/manifests/{id}/profile", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if store.Find(vars["id"]) == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := store.SetActiveProfile(vars["id"], ""); err != nil {
+			http.Error(w, "error setting profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// PUT /api/manifests/{id}/next-boot/{profile}
+	r.HandleFunc("/api/manifests/{id}/next-boot/{profile}", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if store.Find(vars["id"]) == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := store.SetNextBootProfile(vars["id"], vars["profile"]); err != nil {
+			http.Error(w, "error setting next boot profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("PUT")
+
+	// DELETE /api/manifests/{id}/next-boot
+	r.HandleFunc("/api/manifests/{id}/next-boot", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		vars := mux.Vars(r)
+		if store.Find(vars["id"]) == nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := store.SetNextBootProfile(vars["id"], ""); err != nil {
+			http.Error(w, "error setting next boot profile: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
 	// GET|POST /api/self/suspend-boot
 	r.HandleFunc("/api/self/suspend-boot", func(w http.ResponseWriter, r *http.Request) {
 		var ipStr string
@@ -183,7 +346,10 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		m.Suspended = true
+		if err := store.SetSuspended(m.ID, true); err != nil {
+			http.Error(w, "error storing manifest: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 	}).Methods("GET", "POST")
@@ -211,7 +377,10 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 			http.Error(w, "not found", http.StatusNotFound)
 			return
 		}
-		m.Suspended = false
+		if err := store.SetSuspended(m.ID, false); err != nil {
+			http.Error(w, "error storing manifest: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 
 		w.WriteHeader(http.StatusOK)
 	}).Methods("GET", "POST")
@@ -240,6 +409,7 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 			return
 		}
 		var b []byte
+		var err error
 		if strings.Contains(r.Header.Get("Accept"), "application/json") {
 			w.Header().Set("Content-Type", "applications/json")
 			b, err = json.Marshal(store.GetAll())
@@ -255,6 +425,342 @@ func NewServer(store *store.Store, authorization, rootPath string) (server *Serv
 		w.Write(b)
 	}).Methods("GET")
 
+	// GET /api/cache
+	r.HandleFunc("/api/cache", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if server.cache == nil {
+			http.Error(w, "cache is disabled", http.StatusNotFound)
+			return
+		}
+
+		var b []byte
+		var err error
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "applications/json")
+			b, err = json.Marshal(server.cache.Stats())
+		} else {
+			w.Header().Set("Content-Type", "text/yaml")
+			b, err = yaml.Marshal(server.cache.Stats())
+		}
+		if err != nil {
+			http.Error(w, "error marshalling cache stats: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}).Methods("GET")
+
+	// DELETE /api/cache
+	r.HandleFunc("/api/cache", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if server.cache == nil {
+			http.Error(w, "cache is disabled", http.StatusNotFound)
+			return
+		}
+
+		n := server.cache.Purge(queryFirst(r, "url"))
+		server.logger.Info().
+			Str("url", queryFirst(r, "url")).
+			Int("purged", n).
+			Msg("cache purged")
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// GET /api/mirrors
+	r.HandleFunc("/api/mirrors", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var b []byte
+		var err error
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "applications/json")
+			b, err = json.Marshal(server.upstreams.Health())
+		} else {
+			w.Header().Set("Content-Type", "text/yaml")
+			b, err = yaml.Marshal(server.upstreams.Health())
+		}
+		if err != nil {
+			http.Error(w, "error marshalling upstream health: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}).Methods("GET")
+
+	// PUT /api/blobs, PUT /api/blobs/{digest}
+	putBlob := func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if server.blobs == nil {
+			http.Error(w, "blob store is disabled", http.StatusNotFound)
+			return
+		}
+
+		var expected string
+		if d, ok := mux.Vars(r)["digest"]; ok {
+			var err error
+			if expected, err = blob.ParseDigest(d); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		// artifacts such as initrds take longer to upload than other requests,
+		// the response is written only after the upload
+		rc := http.NewResponseController(w)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+
+		info, err := server.blobs.Put(r.Body, expected)
+		var mismatch *blob.DigestMismatchError
+		if errors.As(err, &mismatch) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "error storing blob: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var b []byte
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "applications/json")
+			b, err = json.Marshal(info)
+		} else {
+			w.Header().Set("Content-Type", "text/yaml")
+			b, err = yaml.Marshal(info)
+		}
+		if err != nil {
+			http.Error(w, "error marshalling blob: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write(b)
+	}
+	r.HandleFunc("/api/blobs", putBlob).Methods("PUT")
+	r.HandleFunc("/api/blobs/{digest}", putBlob).Methods("PUT")
+
+	// GET /api/blobs
+	r.HandleFunc("/api/blobs", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if server.blobs == nil {
+			http.Error(w, "blob store is disabled", http.StatusNotFound)
+			return
+		}
+
+		list, err := server.blobs.List()
+		if err != nil {
+			http.Error(w, "error listing blobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var b []byte
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "applications/json")
+			b, err = json.Marshal(list)
+		} else {
+			w.Header().Set("Content-Type", "text/yaml")
+			b, err = yaml.Marshal(list)
+		}
+		if err != nil {
+			http.Error(w, "error marshalling blobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}).Methods("GET")
+
+	// GET /api/blobs/{digest}
+	r.HandleFunc("/api/blobs/{digest}", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if server.blobs == nil {
+			http.Error(w, "blob store is disabled", http.StatusNotFound)
+			return
+		}
+
+		digest, err := blob.ParseDigest(mux.Vars(r)["digest"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := server.blobs.Open(digest)
+		if errors.Is(err, blob.ErrNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "error opening blob: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"`+manifest.BlobDigestPrefix+digest+`"`)
+		http.ServeContent(w, r, "", time.Time{}, f)
+	}).Methods("GET")
+
+	// DELETE /api/blobs/{digest}
+	r.HandleFunc("/api/blobs/{digest}", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if server.blobs == nil {
+			http.Error(w, "blob store is disabled", http.StatusNotFound)
+			return
+		}
+
+		digest, err := blob.ParseDigest(mux.Vars(r)["digest"])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = server.blobs.Delete(digest)
+		if errors.Is(err, blob.ErrNotFound) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		} else if errors.Is(err, blob.ErrReferenced) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "error deleting blob: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
+	// POST /api/blobs/gc
+	r.HandleFunc("/api/blobs/gc", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if server.blobs == nil {
+			http.Error(w, "blob store is disabled", http.StatusNotFound)
+			return
+		}
+
+		removed, freed, err := server.blobs.Collect()
+		if err != nil {
+			http.Error(w, "error collecting blobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result := struct {
+			Removed int   `json:"removed" yaml:"removed"`
+			Freed   int64 `json:"freed" yaml:"freed"`
+		}{removed, freed}
+
+		var b []byte
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "applications/json")
+			b, err = json.Marshal(result)
+		} else {
+			w.Header().Set("Content-Type", "text/yaml")
+			b, err = yaml.Marshal(result)
+		}
+		if err != nil {
+			http.Error(w, "error marshalling result: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}).Methods("POST")
+
+	// GET /api/templates
+	r.HandleFunc("/api/templates", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var b []byte
+		var err error
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "applications/json")
+			b, err = json.Marshal(server.templates.Names())
+		} else {
+			w.Header().Set("Content-Type", "text/yaml")
+			b, err = yaml.Marshal(server.templates.Names())
+		}
+		if err != nil {
+			http.Error(w, "error marshalling templates: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+	}).Methods("GET")
+
+	// GET /api/templates/{name}
+	r.HandleFunc("/api/templates/{name:.+}", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		text, err := server.templates.Source(mux.Vars(r)["name"])
+		if err != nil {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(text))
+	}).Methods("GET")
+
+	// PUT /api/templates/{name}
+	r.HandleFunc("/api/templates/{name:.+}", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		buf, _ := ioutil.ReadAll(r.Body)
+		err := server.templates.Put(mux.Vars(r)["name"], string(buf))
+		if errors.Is(err, templates.ErrNoDirectory) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "error storing template: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}).Methods("PUT")
+
+	// DELETE /api/templates/{name}
+	r.HandleFunc("/api/templates/{name:.+}", func(w http.ResponseWriter, r *http.Request) {
+		if authorization != r.Header.Get("Authorization") {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		err := server.templates.Delete(mux.Vars(r)["name"])
+		if errors.Is(err, templates.ErrNoDirectory) || errors.Is(err, templates.ErrNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "error deleting template: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("DELETE")
+
 	return server, nil
 }
 
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/netbootd/blob"
+	"github.com/DSpeichert/netbootd/store"
+)
+
+// startServer serves the API with short timeouts, returning its base URL.
+func startServer(t *testing.T, timeout time.Duration) (string, *blob.Store) {
+	t.Helper()
+	manifests, err := store.NewStore(store.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := blob.NewStore(blob.Config{Directory: t.TempDir()}, manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(manifests, Deps{Blobs: blobs}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.httpServer.ReadTimeout = timeout
+	server.httpServer.WriteTimeout = timeout
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(l)
+	t.Cleanup(func() { server.httpServer.Close() })
+	return "http://" + l.Addr().String(), blobs
+}
+
+func TestPutBlobSlowly(t *testing.T) {
+	timeout := 100 * time.Millisecond
+	base, blobs := startServer(t, timeout)
+
+	// takes several times the server timeouts to upload
+	content := strings.Repeat("initrd", 1000)
+	body, w := io.Pipe()
+	go func() {
+		for i := 0; i < 5; i++ {
+			time.Sleep(timeout)
+			w.Write([]byte(content[i*len(content)/5 : (i+1)*len(content)/5]))
+		}
+		w.Close()
+	}()
+
+	sum := sha256.Sum256([]byte(content))
+	digest := hex.EncodeToString(sum[:])
+	req, err := http.NewRequest("PUT", base+"/api/blobs/sha256:"+digest, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status %s: %s, %v", resp.Status, b, err)
+	}
+
+	f, err := blobs.Open(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if stored, _ := io.ReadAll(f); string(stored) != content {
+		t.Errorf("stored %d bytes, want %d", len(stored), len(content))
+	}
+}
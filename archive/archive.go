@@ -0,0 +1,211 @@
+// Package archive serves files from inside disk images and archives without extracting them.
+// The index of an archive is read on first use and kept until the archive file changes.
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archive is an index of files inside a disk image or archive.
+type Archive struct {
+	path    string
+	size    int64
+	modTime time.Time
+
+	files map[string]*member
+	// files by lowercased name, used when there is no exact match
+	folded map[string]*member
+	// decompressed members of a compressed tarball, released when the archive is indexed again
+	spools []*spool
+}
+
+// member is a file inside an archive.
+// Members stored uncompressed are read directly from the archive file, compressed ones are decompressed on the fly,
+// except members of compressed tarballs, which are decompressed once into a spool (see spool).
+type member struct {
+	size    int64
+	modTime time.Time
+	// open returns reader of the content, f is the archive file opened for reading
+	open func(f *os.File) (io.ReadSeeker, error)
+	// if set, the member is listed but can't be read, opening it returns err
+	err error
+}
+
+// File is a file inside an archive opened for reading. It must be closed after use.
+type File struct {
+	io.ReadSeeker
+	Size    int64
+	ModTime time.Time
+
+	file *os.File
+}
+
+func (f *File) Close() error {
+	if c, ok := f.ReadSeeker.(io.Closer); ok {
+		c.Close()
+	}
+	return f.file.Close()
+}
+
+type entry struct {
+	mutex   sync.Mutex
+	archive *Archive
+}
+
+var (
+	mutex   sync.Mutex
+	entries = make(map[string]*entry)
+)
+
+// Load returns the index of archive at path. The format is detected from content, supported are
+// ISO 9660 images, zip archives and tarballs, either uncompressed or compressed with gzip or zstd.
+// Indexes are cached and read again only if size or modification time of the file changes.
+func Load(path string) (*Archive, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mutex.Lock()
+	e, ok := entries[path]
+	if !ok {
+		e = &entry{}
+		entries[path] = e
+	}
+	mutex.Unlock()
+
+	// concurrent requests of the same archive wait for a single indexing
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if a := e.archive; a != nil && a.size == stat.Size() && a.modTime.Equal(stat.ModTime()) {
+		return a, nil
+	}
+
+	a, err := index(path, stat)
+	if err != nil {
+		return nil, err
+	}
+	if e.archive != nil {
+		e.archive.release()
+	}
+	e.archive = a
+	return a, nil
+}
+
+func index(path string, stat fs.FileInfo) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := &Archive{
+		path:    path,
+		size:    stat.Size(),
+		modTime: stat.ModTime(),
+		files:   make(map[string]*member),
+		folded:  make(map[string]*member),
+	}
+
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header = header[:n]
+
+	if decompress, ok := tarDecompressor(header); ok {
+		err = a.indexTar(f, decompress)
+	} else if isZip(header) {
+		err = a.indexZip(f)
+	} else if isISO(f) {
+		err = a.indexISO(f)
+	} else {
+		err = errors.New("unsupported archive format")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot index %s: %w", path, err)
+	}
+	return a, nil
+}
+
+// release releases spools of a, once they're not read anymore.
+func (a *Archive) release() {
+	for _, s := range a.spools {
+		s.release()
+	}
+}
+
+// maxLinks limits how many links are followed to resolve a link to a regular file.
+const maxLinks = 8
+
+// symlinkTarget returns absolute path of the target of symbolic link name.
+func symlinkTarget(name, target string) string {
+	if !strings.HasPrefix(target, "/") {
+		target = path.Join(path.Dir(name), target)
+	}
+	return path.Clean(target)
+}
+
+// resolveLinks adds links (by name, with absolute targets) as the regular files they point to,
+// if those are in the archive.
+func (a *Archive) resolveLinks(links map[string]string) {
+	for name, target := range links {
+		for i := 0; i < maxLinks; i++ {
+			next, ok := links[target]
+			if !ok {
+				break
+			}
+			target = next
+		}
+		if m, ok := a.files[strings.Trim(target, "/")]; ok {
+			a.add(name, m)
+		}
+	}
+}
+
+// add stores m under name, which is relative to the archive root and uses slashes.
+func (a *Archive) add(name string, m *member) {
+	name = strings.Trim(name, "/")
+	a.files[name] = m
+	a.folded[strings.ToLower(name)] = m
+}
+
+// Open opens file name, which is relative to the archive root.
+// If no file matches name exactly, a case-insensitive match is used.
+func (a *Archive) Open(name string) (*File, error) {
+	name = strings.Trim(name, "/")
+	m, ok := a.files[name]
+	if !ok {
+		m, ok = a.folded[strings.ToLower(name)]
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	} else if m.err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: m.err}
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := m.open(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &File{
+		ReadSeeker: r,
+		Size:       m.size,
+		ModTime:    m.modTime,
+		file:       f,
+	}, nil
+}
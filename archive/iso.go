@@ -0,0 +1,414 @@
+package archive
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// ISO 9660 (ECMA-119) with Rock Ridge (IEEE P1282) and Joliet extensions.
+
+const (
+	isoSectorSize = 2048
+	// volume descriptors start after the system area
+	isoFirstDescriptor = 16
+	// more descriptors than this are not expected in a sane image
+	isoMaxDescriptors = 64
+	isoMaxDepth       = 64
+	isoMaxDirectory   = 64 << 20
+
+	isoFlagDirectory   = 0x02
+	isoFlagMultiExtent = 0x80
+)
+
+var (
+	errISOSymlink     = errors.New("rock ridge symbolic links are not supported")
+	errISOInterleaved = errors.New("interleaved files are not supported")
+)
+
+func isISO(f io.ReaderAt) bool {
+	id := make([]byte, 5)
+	_, err := f.ReadAt(id, isoFirstDescriptor*isoSectorSize+1)
+	return err == nil && string(id) == "CD001"
+}
+
+// isoRecord is a parsed directory record.
+type isoRecord struct {
+	name      string
+	extent    int64
+	size      int64
+	flags     byte
+	recorded  time.Time
+	su        []byte // system use area
+	unitSize  byte   // non-zero for interleaved files
+	separator bool   // "." or ".." entry
+}
+
+func parseISORecord(rec []byte) (*isoRecord, error) {
+	if len(rec) < 34 {
+		return nil, errors.New("short directory record")
+	}
+	nameLen := int(rec[32])
+	if 33+nameLen > len(rec) {
+		return nil, errors.New("directory record name out of bounds")
+	}
+	r := &isoRecord{
+		extent:   int64(binary.LittleEndian.Uint32(rec[2:])) * isoSectorSize,
+		size:     int64(binary.LittleEndian.Uint32(rec[10:])),
+		recorded: isoRecordingTime(rec[18:25]),
+		flags:    rec[25],
+		unitSize: rec[26],
+		name:     string(rec[33 : 33+nameLen]),
+	}
+	r.separator = nameLen == 1 && (rec[33] == 0 || rec[33] == 1)
+	// system use area follows the name, padded to even length
+	suStart := 33 + nameLen
+	if nameLen%2 == 0 {
+		suStart++
+	}
+	if suStart < len(rec) {
+		r.su = rec[suStart:]
+	}
+	return r, nil
+}
+
+func isoRecordingTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 {
+		return time.Time{}
+	}
+	// offset from GMT in 15 minute intervals
+	zone := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, zone)
+}
+
+// isoVolume walks the directory tree of one volume descriptor.
+type isoVolume struct {
+	f      io.ReaderAt
+	joliet bool
+	// Rock Ridge names are used if set, after skipping suspSkip bytes of each system use area
+	rockRidge bool
+	suspSkip  int
+	visited   map[int64]bool
+}
+
+func (a *Archive) indexISO(f *os.File) error {
+	var primary, joliet []byte
+	for i := 0; i < isoMaxDescriptors; i++ {
+		d := make([]byte, isoSectorSize)
+		if _, err := f.ReadAt(d, int64(isoFirstDescriptor+i)*isoSectorSize); err != nil {
+			return err
+		}
+		if string(d[1:6]) != "CD001" {
+			return errors.New("invalid volume descriptor")
+		}
+		if d[0] == 255 {
+			// terminator
+			break
+		} else if d[0] == 1 && primary == nil {
+			primary = d
+		} else if d[0] == 2 && d[88] == '%' && d[89] == '/' && bytes.IndexByte([]byte("@CE"), d[90]) >= 0 {
+			joliet = d
+		}
+	}
+	if primary == nil {
+		return errors.New("no primary volume descriptor")
+	}
+
+	v := &isoVolume{f: f, visited: make(map[int64]bool)}
+	root, err := parseISORecord(primary[156 : 156+34])
+	if err != nil {
+		return err
+	}
+	v.rockRidge, v.suspSkip, err = v.detectRockRidge(root)
+	if err != nil {
+		return err
+	}
+	if !v.rockRidge && joliet != nil {
+		// Joliet names are preferred to plain ISO 9660 names, Rock Ridge to both
+		v.joliet = true
+		if root, err = parseISORecord(joliet[156 : 156+34]); err != nil {
+			return err
+		}
+	}
+
+	return v.walk(a, root, "", 0)
+}
+
+// detectRockRidge looks for the SUSP indicator in the first record of the root directory.
+func (v *isoVolume) detectRockRidge(root *isoRecord) (bool, int, error) {
+	sector := make([]byte, isoSectorSize)
+	if _, err := v.f.ReadAt(sector, root.extent); err != nil {
+		return false, 0, err
+	}
+	if sector[0] == 0 {
+		return false, 0, nil
+	}
+	dot, err := parseISORecord(sector[:sector[0]])
+	if err != nil {
+		return false, 0, err
+	}
+	su := dot.su
+	if len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xBE && su[5] == 0xEF {
+		return true, int(su[6]), nil
+	}
+	return false, 0, nil
+}
+
+func (v *isoVolume) walk(a *Archive, dir *isoRecord, prefix string, depth int) error {
+	if depth > isoMaxDepth {
+		return errors.New("directory tree too deep")
+	}
+	if v.visited[dir.extent] {
+		return nil
+	}
+	v.visited[dir.extent] = true
+	if dir.size > isoMaxDirectory {
+		return errors.New("directory too large")
+	}
+
+	data := make([]byte, dir.size)
+	if _, err := v.f.ReadAt(data, dir.extent); err != nil {
+		return err
+	}
+
+	// extents of a file larger than 4 GiB are stored in consecutive records
+	var (
+		pendingName        string
+		pendingExtents     []isoExtent
+		pendingInterleaved bool
+	)
+	for off := 0; off < len(data); {
+		l := int(data[off])
+		if l == 0 {
+			// records do not cross sector boundaries, the rest of the sector is padding
+			off = (off/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if off+l > len(data) {
+			return errors.New("directory record out of bounds")
+		}
+		r, err := parseISORecord(data[off : off+l])
+		if err != nil {
+			return err
+		}
+		off += l
+		if r.separator {
+			continue
+		}
+
+		name, skip, symlink, relocated, err := v.name(r)
+		if err != nil {
+			return err
+		} else if skip {
+			continue
+		}
+		path := prefix + "/" + name
+		if symlink {
+			// listed, so that opening it fails with a clear error instead of not found
+			a.add(path, &member{err: errISOSymlink})
+			continue
+		}
+
+		if r.flags&isoFlagDirectory != 0 || relocated >= 0 {
+			if relocated >= 0 {
+				// Rock Ridge child link to a directory relocated because of depth limits
+				if r, err = v.relocatedDirectory(relocated); err != nil {
+					return err
+				}
+			}
+			if err := v.walk(a, r, path, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		// interleaved files are not worth supporting
+		pendingInterleaved = pendingInterleaved || r.unitSize != 0
+		pendingExtents = append(pendingExtents, isoExtent{offset: r.extent, size: r.size})
+		if r.flags&isoFlagMultiExtent != 0 {
+			pendingName = path
+			continue
+		}
+		if pendingName != "" && pendingName != path {
+			return fmt.Errorf("incomplete multi-extent file %s", pendingName)
+		}
+		if pendingInterleaved {
+			a.add(path, &member{err: errISOInterleaved})
+		} else {
+			a.add(path, newISOMember(pendingExtents, r.recorded))
+		}
+		pendingName, pendingExtents, pendingInterleaved = "", nil, false
+	}
+	return nil
+}
+
+// name returns name of the record. If skip is true, the record should be ignored.
+// If symlink is true, the record is a Rock Ridge symbolic link.
+// If the record is a Rock Ridge child link, relocated is the position of the relocated directory, -1 otherwise.
+func (v *isoVolume) name(r *isoRecord) (name string, skip, symlink bool, relocated int64, err error) {
+	relocated = -1
+	if v.joliet {
+		return trimISOVersion(decodeUCS2(r.name)), false, false, relocated, nil
+	}
+	if !v.rockRidge {
+		return strings.TrimSuffix(trimISOVersion(r.name), "."), false, false, relocated, nil
+	}
+
+	var (
+		nm    []byte
+		hasNM bool
+	)
+	err = v.susp(r.su, func(sig string, e []byte) {
+		switch sig {
+		case "NM":
+			if len(e) < 5 || e[4]&0x06 != 0 {
+				// current or parent directory
+				return
+			}
+			hasNM = true
+			nm = append(nm, e[5:]...)
+		case "RE":
+			// relocated directory, reachable via its child link
+			skip = true
+		case "CL":
+			if len(e) >= 8 {
+				relocated = int64(binary.LittleEndian.Uint32(e[4:])) * isoSectorSize
+			}
+		case "SL":
+			symlink = true
+		}
+	})
+	if err != nil {
+		return "", false, false, -1, err
+	}
+	if hasNM {
+		return string(nm), skip, symlink, relocated, nil
+	}
+	return strings.TrimSuffix(trimISOVersion(r.name), "."), skip, symlink, relocated, nil
+}
+
+// susp calls fn with signature and content of each System Use Sharing Protocol entry of su,
+// following continuation areas.
+func (v *isoVolume) susp(su []byte, fn func(sig string, e []byte)) error {
+	if len(su) < v.suspSkip {
+		return nil
+	}
+	su = su[v.suspSkip:]
+	for areas := 0; areas < isoMaxDescriptors; areas++ {
+		var next []byte
+		for len(su) >= 4 {
+			l := int(su[2])
+			if l < 4 || l > len(su) {
+				break
+			}
+			e := su[:l]
+			su = su[l:]
+			sig := string(e[:2])
+			if sig == "ST" {
+				break
+			} else if sig == "CE" && l >= 28 {
+				block := int64(binary.LittleEndian.Uint32(e[4:]))
+				offset := int64(binary.LittleEndian.Uint32(e[12:]))
+				length := int64(binary.LittleEndian.Uint32(e[20:]))
+				if length > isoSectorSize {
+					return errors.New("continuation area too large")
+				}
+				next = make([]byte, length)
+				if _, err := v.f.ReadAt(next, block*isoSectorSize+offset); err != nil {
+					return err
+				}
+				continue
+			}
+			fn(sig, e)
+		}
+		if next == nil {
+			return nil
+		}
+		su = next
+	}
+	return errors.New("too many continuation areas")
+}
+
+// relocatedDirectory returns the "." record of the directory at position.
+func (v *isoVolume) relocatedDirectory(position int64) (*isoRecord, error) {
+	sector := make([]byte, isoSectorSize)
+	if _, err := v.f.ReadAt(sector, position); err != nil {
+		return nil, err
+	}
+	if sector[0] == 0 {
+		return nil, errors.New("invalid relocated directory")
+	}
+	return parseISORecord(sector[:sector[0]])
+}
+
+func trimISOVersion(name string) string {
+	if i := strings.LastIndexByte(name, ';'); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+func decodeUCS2(s string) string {
+	u := make([]uint16, len(s)/2)
+	for i := range u {
+		u[i] = uint16(s[2*i])<<8 | uint16(s[2*i+1])
+	}
+	return string(utf16.Decode(u))
+}
+
+type isoExtent struct {
+	offset int64
+	size   int64
+}
+
+func newISOMember(extents []isoExtent, modTime time.Time) *member {
+	var size int64
+	for _, e := range extents {
+		size += e.size
+	}
+	return &member{
+		size:    size,
+		modTime: modTime,
+		open: func(f *os.File) (io.ReadSeeker, error) {
+			if len(extents) == 1 {
+				return io.NewSectionReader(f, extents[0].offset, extents[0].size), nil
+			}
+			return io.NewSectionReader(&extentReader{f: f, extents: extents}, 0, size), nil
+		},
+	}
+}
+
+// extentReader reads consecutive extents of a file as if they were contiguous.
+type extentReader struct {
+	f       io.ReaderAt
+	extents []isoExtent
+}
+
+func (r *extentReader) ReadAt(p []byte, off int64) (n int, err error) {
+	for _, e := range r.extents {
+		if len(p) == 0 {
+			break
+		}
+		if off >= e.size {
+			off -= e.size
+			continue
+		}
+		l := min(int64(len(p)), e.size-off)
+		m, err := r.f.ReadAt(p[:l], e.offset+off)
+		n += m
+		if err != nil {
+			return n, err
+		}
+		p = p[l:]
+		off = 0
+	}
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
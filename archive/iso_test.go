@@ -0,0 +1,325 @@
+package archive
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+)
+
+// isoNode is a file or directory (if dir is set) of a test image.
+type isoNode struct {
+	// identifier as recorded, e.g. "VMLINUZ.;1"
+	name string
+	su   []byte
+	// content of each extent, more than one for multi-extent files
+	extents  []string
+	unitSize byte
+	dir      bool
+	children []isoNode
+	// the directory is written, but recorded by a Rock Ridge child link in a file record
+	relocated bool
+}
+
+// isoBuilder writes ISO 9660 test images sector by sector.
+type isoBuilder struct {
+	img []byte
+}
+
+var isoTestTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+
+// alloc appends sectors for size bytes and returns the number of the first one.
+func (b *isoBuilder) alloc(size int) int64 {
+	sector := int64(len(b.img) / isoSectorSize)
+	n := (size + isoSectorSize - 1) / isoSectorSize
+	b.img = append(b.img, make([]byte, n*isoSectorSize)...)
+	return sector
+}
+
+func (b *isoBuilder) write(data []byte) int64 {
+	sector := b.alloc(len(data))
+	copy(b.img[sector*isoSectorSize:], data)
+	return sector
+}
+
+func isoTestRecord(sector int64, size int, flags, unitSize byte, name string, su []byte) []byte {
+	l := 33 + len(name)
+	if len(name)%2 == 0 {
+		l++
+	}
+	rec := make([]byte, l, l+len(su)+1)
+	rec = append(rec, su...)
+	if len(rec)%2 != 0 {
+		rec = append(rec, 0)
+	}
+	rec[0] = byte(len(rec))
+	binary.LittleEndian.PutUint32(rec[2:], uint32(sector))
+	binary.BigEndian.PutUint32(rec[6:], uint32(sector))
+	binary.LittleEndian.PutUint32(rec[10:], uint32(size))
+	binary.BigEndian.PutUint32(rec[14:], uint32(size))
+	t := isoTestTime
+	copy(rec[18:], []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 4})
+	rec[25] = flags
+	rec[26] = unitSize
+	binary.LittleEndian.PutUint16(rec[28:], 1)
+	binary.BigEndian.PutUint16(rec[30:], 1)
+	rec[32] = byte(len(name))
+	copy(rec[33:], name)
+	return rec
+}
+
+// layout concatenates records, padding sectors so that records do not cross sector boundaries.
+func layout(records [][]byte) []byte {
+	var data []byte
+	for _, rec := range records {
+		if used := len(data) % isoSectorSize; used+len(rec) > isoSectorSize {
+			data = append(data, make([]byte, isoSectorSize-used)...)
+		}
+		data = append(data, rec...)
+	}
+	return data
+}
+
+// dir writes directory node with its children and returns its position and size.
+func (b *isoBuilder) dir(node isoNode) (int64, int) {
+	var records [][]byte
+	for _, child := range node.children {
+		if child.dir {
+			sector, size := b.dir(child)
+			if child.relocated {
+				cl := []byte{'C', 'L', 12, 1, 0, 0, 0, 0, 0, 0, 0, 0}
+				binary.LittleEndian.PutUint32(cl[4:], uint32(sector))
+				records = append(records, isoTestRecord(0, 0, 0, 0, child.name, append(cl, child.su...)))
+			} else {
+				records = append(records, isoTestRecord(sector, size, isoFlagDirectory, 0, child.name, child.su))
+			}
+			continue
+		}
+		for i, content := range child.extents {
+			var flags byte
+			if i < len(child.extents)-1 {
+				flags = isoFlagMultiExtent
+			}
+			sector := b.write([]byte(content))
+			records = append(records, isoTestRecord(sector, len(content), flags, child.unitSize, child.name, child.su))
+		}
+	}
+
+	// "." carries the system use area of the directory, e.g. the SUSP indicator of the root
+	size := len(layout(append([][]byte{
+		isoTestRecord(0, 0, isoFlagDirectory, 0, "\x00", node.su),
+		isoTestRecord(0, 0, isoFlagDirectory, 0, "\x01", nil),
+	}, records...)))
+	sector := b.alloc(size)
+	data := layout(append([][]byte{
+		isoTestRecord(sector, size, isoFlagDirectory, 0, "\x00", node.su),
+		isoTestRecord(sector, size, isoFlagDirectory, 0, "\x01", nil),
+	}, records...))
+	copy(b.img[sector*isoSectorSize:], data)
+	return sector, size
+}
+
+// writeISO writes an image with the primary volume root, and optionally a Joliet volume root.
+func writeISO(t *testing.T, root isoNode, joliet *isoNode) string {
+	t.Helper()
+	b := &isoBuilder{}
+	b.alloc(isoFirstDescriptor * isoSectorSize)
+	descriptors := b.alloc(3 * isoSectorSize)
+
+	descriptor := func(i int64, kind byte, root isoNode) []byte {
+		var rec []byte
+		if kind != 255 {
+			sector, size := b.dir(root)
+			rec = isoTestRecord(sector, size, isoFlagDirectory, 0, "\x00", nil)
+		}
+		// sliced after writing the directories, which grow the image
+		d := b.img[(descriptors+i)*isoSectorSize : (descriptors+i+1)*isoSectorSize]
+		d[0] = kind
+		copy(d[1:], "CD001\x01")
+		copy(d[156:], rec)
+		return d
+	}
+	descriptor(0, 1, root)
+	next := int64(1)
+	if joliet != nil {
+		d := descriptor(next, 2, *joliet)
+		copy(d[88:], "%/E")
+		next++
+	}
+	descriptor(next, 255, isoNode{})
+
+	p := filepath.Join(t.TempDir(), "image.iso")
+	if err := os.WriteFile(p, b.img, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func ucs2(s string) string {
+	var b []byte
+	for _, u := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(u>>8), byte(u))
+	}
+	return string(b)
+}
+
+func nm(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+func checkISOFiles(t *testing.T, a *Archive, files map[string]string) {
+	t.Helper()
+	for name, want := range files {
+		f, err := a.Open(name)
+		if err != nil {
+			t.Errorf("open %s: %v", name, err)
+			continue
+		}
+		if f.Size != int64(len(want)) || !f.ModTime.Equal(isoTestTime) {
+			t.Errorf("%s: size %d, modification time %s", name, f.Size, f.ModTime)
+		}
+		got, err := io.ReadAll(f)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: read %q, %v, want %q", name, got, err, want)
+		}
+		f.Close()
+	}
+}
+
+func TestISO(t *testing.T) {
+	p := writeISO(t, isoNode{dir: true, children: []isoNode{
+		{name: "BOOT", dir: true, children: []isoNode{
+			{name: "VMLINUZ.;1", extents: []string{"kernel"}},
+			{name: "INITRD.IMG;1", extents: []string{"initrd"}},
+		}},
+		{name: "README.;1", extents: []string{"readme"}},
+		{name: "EMPTY.;1", extents: []string{""}},
+	}}, nil)
+	a, err := Load(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkISOFiles(t, a, map[string]string{
+		"BOOT/VMLINUZ":    "kernel",
+		"/boot/vmlinuz":   "kernel",
+		"boot/initrd.img": "initrd",
+		"README":          "readme",
+		"empty":           "",
+	})
+	for _, name := range []string{"VMLINUZ", "BOOT/VMLINUZ.;1", "BOOT"} {
+		if _, err := a.Open(name); !os.IsNotExist(err) {
+			t.Errorf("open %s: %v", name, err)
+		}
+	}
+}
+
+func TestISOJoliet(t *testing.T) {
+	primary := isoNode{dir: true, children: []isoNode{
+		{name: "ISOLINUX", dir: true, children: []isoNode{
+			{name: "VMLINUZ.;1", extents: []string{"kernel"}},
+		}},
+	}}
+	joliet := isoNode{dir: true, children: []isoNode{
+		{name: ucs2("isolinux"), dir: true, children: []isoNode{
+			{name: ucs2("vmlinuz-6.1.0-amd64;1"), extents: []string{"kernel"}},
+		}},
+	}}
+	a, err := Load(writeISO(t, primary, &joliet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkISOFiles(t, a, map[string]string{"isolinux/vmlinuz-6.1.0-amd64": "kernel"})
+	if _, err := a.Open("ISOLINUX/VMLINUZ"); !os.IsNotExist(err) {
+		t.Errorf("plain ISO 9660 name used with Joliet: %v", err)
+	}
+}
+
+func TestISORockRidge(t *testing.T) {
+	sp := []byte{'S', 'P', 7, 1, 0xBE, 0xEF, 0}
+	// name split in two entries, the first one with the continue flag
+	split := nm("initrd-")
+	split[4] = 0x01
+	split = append(split, nm("6.1.0.img")...)
+
+	image := isoNode{dir: true, su: sp, children: []isoNode{
+		{name: "BOOT", dir: true, su: nm("boot"), children: []isoNode{
+			{name: "VMLINUZ.;1", su: nm("vmlinuz-6.1.0"), extents: []string{"kernel"}},
+			{name: "INITRD_6.IMG;1", su: split, extents: []string{"initrd"}},
+			{name: "VMLINUZ0.;1", su: append(nm("vmlinuz"), 'S', 'L', 5, 1, 0), extents: []string{""}},
+			// deeper than allowed by ISO 9660, moved to rr_moved
+			{name: "DEEP", dir: true, su: nm("deep"), relocated: true, children: []isoNode{
+				{name: "FILE.;1", su: nm("file"), extents: []string{"deep"}},
+			}},
+		}},
+		{name: "RR_MOVED", dir: true, su: nm("rr_moved"), children: []isoNode{
+			{name: "DEEP", dir: true, su: append(nm("deep"), 'R', 'E', 4, 1)},
+		}},
+	}}
+	a, err := Load(writeISO(t, image, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkISOFiles(t, a, map[string]string{
+		"boot/vmlinuz-6.1.0":    "kernel",
+		"boot/initrd-6.1.0.img": "initrd",
+		"boot/deep/file":        "deep",
+	})
+	if _, err := a.Open("boot/vmlinuz"); !errors.Is(err, errISOSymlink) {
+		t.Errorf("open symbolic link: %v", err)
+	}
+	for _, name := range []string{"BOOT/INITRD_6.IMG", "rr_moved/deep/file"} {
+		if _, err := a.Open(name); !os.IsNotExist(err) {
+			t.Errorf("open %s: %v", name, err)
+		}
+	}
+}
+
+func TestISOMultiExtent(t *testing.T) {
+	extents := []string{strings.Repeat("a", 3000), strings.Repeat("b", 2048), "c"}
+	want := strings.Join(extents, "")
+	var children []isoNode
+	// enough records for the directory to span several sectors
+	for i := 0; i < 100; i++ {
+		children = append(children, isoNode{name: "FILE" + string(rune('A'+i%26)) + string(rune('A'+i/26)) + ".;1", extents: []string{"x"}})
+	}
+	children = append(children,
+		isoNode{name: "LARGE.;1", extents: extents},
+		isoNode{name: "INTERLEA.;1", extents: []string{"interleaved"}, unitSize: 1},
+	)
+	p := writeISO(t, isoNode{dir: true, children: children}, nil)
+	if info, _ := os.Stat(p); info.Size() < 20*isoSectorSize {
+		t.Fatalf("image of %d bytes too small", info.Size())
+	}
+	a, err := Load(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkISOFiles(t, a, map[string]string{"large": want, "fileaa": "x", "filevd": "x"})
+
+	f, err := a.Open("large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// across extent boundaries
+	for _, off := range []int64{2990, 5040, 0} {
+		if _, err := f.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 20)
+		n, err := io.ReadFull(f, got)
+		end := min(off+20, int64(len(want)))
+		if string(got[:n]) != want[off:end] {
+			t.Errorf("read %q at %d, %v, want %q", got[:n], off, err, want[off:end])
+		}
+	}
+
+	if _, err := a.Open("interlea"); !errors.Is(err, errISOInterleaved) {
+		t.Errorf("open interleaved file: %v", err)
+	}
+}
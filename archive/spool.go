@@ -0,0 +1,88 @@
+package archive
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// spool holds the content of a member of a compressed tarball, which can only be read by decompressing the tarball
+// from its start. The content is decompressed once, on first open, into an unlinked temporary file, which is closed
+// once the archive is replaced by a newer index and no longer read.
+type spool struct {
+	// extract writes the content read from archive file f to w
+	extract func(f *os.File, w io.Writer) error
+	size    int64
+
+	mutex sync.Mutex
+	// nil until extracted
+	file     *os.File
+	readers  int
+	released bool
+}
+
+// open returns a reader of the content, extracting it from archive file f first if needed.
+// The reader must be closed after use. Concurrent opens wait for a single extraction.
+func (s *spool) open(f *os.File) (io.ReadSeeker, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		spooled, err := s.extractFile(f)
+		if err != nil {
+			return nil, err
+		}
+		s.file = spooled
+	}
+	s.readers++
+	return &spoolReader{SectionReader: io.NewSectionReader(s.file, 0, s.size), spool: s}, nil
+}
+
+func (s *spool) extractFile(archive *os.File) (*os.File, error) {
+	f, err := os.CreateTemp("", "netbootd-archive-*")
+	if err != nil {
+		return nil, err
+	}
+	// removed right away, the content stays available through f until it's closed
+	os.Remove(f.Name())
+	if err := s.extract(archive, f); err != nil {
+		f.Close()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// release closes the file once it's not read anymore, it's extracted again if opened after.
+func (s *spool) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.released = true
+	s.closeUnused()
+}
+
+// closeUnused closes the file of a released spool without readers. Called with mutex held.
+func (s *spool) closeUnused() {
+	if s.released && s.readers == 0 && s.file != nil {
+		s.file.Close()
+		s.file = nil
+	}
+}
+
+type spoolReader struct {
+	*io.SectionReader
+	spool *spool
+	once  sync.Once
+}
+
+func (r *spoolReader) Close() error {
+	r.once.Do(func() {
+		r.spool.mutex.Lock()
+		defer r.spool.mutex.Unlock()
+		r.spool.readers--
+		r.spool.closeUnused()
+	})
+	return nil
+}
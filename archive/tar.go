@@ -0,0 +1,220 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// decompressor returns a reader decompressing r.
+type decompressor func(r io.Reader) (io.ReadCloser, error)
+
+func gzipDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func zstdDecompressor(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func isTar(header []byte) bool {
+	// POSIX ustar and GNU tar magic
+	return len(header) >= 263 && string(header[257:262]) == "ustar"
+}
+
+// tarDecompressor detects compression of a tarball from its first bytes.
+// It returns nil decompressor for uncompressed tarballs and false if header does not start a tarball.
+func tarDecompressor(header []byte) (decompressor, bool) {
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		return gzipDecompressor, true
+	case bytes.HasPrefix(header, zstdMagic):
+		return zstdDecompressor, true
+	case isTar(header):
+		return nil, true
+	}
+	return nil, false
+}
+
+// countingReader counts bytes read through it, to find offsets of tarball members.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (a *Archive) indexTar(f *os.File, decompress decompressor) error {
+	var r io.Reader = io.NewSectionReader(f, 0, a.size)
+	if decompress != nil {
+		rc, err := decompress(r)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		r = rc
+	}
+	// the tar reader must not see an io.Seeker, otherwise it skips content without counting it
+	cr := &countingReader{r: struct{ io.Reader }{r}}
+	tr := tar.NewReader(cr)
+
+	links := make(map[string]string)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean("/" + h.Name)
+
+		switch h.Typeflag {
+		case tar.TypeReg:
+			if isSparse(h) {
+				// content is not stored contiguously
+				continue
+			}
+			// the header has been read entirely, the content follows
+			offset, size := cr.n, h.Size
+			m := &member{size: size, modTime: h.ModTime}
+			if decompress == nil {
+				m.open = func(f *os.File) (io.ReadSeeker, error) {
+					return io.NewSectionReader(f, offset, size), nil
+				}
+			} else {
+				s := &spool{
+					extract: func(f *os.File, w io.Writer) error {
+						r, err := decompress(io.NewSectionReader(f, 0, a.size))
+						if err != nil {
+							return err
+						}
+						defer r.Close()
+						if _, err := io.CopyN(io.Discard, r, offset); err != nil {
+							return err
+						}
+						_, err = io.CopyN(w, r, size)
+						return err
+					},
+					size: size,
+				}
+				a.spools = append(a.spools, s)
+				m.open = s.open
+			}
+			a.add(name, m)
+		case tar.TypeLink:
+			links[name] = path.Clean("/" + h.Linkname)
+		case tar.TypeSymlink:
+			links[name] = symlinkTarget(name, h.Linkname)
+		}
+	}
+
+	a.resolveLinks(links)
+	return nil
+}
+
+func isSparse(h *tar.Header) bool {
+	if h.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// streamReader reads size bytes at offset of a stream that can only be read sequentially,
+// such as a compressed member of a zip archive. Seeking backwards starts reading the stream again.
+type streamReader struct {
+	open   func() (io.ReadCloser, error)
+	offset int64
+	size   int64
+
+	// position in the member
+	pos int64
+	// stream opened at position rpos in the member, nil if not opened yet
+	r    io.ReadCloser
+	rpos int64
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.r == nil || s.rpos > s.pos {
+		if s.r != nil {
+			s.r.Close()
+			s.r = nil
+		}
+		r, err := s.open()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.CopyN(io.Discard, r, s.offset); err != nil {
+			r.Close()
+			return 0, err
+		}
+		s.r, s.rpos = r, 0
+	}
+	if s.rpos < s.pos {
+		n, err := io.CopyN(io.Discard, s.r, s.pos-s.rpos)
+		s.rpos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	p = p[:min(int64(len(p)), s.size-s.pos)]
+	n, err := s.r.Read(p)
+	s.pos += int64(n)
+	s.rpos += int64(n)
+	if err == io.EOF && s.pos < s.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *streamReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+func (s *streamReader) Close() error {
+	if s.r == nil {
+		return nil
+	}
+	return s.r.Close()
+}
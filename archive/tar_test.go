@@ -0,0 +1,166 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func writeTar(t *testing.T, files map[string]string, compress func(io.Writer) io.WriteCloser) string {
+	t.Helper()
+	buf := new(bytes.Buffer)
+	var w io.Writer = buf
+	var cw io.WriteCloser
+	if compress != nil {
+		cw = compress(buf)
+		w = cw
+	}
+	tw := tar.NewWriter(w)
+	for _, name := range []string{"boot/vmlinuz", "boot/initrd.img", "empty"} {
+		content := files[name]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), ModTime: time.Unix(1e9, 0)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "vmlinuz", Typeflag: tar.TypeSymlink, Linkname: "boot/vmlinuz"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(p, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTar(t *testing.T) {
+	files := map[string]string{
+		"boot/vmlinuz":    string(bytes.Repeat([]byte("kernel "), 50000)),
+		"boot/initrd.img": string(bytes.Repeat([]byte("initrd "), 70000)),
+		"empty":           "",
+	}
+	compressions := map[string]func(io.Writer) io.WriteCloser{
+		"plain": nil,
+		"gzip":  func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+		"zstd": func(w io.Writer) io.WriteCloser {
+			zw, err := zstd.NewWriter(w)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return zw
+		},
+	}
+	for name, compress := range compressions {
+		t.Run(name, func(t *testing.T) {
+			a, err := Load(writeTar(t, files, compress))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{"boot/vmlinuz", "/boot/initrd.img", "BOOT/INITRD.IMG", "vmlinuz", "empty"} {
+				want := files[name]
+				switch name {
+				case "/boot/initrd.img", "BOOT/INITRD.IMG":
+					want = files["boot/initrd.img"]
+				case "vmlinuz":
+					want = files["boot/vmlinuz"]
+				}
+				// twice, the second time from the spool of compressed tarballs
+				for i := 0; i < 2; i++ {
+					f, err := a.Open(name)
+					if err != nil {
+						t.Fatalf("open %s: %v", name, err)
+					}
+					if f.Size != int64(len(want)) || !f.ModTime.Equal(time.Unix(1e9, 0)) {
+						t.Errorf("%s: size %d, modification time %s", name, f.Size, f.ModTime)
+					}
+					got, err := io.ReadAll(f)
+					if err != nil || string(got) != want {
+						t.Errorf("%s: read %d bytes, %v, want %d bytes", name, len(got), err, len(want))
+					}
+					// backwards
+					if len(want) > 10 {
+						if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+							t.Fatal(err)
+						}
+						tail, err := io.ReadAll(f)
+						if err != nil || string(tail) != want[len(want)-10:] {
+							t.Errorf("%s: read %q after seek, %v", name, tail, err)
+						}
+						if _, err := f.Seek(3, io.SeekStart); err != nil {
+							t.Fatal(err)
+						}
+						head := make([]byte, 4)
+						if _, err := io.ReadFull(f, head); err != nil || string(head) != want[3:7] {
+							t.Errorf("%s: read %q after seek, %v", name, head, err)
+						}
+					}
+					f.Close()
+				}
+			}
+			if _, err := a.Open("missing"); !os.IsNotExist(err) {
+				t.Errorf("open missing: %v", err)
+			}
+		})
+	}
+}
+
+func TestTarSpool(t *testing.T) {
+	p := writeTar(t, map[string]string{"boot/vmlinuz": "kernel", "boot/initrd.img": "initrd"},
+		func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })
+	a, err := Load(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.spools) != 3 {
+		t.Fatalf("got %d spools, want 3", len(a.spools))
+	}
+	s := a.spools[0]
+
+	f, err := a.Open("boot/vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spooled := s.file
+	g, err := a.Open("boot/vmlinuz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.file != spooled || s.readers != 2 {
+		t.Fatalf("member extracted again, %d readers", s.readers)
+	}
+	g.Close()
+
+	// replacing the archive releases the spool once it's not read anymore
+	now := time.Now().Add(time.Second)
+	if err := os.Chtimes(p, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(p); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(f); err != nil || string(b) != "kernel" {
+		t.Errorf("read %q, %v after release", b, err)
+	}
+	f.Close()
+	f.Close()
+	if s.file != nil || s.readers != 0 {
+		t.Errorf("spool not closed after release, %d readers", s.readers)
+	}
+}
@@ -0,0 +1,80 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+)
+
+func isZip(header []byte) bool {
+	// local file header, or end of central directory of an empty archive
+	return bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+}
+
+func (a *Archive) indexZip(f *os.File) error {
+	zr, err := zip.NewReader(f, a.size)
+	if err != nil {
+		return err
+	}
+	links := make(map[string]string)
+	for _, zf := range zr.File {
+		if strings.HasSuffix(zf.Name, "/") || zf.Flags&0x1 != 0 {
+			// directory or encrypted
+			continue
+		}
+		name := path.Clean("/" + zf.Name)
+		if zf.Mode()&fs.ModeSymlink != 0 {
+			// the content of a symbolic link is its target
+			target, err := readZipFile(zf)
+			if err != nil {
+				return err
+			}
+			links[name] = symlinkTarget(name, target)
+			continue
+		}
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return err
+		}
+		compressed, size := int64(zf.CompressedSize64), int64(zf.UncompressedSize64)
+
+		m := &member{size: size, modTime: zf.Modified}
+		switch zf.Method {
+		case zip.Store:
+			m.open = func(f *os.File) (io.ReadSeeker, error) {
+				return io.NewSectionReader(f, offset, size), nil
+			}
+		case zip.Deflate:
+			m.open = func(f *os.File) (io.ReadSeeker, error) {
+				return &streamReader{
+					open: func() (io.ReadCloser, error) {
+						return flate.NewReader(io.NewSectionReader(f, offset, compressed)), nil
+					},
+					size: size,
+				}, nil
+			}
+		default:
+			// other compression methods are rarely used
+			continue
+		}
+		a.add(name, m)
+	}
+
+	a.resolveLinks(links)
+	return nil
+}
+
+func readZipFile(zf *zip.File) (string, error) {
+	r, err := zf.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(io.LimitReader(r, 4096))
+	return string(b), err
+}
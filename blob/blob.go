@@ -0,0 +1,317 @@
+// Package blob implements an on-disk, content-addressed store of artifacts uploaded through the API,
+// served by mounts referencing them by digest.
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/store"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrNotFound is returned for digests of blobs not in the store.
+	ErrNotFound = errors.New("blob not found")
+	// ErrReferenced is returned when deleting a blob still referenced by a manifest.
+	ErrReferenced = errors.New("blob is referenced by a manifest")
+)
+
+// DigestMismatchError is returned when uploaded content does not match the expected digest.
+type DigestMismatchError struct {
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return "digest mismatch: expected " + manifest.BlobDigestPrefix + e.Expected + ", got " + manifest.BlobDigestPrefix + e.Actual
+}
+
+// UnavailableError is returned by Reference for a blob that is missing or can't be checked.
+type UnavailableError struct {
+	Digest string
+	Err    error
+}
+
+func (e *UnavailableError) Error() string {
+	return "error checking blob " + e.Digest + ": " + e.Err.Error()
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return e.Err
+}
+
+type Config struct {
+	// Directory in which blobs are stored, they are kept across restarts.
+	Directory string
+	// Unreferenced blobs are removed only after being uploaded at least this long ago,
+	// so that manifests referencing them can be put after uploading.
+	GracePeriod time.Duration
+}
+
+// Info describes a stored blob.
+type Info struct {
+	Digest     string    `json:"digest" yaml:"digest"`
+	Size       int64     `json:"size" yaml:"size"`
+	Uploaded   time.Time `json:"uploaded" yaml:"uploaded"`
+	References int       `json:"references" yaml:"references"`
+}
+
+type Store struct {
+	config    Config
+	logger    zerolog.Logger
+	manifests *store.Store
+
+	// serializes storing and removing blobs, so that a blob uploaded again is not collected meanwhile
+	mutex sync.Mutex
+}
+
+// NewStore opens the blob store in cfg.Directory. Blobs are referenced by mounts of manifests in manifests.
+func NewStore(cfg Config, manifests *store.Store) (*Store, error) {
+	if cfg.Directory == "" {
+		return nil, errors.New("blob directory is not set")
+	}
+	// partial uploads left over from a previous run are unusable
+	if err := os.RemoveAll(filepath.Join(cfg.Directory, "tmp")); err != nil {
+		return nil, err
+	}
+	for _, dir := range []string{"sha256", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(cfg.Directory, dir), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Store{
+		config:    cfg,
+		logger:    log.With().Str("module", "blob").Logger(),
+		manifests: manifests,
+	}, nil
+}
+
+// ParseDigest returns the hex-encoded SHA-256 digest of a "sha256:<hex>" or bare hex digest.
+func ParseDigest(digest string) (string, error) {
+	digest = strings.ToLower(strings.TrimPrefix(digest, manifest.BlobDigestPrefix))
+	if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+		return "", errors.New("invalid digest: " + digest)
+	}
+	return digest, nil
+}
+
+func (s *Store) path(digest string) string {
+	return filepath.Join(s.config.Directory, "sha256", digest)
+}
+
+// Put stores content read from r and returns its info. If expected is not empty,
+// content not matching this digest is discarded and a *DigestMismatchError returned.
+func (s *Store) Put(r io.Reader, expected string) (Info, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.config.Directory, "tmp"), "upload-")
+	if err != nil {
+		return Info{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return Info{}, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return Info{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return Info{}, err
+	}
+
+	digest := hex.EncodeToString(h.Sum(nil))
+	if expected != "" && expected != digest {
+		return Info{}, &DigestMismatchError{Expected: expected, Actual: digest}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// uploading existing content again restarts its grace period
+	if err := os.Rename(tmp.Name(), s.path(digest)); err != nil {
+		return Info{}, err
+	}
+	now := time.Now()
+	if err := os.Chtimes(s.path(digest), now, now); err != nil {
+		return Info{}, err
+	}
+
+	s.logger.Info().
+		Str("digest", manifest.BlobDigestPrefix+digest).
+		Int64("size", size).
+		Msg("blob stored")
+
+	return Info{
+		Digest:     manifest.BlobDigestPrefix + digest,
+		Size:       size,
+		Uploaded:   now,
+		References: s.references()[digest],
+	}, nil
+}
+
+// Open returns the blob with digest (as returned by ParseDigest) for reading. It must be closed after use.
+// Content stays readable even if the blob is removed meanwhile.
+func (s *Store) Open(digest string) (*os.File, error) {
+	f, err := os.Open(s.path(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Stat returns info of the blob with digest (as returned by ParseDigest).
+func (s *Store) Stat(digest string) (Info, error) {
+	stat, err := os.Stat(s.path(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	} else if err != nil {
+		return Info{}, err
+	}
+	return Info{
+		Digest:     manifest.BlobDigestPrefix + digest,
+		Size:       stat.Size(),
+		Uploaded:   stat.ModTime(),
+		References: s.references()[digest],
+	}, nil
+}
+
+// List returns info of all stored blobs, ordered by digest.
+func (s *Store) List() ([]Info, error) {
+	items, err := os.ReadDir(filepath.Join(s.config.Directory, "sha256"))
+	if err != nil {
+		return nil, err
+	}
+	refs := s.references()
+	blobs := make([]Info, 0, len(items))
+	for _, item := range items {
+		stat, err := item.Info()
+		if err != nil {
+			// removed meanwhile
+			continue
+		}
+		blobs = append(blobs, Info{
+			Digest:     manifest.BlobDigestPrefix + item.Name(),
+			Size:       stat.Size(),
+			Uploaded:   stat.ModTime(),
+			References: refs[item.Name()],
+		})
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Digest < blobs[j].Digest
+	})
+	return blobs, nil
+}
+
+// Delete removes the blob with digest (as returned by ParseDigest), unless a manifest references it.
+func (s *Store) Delete(digest string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.references()[digest] > 0 {
+		return ErrReferenced
+	}
+	err := os.Remove(s.path(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+
+	s.logger.Info().
+		Str("digest", manifest.BlobDigestPrefix+digest).
+		Msg("blob deleted")
+	return nil
+}
+
+// Reference checks that blobs with digests (as returned by ParseDigest) are stored and calls put,
+// which stores a manifest referencing them. Neither Delete nor Collect remove the blobs in between.
+// Errors of put are returned as is, blobs that are missing or can't be checked are reported with an *UnavailableError.
+func (s *Store) Reference(digests []string, put func() error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, digest := range digests {
+		if _, err := os.Stat(s.path(digest)); errors.Is(err, fs.ErrNotExist) {
+			return &UnavailableError{Digest: manifest.BlobDigestPrefix + digest, Err: ErrNotFound}
+		} else if err != nil {
+			return &UnavailableError{Digest: manifest.BlobDigestPrefix + digest, Err: err}
+		}
+	}
+	return put()
+}
+
+// Collect removes blobs not referenced by any manifest and uploaded longer than the grace period ago.
+// It returns the number of removed blobs and bytes freed.
+func (s *Store) Collect() (removed int, freed int64, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	items, err := os.ReadDir(filepath.Join(s.config.Directory, "sha256"))
+	if err != nil {
+		return 0, 0, err
+	}
+	refs := s.references()
+	for _, item := range items {
+		if refs[item.Name()] > 0 {
+			continue
+		}
+		stat, err := item.Info()
+		if err != nil || time.Since(stat.ModTime()) < s.config.GracePeriod {
+			continue
+		}
+		if err := os.Remove(s.path(item.Name())); err != nil {
+			s.logger.Error().
+				Err(err).
+				Str("digest", manifest.BlobDigestPrefix+item.Name()).
+				Msg("cannot remove unreferenced blob")
+			continue
+		}
+		removed++
+		freed += stat.Size()
+	}
+
+	if removed > 0 {
+		s.logger.Info().
+			Int("removed", removed).
+			Int64("freed", freed).
+			Msg("unreferenced blobs collected")
+	}
+	return removed, freed, nil
+}
+
+// CollectEvery runs Collect periodically, it never returns.
+func (s *Store) CollectEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if _, _, err := s.Collect(); err != nil {
+			s.logger.Error().
+				Err(err).
+				Msg("cannot collect unreferenced blobs")
+		}
+	}
+}
+
+// references counts mounts referencing each blob across all manifests.
+func (s *Store) references() map[string]int {
+	refs := make(map[string]int)
+	for _, m := range s.manifests.GetAll() {
+		for _, digest := range m.Blobs() {
+			refs[digest]++
+		}
+	}
+	return refs
+}
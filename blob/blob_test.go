@@ -0,0 +1,171 @@
+package blob
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/store"
+)
+
+// digest of "hello"
+const hello = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+func newTestStore(t *testing.T, cfg Config) (*Store, *store.Store) {
+	t.Helper()
+	manifests, err := store.NewStore(store.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Directory = t.TempDir()
+	s, err := NewStore(cfg, manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, manifests
+}
+
+// referencing returns a manifest with a mount of the blob with digest.
+func referencing(t *testing.T, digest string) manifest.Manifest {
+	t.Helper()
+	m, err := manifest.ManifestFromYaml([]byte("id: host\nipv4: 192.0.2.10/24\nmounts:\n- path: /hello\n  blob: sha256:"+digest+"\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestPut(t *testing.T) {
+	s, _ := newTestStore(t, Config{})
+
+	info, err := s.Put(strings.NewReader("hello"), hello)
+	if err != nil || info.Digest != manifest.BlobDigestPrefix+hello || info.Size != 5 {
+		t.Fatalf("got %+v, %v", info, err)
+	}
+	f, err := s.Open(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if b, err := io.ReadAll(f); err != nil || string(b) != "hello" {
+		t.Errorf("read %q, %v", b, err)
+	}
+}
+
+func TestPutDigestMismatch(t *testing.T) {
+	s, _ := newTestStore(t, Config{})
+
+	expected := strings.Repeat("0", 64)
+	_, err := s.Put(strings.NewReader("hello"), expected)
+	var mismatch *DigestMismatchError
+	if !errors.As(err, &mismatch) || mismatch.Expected != expected || mismatch.Actual != hello {
+		t.Fatalf("got error %v", err)
+	}
+
+	// neither stored under any digest nor left over as a partial upload
+	if _, err := s.Stat(hello); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat after mismatch: %v", err)
+	}
+	if _, err := s.Stat(expected); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat of expected digest after mismatch: %v", err)
+	}
+	for _, dir := range []string{"sha256", "tmp"} {
+		if items, err := os.ReadDir(filepath.Join(s.config.Directory, dir)); err != nil || len(items) != 0 {
+			t.Errorf("%d files in %s, %v", len(items), dir, err)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	s, manifests := newTestStore(t, Config{})
+	if _, err := s.Put(strings.NewReader("hello"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := manifests.PutManifest(referencing(t, hello)); err != nil {
+		t.Fatal(err)
+	}
+
+	// kept while referenced
+	if err := s.Delete(hello); !errors.Is(err, ErrReferenced) {
+		t.Fatalf("delete of referenced blob: %v", err)
+	}
+	if info, err := s.Stat(hello); err != nil || info.References != 1 {
+		t.Errorf("got %+v, %v after delete of referenced blob", info, err)
+	}
+
+	// removed once not anymore
+	if err := manifests.ForgetManifest("host"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(hello); err != nil {
+		t.Fatalf("delete of unreferenced blob: %v", err)
+	}
+	if _, err := s.Stat(hello); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat after delete: %v", err)
+	}
+	if err := s.Delete(hello); !errors.Is(err, ErrNotFound) {
+		t.Errorf("delete of missing blob: %v", err)
+	}
+}
+
+func TestReference(t *testing.T) {
+	s, manifests := newTestStore(t, Config{})
+	put := func() error {
+		return manifests.PutManifest(referencing(t, hello))
+	}
+
+	// missing blobs can't be referenced
+	err := s.Reference([]string{hello}, put)
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, ErrNotFound) || unavailable.Digest != manifest.BlobDigestPrefix+hello {
+		t.Fatalf("got error %v", err)
+	}
+	if manifests.Find("host") != nil {
+		t.Error("manifest put referencing missing blob")
+	}
+
+	if _, err := s.Put(strings.NewReader("hello"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reference([]string{hello}, put); err != nil || manifests.Find("host") == nil {
+		t.Fatalf("got error %v", err)
+	}
+	// errors of put as is
+	failed := errors.New("failed")
+	if err := s.Reference([]string{hello}, func() error { return failed }); err != failed {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	s, manifests := newTestStore(t, Config{})
+	for _, content := range []string{"hello", "unreferenced"} {
+		if _, err := s.Put(strings.NewReader(content), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := manifests.PutManifest(referencing(t, hello)); err != nil {
+		t.Fatal(err)
+	}
+
+	if removed, freed, err := s.Collect(); err != nil || removed != 1 || freed != int64(len("unreferenced")) {
+		t.Errorf("removed %d blobs of %d bytes, %v", removed, freed, err)
+	}
+	if blobs, err := s.List(); err != nil || len(blobs) != 1 || blobs[0].Digest != manifest.BlobDigestPrefix+hello {
+		t.Errorf("got %+v, %v after collecting", blobs, err)
+	}
+
+	// recent uploads are kept during the grace period
+	s.config.GracePeriod = time.Hour
+	if _, err := s.Put(strings.NewReader("recent"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if removed, _, err := s.Collect(); err != nil || removed != 0 {
+		t.Errorf("removed %d blobs, %v during grace period", removed, err)
+	}
+}
@@ -0,0 +1,397 @@
+// Package cache implements an on-disk, content-addressed cache of upstream HTTP responses for proxy mounts.
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type Config struct {
+	// Directory in which cached content is stored, in its tmp subdirectory, which is removed on start.
+	Directory string
+	// Maximum total size of cached content in bytes, least recently used entries are evicted above it.
+	MaxSize int64
+}
+
+// StatusError is returned when upstream responds with a status other than 200 OK.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "upstream returned status " + e.Status
+}
+
+// Stats contains cache statistics.
+type Stats struct {
+	Entries       int   `json:"entries" yaml:"entries"`
+	Blobs         int   `json:"blobs" yaml:"blobs"`
+	Size          int64 `json:"size" yaml:"size"`
+	MaxSize       int64 `json:"maxSize" yaml:"maxSize"`
+	Hits          int64 `json:"hits" yaml:"hits"`
+	Misses        int64 `json:"misses" yaml:"misses"`
+	Revalidations int64 `json:"revalidations" yaml:"revalidations"`
+	Evictions     int64 `json:"evictions" yaml:"evictions"`
+	UpstreamBytes int64 `json:"upstreamBytes" yaml:"upstreamBytes"`
+}
+
+// Key identifies cached content: the upstream URL, and the variant of the request sent for it.
+// Requests with different headers or credentials may get different responses, they are cached separately.
+type Key struct {
+	URL string
+	// e.g. rendered headers and credentials of the request, empty if none
+	Variant string
+}
+
+// entry maps a Key to cached content.
+type entry struct {
+	key  Key
+	blob *blob
+
+	contentType  string
+	etag         string
+	lastModified string
+	modTime      time.Time
+	expires      time.Time
+
+	// position in LRU list
+	element *list.Element
+}
+
+// blob is content stored on disk, named by its SHA-256 digest and shared by all entries with identical content.
+type blob struct {
+	digest string
+	size   int64
+	refs   int
+}
+
+// fetch is an upstream request in progress, shared by concurrent requests of the same URL.
+type fetch struct {
+	done chan struct{}
+	err  error
+	// stored or revalidated entry, nil if the response was not cacheable
+	entry *entry
+}
+
+type Cache struct {
+	config Config
+	logger zerolog.Logger
+
+	mutex    sync.Mutex
+	entries  map[Key]*entry
+	blobs    map[string]*blob
+	inflight map[Key]*fetch
+	// least recently used entry at the back
+	lru   *list.List
+	size  int64
+	stats Stats
+}
+
+func NewCache(cfg Config) (*Cache, error) {
+	if cfg.Directory == "" {
+		return nil, errors.New("cache directory is not set")
+	}
+	// cached content is indexed in memory only, anything left over from a previous run is unusable.
+	// All of it is kept in tmp, nothing else in the directory (which may be shared) is removed.
+	if err := os.RemoveAll(filepath.Join(cfg.Directory, "tmp")); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(cfg.Directory, "tmp", "sha256"), 0o755); err != nil {
+		return nil, err
+	}
+
+	return &Cache{
+		config:   cfg,
+		logger:   log.With().Str("module", "cache").Logger(),
+		entries:  make(map[Key]*entry),
+		blobs:    make(map[string]*blob),
+		inflight: make(map[Key]*fetch),
+		lru:      list.New(),
+	}, nil
+}
+
+// Object is cached content opened for reading. It must be closed after use.
+type Object struct {
+	*os.File
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+	// Digest is hex-encoded SHA-256 of the content.
+	Digest string
+}
+
+// FetchFunc requests content from upstream, adding header (which contains validators of stale content) to the request.
+type FetchFunc func(header http.Header) (*http.Response, error)
+
+// Get returns content stored under key, from cache if fresh, otherwise fetched (or revalidated) from upstream.
+// If ttl is non-zero, it's used as freshness lifetime instead of one derived from upstream cache headers.
+func (c *Cache) Get(key Key, ttl time.Duration, do FetchFunc) (*Object, error) {
+	for {
+		c.mutex.Lock()
+		e, ok := c.entries[key]
+		if ok && time.Now().Before(e.expires) {
+			c.stats.Hits++
+			c.lru.MoveToFront(e.element)
+			obj, err := c.open(e)
+			c.mutex.Unlock()
+			return obj, err
+		}
+
+		if f, ok := c.inflight[key]; ok {
+			// somebody else is fetching it already
+			c.mutex.Unlock()
+			<-f.done
+			if f.err != nil {
+				return nil, f.err
+			}
+			// use the result even if it must be revalidated on every use
+			c.mutex.Lock()
+			if e, ok := c.entries[key]; ok && e == f.entry {
+				c.stats.Hits++
+				c.lru.MoveToFront(e.element)
+				obj, err := c.open(e)
+				c.mutex.Unlock()
+				return obj, err
+			}
+			c.mutex.Unlock()
+			continue
+		}
+
+		f := &fetch{done: make(chan struct{})}
+		c.inflight[key] = f
+		var validators *entry
+		if ok {
+			copied := *e
+			validators = &copied
+		}
+		c.mutex.Unlock()
+
+		obj, err := c.fetch(f, key, ttl, do, validators)
+
+		c.mutex.Lock()
+		delete(c.inflight, key)
+		c.mutex.Unlock()
+		f.err = err
+		close(f.done)
+
+		return obj, err
+	}
+}
+
+// fetch requests key from upstream, conditionally if stale is not nil, and stores the response.
+func (c *Cache) fetch(f *fetch, key Key, ttl time.Duration, do FetchFunc, stale *entry) (*Object, error) {
+	header := http.Header{}
+	if stale != nil {
+		if stale.etag != "" {
+			header.Set("If-None-Match", stale.etag)
+		}
+		if stale.lastModified != "" {
+			header.Set("If-Modified-Since", stale.lastModified)
+		}
+	}
+
+	resp, err := do(header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	now := time.Now()
+	lifetime, cacheable := freshness(resp.Header, now)
+	if ttl != 0 {
+		lifetime, cacheable = ttl, true
+	}
+
+	if resp.StatusCode == http.StatusNotModified && stale != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		e, ok := c.entries[key]
+		if !ok || e.blob != stale.blob {
+			// purged or replaced in the meantime
+			return nil, fmt.Errorf("cache entry for %s disappeared during revalidation", key.URL)
+		}
+		c.stats.Revalidations++
+		e.expires = now.Add(lifetime)
+		f.entry = e
+		c.lru.MoveToFront(e.element)
+		return c.open(e)
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(c.config.Directory, "tmp"), "fetch-")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if err == nil && resp.ContentLength >= 0 && size != resp.ContentLength {
+		err = fmt.Errorf("upstream response truncated: got %d of %d bytes", size, resp.ContentLength)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	e := &entry{
+		key:          key,
+		contentType:  resp.Header.Get("Content-Type"),
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		modTime:      modTime,
+		expires:      now.Add(lifetime),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats.Misses++
+	c.stats.UpstreamBytes += size
+
+	b, err := c.addBlob(tmp.Name(), h, size)
+	if err != nil {
+		return nil, err
+	}
+	e.blob = b
+	obj, err := c.open(e)
+	if err != nil {
+		c.releaseBlob(b)
+		return nil, err
+	}
+
+	if !cacheable || size > c.config.MaxSize {
+		// serve this response only, the content is removed once obj is closed
+		c.releaseBlob(b)
+		return obj, nil
+	}
+
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+	f.entry = e
+	c.evict()
+
+	return obj, nil
+}
+
+// addBlob moves a downloaded file into the content-addressed store and returns the referenced blob.
+func (c *Cache) addBlob(path string, h hash.Hash, size int64) (*blob, error) {
+	digest := hex.EncodeToString(h.Sum(nil))
+	b, ok := c.blobs[digest]
+	if ok {
+		os.Remove(path)
+	} else {
+		if err := os.Rename(path, c.blobPath(digest)); err != nil {
+			os.Remove(path)
+			return nil, err
+		}
+		b = &blob{digest: digest, size: size}
+		c.blobs[digest] = b
+		c.size += size
+	}
+	b.refs++
+	return b, nil
+}
+
+func (c *Cache) releaseBlob(b *blob) {
+	b.refs--
+	if b.refs > 0 {
+		return
+	}
+	delete(c.blobs, b.digest)
+	c.size -= b.size
+	// open readers keep the content accessible until closed
+	if err := os.Remove(c.blobPath(b.digest)); err != nil {
+		c.logger.Error().
+			Err(err).
+			Str("digest", b.digest).
+			Msg("cannot remove cached content")
+	}
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.config.Directory, "tmp", "sha256", digest)
+}
+
+// open must be called with mutex held.
+func (c *Cache) open(e *entry) (*Object, error) {
+	f, err := os.Open(c.blobPath(e.blob.digest))
+	if err != nil {
+		return nil, err
+	}
+	return &Object{
+		File:        f,
+		Size:        e.blob.size,
+		ModTime:     e.modTime,
+		ContentType: e.contentType,
+		Digest:      e.blob.digest,
+	}, nil
+}
+
+// remove must be called with mutex held.
+func (c *Cache) remove(e *entry) {
+	delete(c.entries, e.key)
+	c.lru.Remove(e.element)
+	c.releaseBlob(e.blob)
+}
+
+// evict removes least recently used entries until the cache fits its maximum size.
+// It must be called with mutex held.
+func (c *Cache) evict() {
+	for c.size > c.config.MaxSize && c.lru.Len() > 0 {
+		e := c.lru.Back().Value.(*entry)
+		c.logger.Debug().
+			Str("url", e.key.URL).
+			Msg("evicting cache entry")
+		c.remove(e)
+		c.stats.Evictions++
+	}
+}
+
+// Purge removes entries of url (all its variants) from cache, or all entries if url is empty.
+// It returns the number of removed entries.
+func (c *Cache) Purge(url string) int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := 0
+	for key, e := range c.entries {
+		if url == "" || key.URL == url {
+			c.remove(e)
+			n++
+		}
+	}
+	return n
+}
+
+// Stats returns a snapshot of cache statistics.
+func (c *Cache) Stats() Stats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Blobs = len(c.blobs)
+	stats.Size = c.size
+	stats.MaxSize = c.config.MaxSize
+	return stats
+}
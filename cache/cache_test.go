@@ -0,0 +1,255 @@
+package cache
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestCache(t *testing.T) *Cache {
+	t.Helper()
+	c, err := NewCache(Config{Directory: t.TempDir(), MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func response(status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode:    status,
+		Status:        http.StatusText(status),
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func get(t *testing.T, c *Cache, key Key, ttl time.Duration, do FetchFunc) string {
+	t.Helper()
+	obj, err := c.Get(key, ttl, do)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	b, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNewCache(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"tmp/fetch-1", "tmp/sha256/0123", "sha256/0123", "unrelated"} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewCache(Config{Directory: dir}); err != nil {
+		t.Fatal(err)
+	}
+	for name, exists := range map[string]bool{"tmp/fetch-1": false, "tmp/sha256/0123": false, "tmp/sha256": true, "sha256/0123": true, "unrelated": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != exists {
+			t.Errorf("%s exists: %v, want %v", name, err == nil, exists)
+		}
+	}
+}
+
+func TestRevalidation(t *testing.T) {
+	c := newTestCache(t)
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+
+	var requests []http.Header
+	var respond func() *http.Response
+	do := func(header http.Header) (*http.Response, error) {
+		requests = append(requests, header)
+		return respond(), nil
+	}
+
+	// must be revalidated on every use
+	respond = func() *http.Response {
+		return response(http.StatusOK, http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}, "Last-Modified": {lastModified}}, "v1")
+	}
+	if got := get(t, c, Key{URL: "http://upstream/a"}, 0, do); got != "v1" {
+		t.Fatalf("got %q", got)
+	}
+	if len(requests[0]) != 0 {
+		t.Errorf("first request has validators %v", requests[0])
+	}
+
+	respond = func() *http.Response {
+		return response(http.StatusNotModified, http.Header{"Cache-Control": {"max-age=3600"}}, "")
+	}
+	if got := get(t, c, Key{URL: "http://upstream/a"}, 0, do); got != "v1" {
+		t.Errorf("got %q after revalidation", got)
+	}
+	if len(requests) != 2 || requests[1].Get("If-None-Match") != `"v1"` || requests[1].Get("If-Modified-Since") != lastModified {
+		t.Fatalf("revalidation requests %v", requests)
+	}
+
+	// fresh now
+	if got := get(t, c, Key{URL: "http://upstream/a"}, 0, do); got != "v1" || len(requests) != 2 {
+		t.Errorf("got %q after %d requests", got, len(requests))
+	}
+
+	// changed upstream, replaced once stale
+	c.mutex.Lock()
+	c.entries[Key{URL: "http://upstream/a"}].expires = time.Now()
+	c.mutex.Unlock()
+	respond = func() *http.Response {
+		return response(http.StatusOK, http.Header{"Cache-Control": {"max-age=3600"}, "Etag": {`"v2"`}}, "v2")
+	}
+	if got := get(t, c, Key{URL: "http://upstream/a"}, 0, do); got != "v2" || len(requests) != 3 {
+		t.Errorf("got %q after %d requests", got, len(requests))
+	}
+
+	stats := c.Stats()
+	if stats.Hits != 1 || stats.Misses != 2 || stats.Revalidations != 1 || stats.Entries != 1 || stats.Blobs != 1 || stats.Size != 2 {
+		t.Errorf("stats %+v", stats)
+	}
+
+	// a ttl overrides upstream cache headers
+	respond = func() *http.Response {
+		return response(http.StatusOK, http.Header{"Cache-Control": {"no-store"}}, "ttl")
+	}
+	for i := 0; i < 2; i++ {
+		if got := get(t, c, Key{URL: "http://upstream/ttl"}, time.Hour, do); got != "ttl" || len(requests) != 4 {
+			t.Errorf("got %q after %d requests", got, len(requests))
+		}
+	}
+
+	// upstream errors are not cached
+	respond = func() *http.Response {
+		return response(http.StatusNotFound, nil, "not found")
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get(Key{URL: "http://upstream/missing"}, time.Hour, do); err == nil || err.(*StatusError).StatusCode != http.StatusNotFound {
+			t.Errorf("got error %v", err)
+		}
+	}
+	if len(requests) != 6 {
+		t.Errorf("%d requests", len(requests))
+	}
+}
+
+func TestVariants(t *testing.T) {
+	c := newTestCache(t)
+	fetch := func(content string) FetchFunc {
+		return func(http.Header) (*http.Response, error) {
+			return response(http.StatusOK, http.Header{"Cache-Control": {"max-age=3600"}}, content), nil
+		}
+	}
+
+	// requests with different headers are not served each other's responses
+	keys := []Key{
+		{URL: "http://upstream/a"},
+		{URL: "http://upstream/a", Variant: "host-1"},
+		{URL: "http://upstream/a", Variant: "host-2"},
+		{URL: "http://upstream/b", Variant: "host-1"},
+	}
+	for _, key := range keys {
+		if got := get(t, c, key, 0, fetch(key.URL+" "+key.Variant)); got != key.URL+" "+key.Variant {
+			t.Errorf("%+v: got %q", key, got)
+		}
+	}
+	for _, key := range keys {
+		if got := get(t, c, key, 0, fetch("refetched")); got != key.URL+" "+key.Variant {
+			t.Errorf("%+v: got %q from cache", key, got)
+		}
+	}
+
+	// all variants of the URL are purged
+	if n := c.Purge("http://upstream/a"); n != 3 {
+		t.Errorf("purged %d entries, want 3", n)
+	}
+	if stats := c.Stats(); stats.Entries != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+}
+
+// concurrentGets gets url from n goroutines while the first upstream request is blocked,
+// and returns content they got and number of upstream requests.
+func concurrentGets(t *testing.T, c *Cache, n int, header http.Header) ([]string, int) {
+	t.Helper()
+	var requests atomic.Int32
+	release := make(chan struct{})
+	do := func(http.Header) (*http.Response, error) {
+		if requests.Add(1) == 1 {
+			<-release
+		}
+		return response(http.StatusOK, header.Clone(), "content"), nil
+	}
+
+	got := make([]string, n)
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			obj, err := c.Get(Key{URL: "http://upstream/a"}, 0, do)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer obj.Close()
+			b, _ := io.ReadAll(obj)
+			got[i] = string(b)
+		}()
+	}
+	// the others wait for the blocked request
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	return got, int(requests.Load())
+}
+
+func TestWaitersShareResult(t *testing.T) {
+	c := newTestCache(t)
+	// stored, but to be revalidated on every use
+	got, requests := concurrentGets(t, c, 5, http.Header{"Cache-Control": {"no-cache"}})
+	for i, content := range got {
+		if content != "content" {
+			t.Errorf("request %d got %q", i, content)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("%d upstream requests, want 1", requests)
+	}
+}
+
+func TestWaitersUncacheable(t *testing.T) {
+	c := newTestCache(t)
+	// not stored, so each waiter requests it again
+	got, requests := concurrentGets(t, c, 5, http.Header{"Cache-Control": {"no-store"}})
+	for i, content := range got {
+		if content != "content" {
+			t.Errorf("request %d got %q", i, content)
+		}
+	}
+	if requests != 5 {
+		t.Errorf("%d upstream requests, want 5", requests)
+	}
+
+	// content is removed once it's not read anymore
+	stats := c.Stats()
+	if stats.Entries != 0 || stats.Blobs != 0 || stats.Size != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	items, err := os.ReadDir(filepath.Join(c.config.Directory, "tmp", "sha256"))
+	if err != nil || len(items) != 0 {
+		t.Errorf("%d stored blobs, %v", len(items), err)
+	}
+}
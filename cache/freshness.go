@@ -0,0 +1,59 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// freshness returns freshness lifetime of a response according to its cache headers (RFC 9111),
+// and whether it may be stored at all. Responses without explicit lifetime must be revalidated on every use.
+func freshness(h http.Header, now time.Time) (lifetime time.Duration, cacheable bool) {
+	var maxAge, sMaxAge = -1, -1
+	for _, directive := range strings.Split(strings.Join(h.Values("Cache-Control"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "private":
+			return 0, false
+		case "no-cache":
+			return 0, true
+		case "max-age":
+			maxAge = parseSeconds(value)
+		case "s-maxage":
+			sMaxAge = parseSeconds(value)
+		}
+	}
+
+	switch {
+	case sMaxAge >= 0:
+		return time.Duration(sMaxAge) * time.Second, true
+	case maxAge >= 0:
+		return time.Duration(maxAge) * time.Second, true
+	}
+
+	if expires := h.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid Expires means already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(h.Get("Date"))
+		if err != nil {
+			date = now
+		}
+		if t.After(date) {
+			return t.Sub(date), true
+		}
+	}
+
+	return 0, true
+}
+
+func parseSeconds(value string) int {
+	n, err := strconv.Atoi(strings.Trim(value, `"`))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,43 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	date := now.Add(-time.Hour).Format(http.TimeFormat)
+	tests := []struct {
+		header    http.Header
+		lifetime  time.Duration
+		cacheable bool
+	}{
+		{http.Header{}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=300"}}, 300 * time.Second, true},
+		{http.Header{"Cache-Control": {`public, max-age="60"`}}, 60 * time.Second, true},
+		{http.Header{"Cache-Control": {"Max-Age=60"}}, 60 * time.Second, true},
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=600"}}, 600 * time.Second, true},
+		{http.Header{"Cache-Control": {"s-maxage=0", "max-age=60"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=-1"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=abc"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=60, no-cache"}}, 0, true},
+		{http.Header{"Cache-Control": {"max-age=60", "no-store"}}, 0, false},
+		{http.Header{"Cache-Control": {"private, max-age=60"}}, 0, false},
+		// max-age takes precedence over Expires
+		{http.Header{"Cache-Control": {"max-age=10"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 10 * time.Second, true},
+		{http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour, true},
+		// relative to Date of the response, not the local clock
+		{http.Header{"Expires": {now.Format(http.TimeFormat)}, "Date": {date}}, time.Hour, true},
+		{http.Header{"Expires": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0, true},
+		{http.Header{"Expires": {"0"}}, 0, true},
+		{http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}, "Date": {"invalid"}}, time.Hour, true},
+	}
+	for _, tt := range tests {
+		lifetime, cacheable := freshness(tt.header, now)
+		if lifetime != tt.lifetime || cacheable != tt.cacheable {
+			t.Errorf("freshness(%v) = %s, %v, want %s, %v", tt.header, lifetime, cacheable, tt.lifetime, tt.cacheable)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Package checksum verifies content served by mounts against checksums pinned in the manifest.
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+// Error reports content that does not match the pinned checksum.
+type Error struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s checksum mismatch: expected %s, got %s", e.Algorithm, e.Expected, e.Actual)
+}
+
+// Verifier checks content against a checksum pinned on a mount.
+type Verifier struct {
+	algorithm string
+	expected  []byte
+	newHash   func() hash.Hash
+}
+
+// New returns a Verifier of mount, or nil if mount has no checksum pinned.
+// If both checksums are set, SHA-512 is used.
+func New(mount manifest.Mount) *Verifier {
+	var v *Verifier
+	if mount.Sha512 != "" {
+		v = &Verifier{algorithm: "sha512", newHash: sha512.New}
+		v.expected, _ = hex.DecodeString(mount.Sha512)
+	} else if mount.Sha256 != "" {
+		v = &Verifier{algorithm: "sha256", newHash: sha256.New}
+		v.expected, _ = hex.DecodeString(mount.Sha256)
+	}
+	return v
+}
+
+func (v *Verifier) check(h hash.Hash) error {
+	actual := h.Sum(nil)
+	if bytes.Equal(actual, v.expected) {
+		return nil
+	}
+	return &Error{
+		Algorithm: v.algorithm,
+		Expected:  hex.EncodeToString(v.expected),
+		Actual:    hex.EncodeToString(actual),
+	}
+}
+
+// VerifyReader reads r to the end and verifies its content.
+func (v *Verifier) VerifyReader(r io.Reader) error {
+	h := v.newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return err
+	}
+	return v.check(h)
+}
+
+type fileKey struct {
+	name      string
+	size      int64
+	modTime   time.Time
+	algorithm string
+	expected  string
+}
+
+// files remembers files that were verified already, so that they are not hashed on every request.
+var files sync.Map
+
+// VerifyFile verifies the whole content of f, regardless of its current offset.
+// Successful results are remembered for as long as the file's name, size and modification time do not change.
+func (v *Verifier) VerifyFile(f *os.File) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	key := fileKey{
+		name:      f.Name(),
+		size:      stat.Size(),
+		modTime:   stat.ModTime(),
+		algorithm: v.algorithm,
+		expected:  string(v.expected),
+	}
+	if _, ok := files.Load(key); ok {
+		return nil
+	}
+
+	if err := v.VerifyReader(io.NewSectionReader(f, 0, stat.Size())); err != nil {
+		return err
+	}
+	files.Store(key, struct{}{})
+	return nil
+}
+
+// Reader returns a reader verifying content of r while it's read.
+// The last byte is held back until r is exhausted, so that content not matching the checksum is never
+// returned completely. In that case, *Error is returned instead of io.EOF, after calling onMismatch if not nil.
+func (v *Verifier) Reader(r io.Reader, onMismatch func(err error)) io.Reader {
+	return &reader{
+		r:          r,
+		verifier:   v,
+		hash:       v.newHash(),
+		onMismatch: onMismatch,
+		storage:    make([]byte, 0, 32*1024),
+	}
+}
+
+type reader struct {
+	r          io.Reader
+	verifier   *Verifier
+	hash       hash.Hash
+	onMismatch func(err error)
+
+	storage []byte
+	// read from r but not yet returned
+	buf      []byte
+	verified bool
+	err      error
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	for {
+		if r.verified {
+			if len(r.buf) == 0 {
+				return 0, io.EOF
+			}
+			n := copy(p, r.buf)
+			r.buf = r.buf[n:]
+			return n, nil
+		}
+		// content read before an error is returned first, except the held back byte
+		if len(r.buf) > 1 {
+			n := copy(p, r.buf[:len(r.buf)-1])
+			r.buf = r.buf[n:]
+			return n, nil
+		}
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		// keep the held back byte and read more after it
+		held := copy(r.storage[:cap(r.storage)], r.buf)
+		n, err := r.r.Read(r.storage[held:cap(r.storage)])
+		r.hash.Write(r.storage[held : held+n])
+		r.buf = r.storage[:held+n]
+		if err == io.EOF {
+			if verr := r.verifier.check(r.hash); verr != nil {
+				r.err = verr
+				if r.onMismatch != nil {
+					r.onMismatch(verr)
+				}
+				continue
+			}
+			r.verified = true
+		} else if err != nil {
+			r.err = err
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package checksum
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestNew(t *testing.T) {
+	if v := New(manifest.Mount{}); v != nil {
+		t.Errorf("verifier of mount without checksum: %+v", v)
+	}
+	sum := sha512.Sum512([]byte("content"))
+	v := New(manifest.Mount{Sha256: sha256Hex("other"), Sha512: hex.EncodeToString(sum[:])})
+	if err := v.VerifyReader(strings.NewReader("content")); err != nil || v.algorithm != "sha512" {
+		t.Errorf("%s verifier: %v", v.algorithm, err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	content := strings.Repeat("0123456789", 10000)
+	// differs in the last byte only
+	mismatch := content[:len(content)-1] + "x"
+
+	readers := map[string]func(io.Reader) io.Reader{
+		"plain":    func(r io.Reader) io.Reader { return r },
+		"one byte": iotest.OneByteReader,
+		"half":     iotest.HalfReader,
+		// returns io.EOF together with the last data
+		"data err": iotest.DataErrReader,
+	}
+	for name, wrap := range readers {
+		t.Run(name, func(t *testing.T) {
+			v := New(manifest.Mount{Sha256: sha256Hex(content)})
+
+			got, err := io.ReadAll(v.Reader(wrap(strings.NewReader(content)), func(err error) {
+				t.Errorf("mismatch reported for matching content: %v", err)
+			}))
+			if err != nil || string(got) != content {
+				t.Errorf("read %d bytes, %v, want %d bytes", len(got), err, len(content))
+			}
+
+			var reported []error
+			r := v.Reader(wrap(strings.NewReader(mismatch)), func(err error) {
+				reported = append(reported, err)
+			})
+			got, err = io.ReadAll(r)
+			var cerr *Error
+			if !errors.As(err, &cerr) || cerr.Expected != sha256Hex(content) || cerr.Actual != sha256Hex(mismatch) {
+				t.Errorf("got error %v", err)
+			}
+			// everything but the mismatching last byte
+			if string(got) != content[:len(content)-1] {
+				t.Errorf("read %d bytes, want %d", len(got), len(content)-1)
+			}
+			// the error sticks, reported once
+			if _, err := r.Read(make([]byte, 10)); err != cerr || len(reported) != 1 {
+				t.Errorf("read again: %v, %d reported", err, len(reported))
+			}
+		})
+	}
+}
+
+func TestReaderEmpty(t *testing.T) {
+	v := New(manifest.Mount{Sha256: sha256Hex("")})
+	if got, err := io.ReadAll(v.Reader(strings.NewReader(""), nil)); err != nil || len(got) != 0 {
+		t.Errorf("read %q, %v", got, err)
+	}
+	if got, err := io.ReadAll(v.Reader(strings.NewReader("x"), nil)); !errors.As(err, new(*Error)) || len(got) != 0 {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	v := New(manifest.Mount{Sha256: sha256Hex("content")})
+	failure := errors.New("failure")
+	r := v.Reader(io.MultiReader(strings.NewReader("cont"), iotest.ErrReader(failure)), func(err error) {
+		t.Errorf("mismatch reported for read error: %v", err)
+	})
+	if got, err := io.ReadAll(r); err != failure || string(got) != "con" {
+		t.Errorf("read %q, %v", got, err)
+	}
+}
+
+func TestVerifyFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "vmlinuz")
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	write := func(content string, modTime time.Time) *os.File {
+		t.Helper()
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	v := New(manifest.Mount{Sha256: sha256Hex("kernel")})
+
+	f := write("kernel", modTime)
+	// regardless of the current offset
+	if _, err := f.Seek(3, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.VerifyFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if off, _ := f.Seek(0, io.SeekCurrent); off != 3 {
+		t.Errorf("offset changed to %d", off)
+	}
+
+	// remembered while name, size and modification time don't change
+	f = write("KERNEL", modTime)
+	if err := v.VerifyFile(f); err != nil {
+		t.Errorf("verified again: %v", err)
+	}
+
+	// replaced with content of the same size
+	f = write("KERNEL", modTime.Add(time.Second))
+	if err := v.VerifyFile(f); !errors.As(err, new(*Error)) {
+		t.Errorf("replaced file: %v", err)
+	}
+	f = write("kernel", modTime.Add(2*time.Second))
+	if err := v.VerifyFile(f); err != nil {
+		t.Errorf("restored file: %v", err)
+	}
+
+	// failures are not remembered
+	f = write("KERNEL", modTime.Add(3*time.Second))
+	for i := 0; i < 2; i++ {
+		if err := v.VerifyFile(f); !errors.As(err, new(*Error)) {
+			t.Errorf("replaced file: %v", err)
+		}
+	}
+
+	// nor shared with other checksums
+	other := New(manifest.Mount{Sha256: sha256Hex("other")})
+	f = write("kernel", modTime.Add(4*time.Second))
+	if err := v.VerifyFile(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.VerifyFile(f); !errors.As(err, new(*Error)) {
+		t.Errorf("verified with other checksum: %v", err)
+	}
+}
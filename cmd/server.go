@@ -2,16 +2,28 @@ package cmd
 
 import (
 	"net"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/DSpeichert/netbootd/api"
+	"github.com/DSpeichert/netbootd/blob"
+	"github.com/DSpeichert/netbootd/cache"
 	"github.com/DSpeichert/netbootd/config"
 	"github.com/DSpeichert/netbootd/dhcpd"
+	"github.com/DSpeichert/netbootd/grub"
 	"github.com/DSpeichert/netbootd/httpd"
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/program"
+	"github.com/DSpeichert/netbootd/render"
 	"github.com/DSpeichert/netbootd/store"
 	"github.com/DSpeichert/netbootd/syslogd"
+	"github.com/DSpeichert/netbootd/templates"
 	"github.com/DSpeichert/netbootd/tftpd"
+	"github.com/DSpeichert/netbootd/upstream"
 	systemd "github.com/coreos/go-systemd/v22/daemon"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -23,12 +35,42 @@ var (
 	addr         string
 	ifname       string
 	httpPort     int
+	httpBaseUrl  string
 	syslogPort   int
 	apiPort      int
 	apiTlsCert   string
 	apiTlsKey    string
 	manifestPath string
 	rootPath     string
+
+	tftpBlksizeMax    int
+	tftpWindowsizeMax int
+	tftpTimeout       time.Duration
+	tftpRetries       int
+	tftpSinglePort    bool
+	tftpSpoolMemory   int64
+	tftpSpoolDir      string
+
+	cacheDir     string
+	cacheMaxSize int64
+
+	proxyTimeout      time.Duration
+	proxyUnhealthyFor time.Duration
+	proxySecretsDir   string
+
+	execConcurrency int
+	execCommands    []string
+
+	blobDir         string
+	blobGracePeriod time.Duration
+	blobGCInterval  time.Duration
+
+	templateDir       string
+	templateFunctions []string
+	templateTimeout   time.Duration
+	templateMaxSize   int64
+
+	grubDir string
 )
 
 func init() {
@@ -38,6 +80,9 @@ func init() {
 	serverCmd.Flags().IntVarP(&httpPort, "http-port", "p", 8080, "HTTP port to listen on")
 	viper.BindPFlag("http.port", serverCmd.Flags().Lookup("http-port"))
 
+	serverCmd.Flags().StringVar(&httpBaseUrl, "http-base-url", "", "URL of the HTTP server as reachable by clients, e.g. through NAT or a reverse proxy (default: address the request was received on)")
+	viper.BindPFlag("http.baseUrl", serverCmd.Flags().Lookup("http-base-url"))
+
 	serverCmd.Flags().IntVarP(&syslogPort, "syslog-port", "s", 514, "Syslog port to listen on")
 	viper.BindPFlag("syslog.port", serverCmd.Flags().Lookup("syslog-port"))
 
@@ -59,6 +104,72 @@ func init() {
 	serverCmd.Flags().StringVarP(&rootPath, "root", "", "", "if not given as an absolute path, a mount's path.localDir is relative to this directory")
 	viper.BindPFlag("rootPath", serverCmd.Flags().Lookup("root"))
 
+	serverCmd.Flags().IntVar(&tftpBlksizeMax, "tftp-blksize-max", 0, "largest TFTP block size accepted from clients (default: interface MTU)")
+	viper.BindPFlag("tftp.blksizeMax", serverCmd.Flags().Lookup("tftp-blksize-max"))
+
+	serverCmd.Flags().IntVar(&tftpWindowsizeMax, "tftp-windowsize-max", 16, "largest TFTP window size (RFC 7440) accepted from clients, 1 disables windowing")
+	viper.BindPFlag("tftp.windowsizeMax", serverCmd.Flags().Lookup("tftp-windowsize-max"))
+
+	serverCmd.Flags().DurationVar(&tftpTimeout, "tftp-timeout", 5*time.Second, "TFTP retransmit timeout")
+	viper.BindPFlag("tftp.timeout", serverCmd.Flags().Lookup("tftp-timeout"))
+
+	serverCmd.Flags().IntVar(&tftpRetries, "tftp-retries", 5, "TFTP retransmits before a transfer is aborted")
+	viper.BindPFlag("tftp.retries", serverCmd.Flags().Lookup("tftp-retries"))
+
+	serverCmd.Flags().BoolVar(&tftpSinglePort, "tftp-single-port", false, "serve all TFTP transfers from port 69 instead of ephemeral ports (for firewalls and NAT)")
+	viper.BindPFlag("tftp.singlePort", serverCmd.Flags().Lookup("tftp-single-port"))
+
+	serverCmd.Flags().Int64Var(&tftpSpoolMemory, "tftp-spool-memory-max", 64<<20, "bytes of a spooled TFTP proxy response kept in memory before spilling to disk")
+	viper.BindPFlag("tftp.spoolMemoryMax", serverCmd.Flags().Lookup("tftp-spool-memory-max"))
+
+	serverCmd.Flags().StringVar(&tftpSpoolDir, "tftp-spool-dir", "", "directory for spooled TFTP proxy responses (default: system temporary directory)")
+	viper.BindPFlag("tftp.spoolDir", serverCmd.Flags().Lookup("tftp-spool-dir"))
+
+	serverCmd.Flags().StringVar(&cacheDir, "cache-dir", filepath.Join(os.TempDir(), "netbootd-cache"), "directory for cached responses of proxy mounts")
+	viper.BindPFlag("cache.directory", serverCmd.Flags().Lookup("cache-dir"))
+
+	serverCmd.Flags().Int64Var(&cacheMaxSize, "cache-max-size", 4<<30, "maximum size of cached responses of proxy mounts in bytes")
+	viper.BindPFlag("cache.maxSize", serverCmd.Flags().Lookup("cache-max-size"))
+
+	serverCmd.Flags().DurationVar(&proxyTimeout, "proxy-timeout", 30*time.Second, "time each upstream attempt of proxy mounts may wait for response headers before failing over")
+	viper.BindPFlag("proxy.timeout", serverCmd.Flags().Lookup("proxy-timeout"))
+
+	serverCmd.Flags().DurationVar(&proxyUnhealthyFor, "proxy-unhealthy-for", time.Minute, "time a failed upstream of proxy mounts is tried only after healthy ones")
+	viper.BindPFlag("proxy.unhealthyFor", serverCmd.Flags().Lookup("proxy-unhealthy-for"))
+
+	serverCmd.Flags().StringVar(&proxySecretsDir, "proxy-secrets-dir", "", "directory with credential files of proxyAuth, which are relative to it (default: proxyAuth disabled)")
+	viper.BindPFlag("proxy.secretsDir", serverCmd.Flags().Lookup("proxy-secrets-dir"))
+
+	serverCmd.Flags().IntVar(&execConcurrency, "exec-concurrency", 4, "maximum number of programs of exec mounts running at the same time, 0 for no limit")
+	viper.BindPFlag("exec.concurrency", serverCmd.Flags().Lookup("exec-concurrency"))
+
+	serverCmd.Flags().StringSliceVar(&execCommands, "exec-commands", nil, "absolute paths of programs exec mounts may run (default: none)")
+	viper.BindPFlag("exec.commands", serverCmd.Flags().Lookup("exec-commands"))
+
+	serverCmd.Flags().StringVar(&blobDir, "blob-dir", "", "directory of the blob store for artifacts uploaded through the API (default: disabled)")
+	viper.BindPFlag("blobs.directory", serverCmd.Flags().Lookup("blob-dir"))
+
+	serverCmd.Flags().DurationVar(&blobGracePeriod, "blob-grace-period", time.Hour, "time after upload before an unreferenced blob may be garbage-collected")
+	viper.BindPFlag("blobs.gracePeriod", serverCmd.Flags().Lookup("blob-grace-period"))
+
+	serverCmd.Flags().DurationVar(&blobGCInterval, "blob-gc-interval", 10*time.Minute, "interval of garbage collection of unreferenced blobs")
+	viper.BindPFlag("blobs.gcInterval", serverCmd.Flags().Lookup("blob-gc-interval"))
+
+	serverCmd.Flags().StringVar(&templateDir, "templates", "", "directory of the template library shared by content of all mounts")
+	viper.BindPFlag("templates.directory", serverCmd.Flags().Lookup("templates"))
+
+	serverCmd.Flags().StringSliceVar(&templateFunctions, "template-functions", []string{templates.DefaultFunctions}, "functions allowed in templates, \"default\" stands for the default allow-list (all except env, expandenv, getHostByName and key generation)")
+	viper.BindPFlag("templates.functions", serverCmd.Flags().Lookup("template-functions"))
+
+	serverCmd.Flags().DurationVar(&templateTimeout, "template-timeout", 5*time.Second, "maximum duration of a template execution, 0 for no limit")
+	viper.BindPFlag("templates.timeout", serverCmd.Flags().Lookup("template-timeout"))
+
+	serverCmd.Flags().Int64Var(&templateMaxSize, "template-max-size", 16<<20, "maximum size of rendered templates in bytes, 0 for no limit")
+	viper.BindPFlag("templates.maxSize", serverCmd.Flags().Lookup("template-max-size"))
+
+	serverCmd.Flags().StringVar(&grubDir, "grub-dir", "", "directory with shim and GRUB binaries per architecture (amd64, arm64) for manifests with grub enabled")
+	viper.BindPFlag("grub.directory", serverCmd.Flags().Lookup("grub-dir"))
+
 	rootCmd.AddCommand(serverCmd)
 }
 
@@ -90,9 +201,70 @@ var serverCmd = &cobra.Command{
 		store.GlobalHints.HttpPort = viper.GetInt("http.port")
 		store.GlobalHints.SyslogPort = viper.GetInt("syslog.port")
 		store.GlobalHints.ApiPort = viper.GetInt("api.port")
+		if viper.GetString("http.baseUrl") != "" {
+			u, err := url.Parse(viper.GetString("http.baseUrl"))
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				log.Fatal().Str("url", viper.GetString("http.baseUrl")).Msg("Invalid HTTP base URL")
+			}
+			u.Path = strings.TrimSuffix(u.Path, "/")
+			store.GlobalHints.HttpBaseUrl = u
+		}
+
+		// proxy cache
+		proxyCache, err := cache.NewCache(cache.Config{
+			Directory: viper.GetString("cache.directory"),
+			MaxSize:   viper.GetInt64("cache.maxSize"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create proxy cache")
+		}
+
+		// upstreams of proxy mounts
+		upstreams := upstream.NewPool(upstream.Config{
+			Timeout:          viper.GetDuration("proxy.timeout"),
+			UnhealthyFor:     viper.GetDuration("proxy.unhealthyFor"),
+			SecretsDirectory: viper.GetString("proxy.secretsDir"),
+		})
+
+		// programs of exec mounts
+		programs := program.NewRunner(program.Config{
+			Concurrency: viper.GetInt("exec.concurrency"),
+			Commands:    viper.GetStringSlice("exec.commands"),
+		})
+
+		// blob store, optional
+		var blobs *blob.Store
+		if viper.GetString("blobs.directory") != "" {
+			blobs, err = blob.NewStore(blob.Config{
+				Directory:   viper.GetString("blobs.directory"),
+				GracePeriod: viper.GetDuration("blobs.gracePeriod"),
+			}, store)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Failed to open blob store")
+			}
+			if viper.GetDuration("blobs.gcInterval") > 0 {
+				go blobs.CollectEvery(viper.GetDuration("blobs.gcInterval"))
+			}
+		}
+
+		// template library
+		library, err := templates.NewLibrary(templates.Config{
+			Directory: viper.GetString("templates.directory"),
+			Functions: viper.GetStringSlice("templates.functions"),
+			Timeout:   viper.GetDuration("templates.timeout"),
+			MaxSize:   viper.GetInt64("templates.maxSize"),
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to load template library")
+		}
+		if err := library.Watch(); err != nil {
+			log.Fatal().Err(err).Msg("Failed to watch template library")
+		}
+		renderer := render.NewRenderer(store, library)
+		grubLoader := grub.NewLoader(viper.GetString("grub.directory"))
 
 		// DHCP
-		dhcpServer, err := dhcpd.NewServer(viper.GetString("address"), viper.GetString("interface"), store)
+		dhcpServer, err := dhcpd.NewServer(viper.GetString("address"), viper.GetString("interface"), store, grubLoader)
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to create DHCP server")
 		}
@@ -109,7 +281,24 @@ var serverCmd = &cobra.Command{
 		}
 
 		// TFTP
-		tftpServer, err := tftpd.NewServer(store, viper.GetString("rootPath"))
+		tftpServer, err := tftpd.NewServer(store, viper.GetString("rootPath"), tftpd.Deps{
+			Cache:     proxyCache,
+			Upstreams: upstreams,
+			Programs:  programs,
+			Blobs:     blobs,
+			Renderer:  renderer,
+			Grub:      grubLoader,
+		}, tftpd.Config{
+			Transfer: manifest.TFTPOptions{
+				BlksizeMax:    viper.GetInt("tftp.blksizeMax"),
+				WindowsizeMax: viper.GetInt("tftp.windowsizeMax"),
+				Timeout:       viper.GetDuration("tftp.timeout"),
+				Retries:       viper.GetInt("tftp.retries"),
+			},
+			SinglePort:     viper.GetBool("tftp.singlePort"),
+			SpoolMemoryMax: viper.GetInt64("tftp.spoolMemoryMax"),
+			SpoolDir:       viper.GetString("tftp.spoolDir"),
+		})
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to create TFTP server")
 		}
@@ -123,7 +312,14 @@ var serverCmd = &cobra.Command{
 		go tftpServer.Serve(connTftp)
 
 		// HTTP service
-		httpServer, err := httpd.NewServer(store, viper.GetString("rootPath"))
+		httpServer, err := httpd.NewServer(store, viper.GetString("rootPath"), httpd.Deps{
+			Cache:     proxyCache,
+			Upstreams: upstreams,
+			Programs:  programs,
+			Blobs:     blobs,
+			Renderer:  renderer,
+			Grub:      grubLoader,
+		})
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to create HTTP server")
 		}
@@ -155,7 +351,13 @@ var serverCmd = &cobra.Command{
 		log.Info().Interface("syslog", syslogAddr).Msg("Syslog listening...")
 
 		// HTTP API service
-		apiServer, err := api.NewServer(store, viper.GetString("api.authorization"), viper.GetString("rootPath"))
+		apiServer, err := api.NewServer(store, api.Deps{
+			Cache:     proxyCache,
+			Upstreams: upstreams,
+			Programs:  programs,
+			Blobs:     blobs,
+			Templates: library,
+		}, viper.GetString("api.authorization"), viper.GetString("rootPath"))
 		if err != nil {
 			log.Fatal().Err(err).Msg("Failed to create HTTP API server")
 		}
@@ -0,0 +1,69 @@
+package dhcpd
+
+import (
+	"time"
+
+	mfest "github.com/DSpeichert/netbootd/manifest"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// clientArch describes a client system architecture (option 93).
+type clientArch struct {
+	arch     string
+	firmware string
+	httpBoot bool
+}
+
+var clientArchs = map[iana.Arch]clientArch{
+	iana.INTEL_X86PC:      {"x86", "bios", false},
+	iana.EFI_IA32:         {"i386", "uefi", false},
+	iana.EFI_X86_64:       {"amd64", "uefi", false},
+	iana.EFI_BC:           {"amd64", "uefi", false}, // sent by many x86-64 UEFI implementations
+	iana.EFI_ARM32:        {"arm", "uefi", false},
+	iana.EFI_ARM64:        {"arm64", "uefi", false},
+	iana.EFI_X86_HTTP:     {"i386", "uefi", true},
+	iana.EFI_X86_64_HTTP:  {"amd64", "uefi", true},
+	iana.EFI_BC_HTTP:      {"amd64", "uefi", true},
+	iana.EFI_ARM32_HTTP:   {"arm", "uefi", true},
+	iana.EFI_ARM64_HTTP:   {"arm64", "uefi", true},
+	iana.INTEL_X86PC_HTTP: {"x86", "bios", true},
+	iana.UBOOT_ARM32:      {"arm", "uboot", false},
+	iana.UBOOT_ARM64:      {"arm64", "uboot", false},
+	iana.UBOOT_ARM32_HTTP: {"arm", "uboot", true},
+	iana.UBOOT_ARM64_HTTP: {"arm64", "uboot", true},
+	iana.EFI_RISCV32:      {"riscv32", "uefi", false},
+	iana.EFI_RISCV32_HTTP: {"riscv32", "uefi", true},
+	iana.EFI_RISCV64:      {"riscv64", "uefi", false},
+	iana.EFI_RISCV64_HTTP: {"riscv64", "uefi", true},
+}
+
+// dhcpFacts returns facts of req. Operating systems and installers don't send the client architecture,
+// so it is taken from previous facts (if any) when missing, to remember how the client booted.
+func dhcpFacts(req *dhcpv4.DHCPv4, previous *mfest.DHCPFacts) mfest.DHCPFacts {
+	facts := mfest.DHCPFacts{
+		MAC:         req.ClientHWAddr,
+		ArchCode:    -1,
+		VendorClass: req.ClassIdentifier(),
+		UserClass:   req.UserClass(),
+		Hostname:    req.HostName(),
+		Time:        time.Now(),
+	}
+	if !req.GatewayIPAddr.IsUnspecified() {
+		facts.RelayIP = req.GatewayIPAddr
+	}
+
+	if archs := req.ClientArch(); len(archs) > 0 {
+		arch := clientArchs[archs[0]]
+		facts.ArchCode = int(archs[0])
+		facts.Arch = arch.arch
+		facts.Firmware = arch.firmware
+		facts.HTTPBoot = arch.httpBoot
+	} else if previous != nil {
+		facts.ArchCode = previous.ArchCode
+		facts.Arch = previous.Arch
+		facts.Firmware = previous.Firmware
+		facts.HTTPBoot = previous.HTTPBoot
+	}
+	return facts
+}
@@ -20,6 +20,9 @@ func (server *Server) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, peer net.
 		err          error
 		bootFileSize int
 		manifest     *mfest.Manifest
+		isIpxe       bool
+		grubFilename string
+		serveNBP     bool
 	)
 
 	req, err := dhcpv4.FromBytes(buf)
@@ -86,6 +89,22 @@ func (server *Server) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, peer net.
 		goto response
 	}
 
+	// the firmware starting over ends a boot with the next boot profile
+	if req.MessageType() == dhcpv4.MessageTypeDiscover && isFirmwareBoot(req) {
+		if m := server.store.StartBoot(manifest.ID); m != nil {
+			manifest = m
+		}
+	}
+
+	if manifest.IsSuspendedBoot(mfest.SuspendedBootIgnore) {
+		server.logger.Info().
+			Str("MAC", req.ClientHWAddr.String()).
+			Str("manifest", manifest.ID).
+			Msg("ignore packet from suspended host")
+		resp = nil
+		goto response
+	}
+
 	// server ID
 	if req.ServerIPAddr != nil &&
 		!req.ServerIPAddr.Equal(net.IPv4zero) &&
@@ -100,6 +119,9 @@ func (server *Server) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, peer net.
 		resp.UpdateOption(dhcpv4.OptServerIdentifier(localIp))
 	}
 
+	// remembered for templates of content served to the client later
+	server.store.RecordDHCP(manifest.ID, dhcpFacts(req, server.store.DHCPFacts(manifest.ID)))
+
 	resp.YourIPAddr = manifest.IPv4.IP
 	resp.Options.Update(dhcpv4.OptSubnetMask(manifest.IPv4.Net.Mask))
 
@@ -129,14 +151,27 @@ func (server *Server) HandleMsg4(buf []byte, oob *ipv4.ControlMessage, peer net.
 	}
 
 	// NBP
-	if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) && !manifest.Suspended {
+	isIpxe = stringSlicesEqual(req.UserClass(), []string{"iPXE"})
+	// UEFI clients booting with shim and GRUB, if binaries for their architecture are provided
+	// (suspended hosts booting from their local disk with iPXE don't)
+	if facts := server.store.DHCPFacts(manifest.ID); manifest.Grub && !isIpxe && len(req.ClientArch()) > 0 &&
+		facts != nil && facts.Firmware == "uefi" && !manifest.IsSuspendedBoot(mfest.SuspendedBootIPXE) {
+		grubFilename = server.grub.BootFilename(facts.Arch)
+	}
+	// suspended hosts get a NBP only to boot from their local disk
+	serveNBP = !manifest.Suspended || manifest.IsSuspendedBoot(mfest.SuspendedBootIPXE) ||
+		(manifest.IsSuspendedBoot(mfest.SuspendedBootGRUB) && grubFilename != "")
+
+	if req.IsOptionRequested(dhcpv4.OptionTFTPServerName) && serveNBP {
 		resp.Options.Update(dhcpv4.OptTFTPServerName(localIp.String()))
 	}
 
-	if req.IsOptionRequested(dhcpv4.OptionBootfileName) && !manifest.Suspended {
+	if req.IsOptionRequested(dhcpv4.OptionBootfileName) && serveNBP {
 		// serve iPXE script if user-class is iPXE, or whatever the user chooses if iPXE is disabled
-		if stringSlicesEqual(req.UserClass(), []string{"iPXE"}) || !manifest.Ipxe {
-			resp.Options.Update(dhcpv4.OptBootFileName(manifest.BootFilename))
+		if grubFilename != "" {
+			resp.Options.Update(dhcpv4.OptBootFileName(grubFilename))
+		} else if isIpxe || !manifest.Ipxe {
+			resp.Options.Update(dhcpv4.OptBootFileName(manifest.GetBootFilename()))
 		} else if len(req.ClientArch()) > 0 && req.ClientArch()[0] > 0 {
 			// likely UEFI (not BIOS)
 			if strings.Contains(req.ClassIdentifier(), "PXEClient:Arch:00011") {
@@ -241,6 +276,14 @@ response:
 	}
 }
 
+// isFirmwareBoot reports whether req is sent by the network boot firmware (PXE or UEFI HTTP boot) of the client,
+// rather than by iPXE or an operating system.
+func isFirmwareBoot(req *dhcpv4.DHCPv4) bool {
+	vendorClass := req.ClassIdentifier()
+	return len(req.ClientArch()) > 0 && !stringSlicesEqual(req.UserClass(), []string{"iPXE"}) &&
+		(strings.HasPrefix(vendorClass, "PXEClient") || strings.HasPrefix(vendorClass, "HTTPClient"))
+}
+
 func stringSlicesEqual(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
@@ -0,0 +1,56 @@
+package dhcpd
+
+import (
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestIsFirmwareBoot(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  []dhcpv4.Option
+		firmware bool
+	}{
+		{"BIOS PXE", []dhcpv4.Option{
+			dhcpv4.OptClassIdentifier("PXEClient:Arch:00000:UNDI:002001"),
+			dhcpv4.OptClientArch(iana.INTEL_X86PC),
+		}, true},
+		{"UEFI PXE", []dhcpv4.Option{
+			dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003016"),
+			dhcpv4.OptClientArch(iana.EFI_X86_64),
+		}, true},
+		{"UEFI HTTP", []dhcpv4.Option{
+			dhcpv4.OptClassIdentifier("HTTPClient:Arch:00016:UNDI:003001"),
+			dhcpv4.OptClientArch(iana.EFI_X86_64_HTTP),
+		}, true},
+		{"iPXE", []dhcpv4.Option{
+			dhcpv4.OptClassIdentifier("PXEClient:Arch:00007:UNDI:003010"),
+			dhcpv4.OptClientArch(iana.EFI_X86_64),
+			dhcpv4.OptUserClass("iPXE"),
+		}, false},
+		{"operating system", []dhcpv4.Option{
+			dhcpv4.OptClassIdentifier("udhcp 1.36.1"),
+		}, false},
+		{"without client architecture", []dhcpv4.Option{
+			dhcpv4.OptClassIdentifier("PXEClient"),
+		}, false},
+		{"without vendor class", []dhcpv4.Option{
+			dhcpv4.OptClientArch(iana.EFI_X86_64),
+		}, false},
+	}
+	for _, tt := range tests {
+		var modifiers []dhcpv4.Modifier
+		for _, opt := range tt.options {
+			modifiers = append(modifiers, dhcpv4.WithOption(opt))
+		}
+		req, err := dhcpv4.New(modifiers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isFirmwareBoot(req); got != tt.firmware {
+			t.Errorf("isFirmwareBoot(%s) = %v, want %v", tt.name, got, tt.firmware)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 
+	"github.com/DSpeichert/netbootd/grub"
 	"github.com/DSpeichert/netbootd/store"
 	"github.com/insomniacslk/dhcp/dhcpv4/server4"
 	"github.com/rs/zerolog"
@@ -20,9 +21,10 @@ type Server struct {
 	address *net.UDPAddr
 	logger  zerolog.Logger
 	store   *store.Store
+	grub    *grub.Loader
 }
 
-func NewServer(addr, ifname string, store *store.Store) (server *Server, err error) {
+func NewServer(addr, ifname string, store *store.Store, grub *grub.Loader) (server *Server, err error) {
 	var ip net.IP
 	// only parse addr if non-zero length
 	if addr != "" {
@@ -39,6 +41,7 @@ func NewServer(addr, ifname string, store *store.Store) (server *Server, err err
 		},
 		logger: log.With().Str("service", "dhcpv4").Logger(),
 		store:  store,
+		grub:   grub,
 	}
 
 	return server, nil
@@ -0,0 +1,83 @@
+// Package grub serves user-provided shim and GRUB binaries to boot UEFI clients with GRUB,
+// e.g. when Secure Boot only permits signed loaders.
+package grub
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Path under which binaries are served (over TFTP and HTTP), followed by the architecture, e.g. grub/amd64/shimx64.efi.
+const Path = "grub/"
+
+// ErrNotFound is returned for paths not served by the loader.
+var ErrNotFound = errors.New("grub binary not found")
+
+// binaries are named as shim expects to find GRUB next to itself.
+var binaries = map[string]struct{ shim, grub string }{
+	"amd64": {"shimx64.efi", "grubx64.efi"},
+	"arm64": {"shimaa64.efi", "grubaa64.efi"},
+}
+
+// Loader serves files of a directory with a subdirectory for each architecture ("amd64", "arm64"),
+// containing GRUB (grubx64.efi, grubaa64.efi) and optionally shim (shimx64.efi, shimaa64.efi),
+// as well as anything else they load, such as MokManager.
+type Loader struct {
+	directory string
+}
+
+// NewLoader returns a loader serving binaries from directory, empty means none are served.
+func NewLoader(directory string) *Loader {
+	return &Loader{directory: directory}
+}
+
+// BootFilename returns the path of the binary a client of arch boots first: shim if provided, GRUB otherwise.
+// It's empty if neither is.
+func (l *Loader) BootFilename(arch string) string {
+	b, ok := binaries[arch]
+	if !ok || l.directory == "" {
+		return ""
+	}
+	for _, name := range []string{b.shim, b.grub} {
+		if fi, err := os.Stat(filepath.Join(l.directory, arch, name)); err == nil && fi.Mode().IsRegular() {
+			return Path + arch + "/" + name
+		}
+	}
+	return ""
+}
+
+// IsImageDirectory reports whether dir (without leading slash) is the directory GRUB of a known architecture
+// is loaded from, e.g. grub/amd64.
+func IsImageDirectory(dir string) bool {
+	arch, ok := strings.CutPrefix(dir, Path)
+	_, known := binaries[arch]
+	return ok && known
+}
+
+// Open opens the file requested with p, which must be below Path and the directory of a known architecture.
+func (l *Loader) Open(p string) (*os.File, error) {
+	rest, ok := strings.CutPrefix(strings.TrimLeft(p, "/"), Path)
+	if !ok || l.directory == "" {
+		return nil, ErrNotFound
+	}
+	rest = strings.TrimPrefix(path.Clean("/"+rest), "/")
+	arch, name, _ := strings.Cut(rest, "/")
+	if _, ok := binaries[arch]; !ok || name == "" {
+		return nil, ErrNotFound
+	}
+
+	f, err := os.Open(filepath.Join(l.directory, arch, filepath.FromSlash(name)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err != nil || !fi.Mode().IsRegular() {
+		f.Close()
+		return nil, ErrNotFound
+	}
+	return f, nil
+}
@@ -6,19 +6,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
+	"github.com/DSpeichert/netbootd/archive"
+	"github.com/DSpeichert/netbootd/cache"
+	"github.com/DSpeichert/netbootd/checksum"
+	"github.com/DSpeichert/netbootd/initrd"
 	mfest "github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/program"
 	"github.com/DSpeichert/netbootd/static"
-	"github.com/Masterminds/sprig/v3"
+	"github.com/DSpeichert/netbootd/upstream"
 )
 
 type Handler struct {
@@ -106,8 +110,33 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if manifest.Grub {
+		f, err := h.server.grub.Open(r.URL.Path)
+		if err == nil {
+			defer f.Close()
+			fstat, _ := f.Stat()
+			h.server.logger.Info().
+				Str("path", r.RequestURI).
+				Str("client", raddr.String()).
+				Str("manifest_for", manifestRaddr.String()).
+				Msg("grub download")
+
+			http.ServeContent(w, r, fstat.Name(), fstat.ModTime(), f)
+			return
+		}
+	}
+
 	mount, err := manifest.GetMount(r.URL.Path)
-	if err != nil {
+	if errors.Is(err, mfest.ErrNotServed) {
+		h.server.logger.Debug().
+			Str("path", r.URL.Path).
+			Str("client", raddr.String()).
+			Str("manifest_for", manifestRaddr.String()).
+			Msg("configuration lookup not served")
+
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
 		h.server.logger.Error().
 			Err(err).
 			Str("path", r.URL.Path).
@@ -123,41 +152,32 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Interface("mount", mount).
 		Msg("found mount")
 
-	if mount.Content != "" {
-		tmpl, err := template.New("").Funcs(sprig.TxtFuncMap()).Parse(mount.Content)
+	verifier := checksum.New(mount)
+	data := h.server.renderer.HTTPContext(r, manifest, mount, laddr, raddr)
+
+	var overlay []byte
+	if len(mount.InitrdOverlay) > 0 {
+		overlay, err = h.server.renderer.InitrdOverlay(mount, data)
 		if err != nil {
 			h.server.logger.Error().
 				Err(err).
-				Msg("failed to parse content template for mount")
+				Msg("failed to generate initrd overlay for mount")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+	}
 
-		buf := new(bytes.Buffer)
-
-		err = tmpl.Execute(buf, mfest.ContentContext{
-			LocalIP:  laddr,
-			RemoteIP: raddr,
-			HttpBaseUrl: &url.URL{
-				Scheme: "http",
-				Host:   r.Host,
-			},
-			ApiBaseUrl: &url.URL{
-				Scheme: "http",
-				Host:   net.JoinHostPort(laddr.String(), strconv.Itoa(h.server.store.GlobalHints.ApiPort)),
-			},
-			SyslogHost: net.JoinHostPort(laddr.String(), strconv.Itoa(h.server.store.GlobalHints.SyslogPort)),
-			Manifest:   manifest,
-		})
+	if mount.Content != "" {
+		content, err := h.server.renderer.Content(mount, data)
 		if err != nil {
 			h.server.logger.Error().
 				Err(err).
-				Msg("failed to execute content template for mount")
+				Msg("failed to render content template for mount")
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		http.ServeContent(w, r, mount.Path, time.Time{}, bytes.NewReader(buf.Bytes()))
+		http.ServeContent(w, r, mount.Path, time.Time{}, bytes.NewReader(content))
 
 		h.server.logger.Info().
 			Err(err).
@@ -165,6 +185,29 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Str("client", raddr.String()).
 			Str("manifest_for", manifestRaddr.String()).
 			Msg("transfer finished")
+	} else if mount.Redirect != "" {
+		target, err := h.server.renderer.Redirect(mount, data)
+		if err != nil {
+			h.server.logger.Error().
+				Err(err).
+				Msg("failed to render redirect for mount")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		target = mount.ProxyURL(target, r.URL.Path)
+
+		status := mount.RedirectStatus
+		if status == 0 {
+			status = http.StatusFound
+		}
+		http.Redirect(w, r, target, status)
+
+		h.server.logger.Info().
+			Str("path", r.RequestURI).
+			Str("url", target).
+			Str("client", raddr.String()).
+			Str("manifest_for", manifestRaddr.String()).
+			Msg("redirected")
 	} else if mount.Proxy != "" {
 		d, err := mount.ProxyDirector()
 		if err != nil {
@@ -174,11 +217,155 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+
+		header, err := h.server.renderer.Headers(mount, data)
+		if err != nil {
+			h.server.logger.Error().
+				Err(err).
+				Msg("failed to render proxy headers for mount")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if mount.Cache && h.server.cache != nil {
+			// responses of mirrors are cached under the URL at Proxy, as their content is the same
+			primary := r.Clone(r.Context())
+			d(primary)
+
+			key := cache.Key{URL: primary.URL.String(), Variant: upstream.Variant(mount, header)}
+			obj, err := h.server.cache.Get(key, mount.CacheTTL, func(validators http.Header) (*http.Response, error) {
+				return h.server.upstreams.Get(mount, func(base string) (*http.Request, error) {
+					dd, err := mount.ProxyDirectorFor(base)
+					if err != nil {
+						return nil, err
+					}
+					req, err := http.NewRequest("GET", r.URL.String(), nil)
+					if err != nil {
+						return nil, err
+					}
+					for _, hdr := range []http.Header{header, validators} {
+						for name, values := range hdr {
+							req.Header[name] = values
+						}
+					}
+					req.Header.Set("X-Forwarded-For", raddr.String())
+					dd(req)
+					return req, nil
+				})
+			})
+			if err != nil {
+				h.server.logger.Error().
+					Err(err).
+					Str("url", primary.URL.String()).
+					Msg("cannot get cached upstream response")
+				var serr *cache.StatusError
+				if errors.As(err, &serr) {
+					http.Error(w, serr.Status, serr.StatusCode)
+				} else {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+				}
+				return
+			}
+			defer obj.Close()
+
+			if verifier != nil {
+				if err := verifier.VerifyFile(obj.File); err != nil {
+					h.logChecksumFailure(err, r, raddr)
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+			}
+
+			if obj.ContentType != "" {
+				w.Header().Set("Content-Type", obj.ContentType)
+			}
+			var content io.ReadSeeker = obj
+			modTime := obj.ModTime
+			if overlay != nil {
+				content = initrd.AppendSeeker(obj, obj.Size, overlay)
+				// the overlay is rendered on every request, so it may have changed since
+				modTime = time.Time{}
+			}
+			http.ServeContent(w, r, r.URL.Path, modTime, content)
+
+			h.server.logger.Info().
+				Str("path", r.RequestURI).
+				Str("url", primary.URL.String()).
+				Str("client", raddr.String()).
+				Str("manifest_for", manifestRaddr.String()).
+				Msg("transfer finished")
+			return
+		}
+
 		rp := httputil.ReverseProxy{
-			Director: d,
+			// requests are rewritten for each upstream attempt by the transport
+			Director:  func(req *http.Request) {},
+			Transport: h.server.upstreams.Transport(mount, header),
+		}
+		if verifier != nil || overlay != nil {
+			// partial content can be neither verified nor extended
+			rp.Director = func(req *http.Request) {
+				req.Header.Del("Range")
+				req.Header.Del("If-Range")
+			}
+			rp.ModifyResponse = func(resp *http.Response) error {
+				if resp.StatusCode != http.StatusOK {
+					return nil
+				}
+				body := io.Reader(resp.Body)
+				if verifier != nil {
+					// the connection is aborted before the last byte unless the content matches
+					body = verifier.Reader(body, func(err error) {
+						h.logChecksumFailure(err, r, raddr)
+					})
+				}
+				if overlay != nil {
+					var size int64
+					body, size = initrd.Append(body, resp.ContentLength, overlay)
+					resp.ContentLength = size
+					if size >= 0 {
+						resp.Header.Set("Content-Length", strconv.FormatInt(size, 10))
+					} else {
+						resp.Header.Del("Content-Length")
+					}
+					// validators and digests of upstream do not match the extended content
+					resp.Header.Del("ETag")
+					resp.Header.Del("Content-MD5")
+					resp.Header.Del("Accept-Ranges")
+				}
+				resp.Body = struct {
+					io.Reader
+					io.Closer
+				}{body, resp.Body}
+				return nil
+			}
 		}
 		rp.ServeHTTP(w, r)
 		return
+	} else if mount.Exec != nil {
+		out, err := h.server.programs.Run(r.Context(), *mount.Exec, data)
+		if err != nil {
+			h.server.logger.Error().
+				Err(err).
+				Str("path", r.RequestURI).
+				Str("client", raddr.String()).
+				Msg("program of exec mount failed")
+			// details may be sensitive, they are logged only
+			if errors.Is(err, program.ErrBusy) {
+				http.Error(w, "program failed: too busy", http.StatusServiceUnavailable)
+			} else {
+				http.Error(w, "program failed", http.StatusInternalServerError)
+			}
+			return
+		}
+
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(out))
+
+		h.server.logger.Info().
+			Str("path", r.RequestURI).
+			Str("client", raddr.String()).
+			Str("manifest_for", manifestRaddr.String()).
+			Msg("transfer finished")
 	} else if mount.LocalDir != "" {
 		path := mount.HostPath(h.server.rootPath, r.URL.Path)
 
@@ -198,6 +385,7 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		defer f.Close()
 		stat, err := f.Stat()
 		if err != nil {
 			h.server.logger.Error().
@@ -206,7 +394,92 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		http.ServeContent(w, r, r.URL.Path, stat.ModTime(), f)
+		if verifier != nil {
+			if err := verifier.VerifyFile(f); err != nil {
+				h.logChecksumFailure(err, r, raddr)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		var content io.ReadSeeker = f
+		modTime := stat.ModTime()
+		if overlay != nil {
+			content = initrd.AppendSeeker(f, stat.Size(), overlay)
+			// the overlay is rendered on every request, so it may have changed since
+			modTime = time.Time{}
+		}
+		http.ServeContent(w, r, r.URL.Path, modTime, content)
+		return
+	} else if mount.ISO != "" || mount.Archive != "" {
+		arc, err := archive.Load(mount.ArchivePath(h.server.rootPath))
+		if err != nil {
+			h.server.logger.Error().
+				Err(err).
+				Str("archive", mount.ArchivePath(h.server.rootPath)).
+				Msg("cannot load archive")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		f, err := arc.Open(mount.MemberPath(r.URL.Path))
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			h.server.logger.Error().
+				Err(err).
+				Msgf("Could not get file from archive: %q", r.URL.Path)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+
+		var content io.ReadSeeker = f
+		modTime := f.ModTime
+		if overlay != nil {
+			content = initrd.AppendSeeker(f, f.Size, overlay)
+			// the overlay is rendered on every request, so it may have changed since
+			modTime = time.Time{}
+		}
+		http.ServeContent(w, r, r.URL.Path, modTime, content)
+		return
+	} else if mount.Blob != "" {
+		if h.server.blobs == nil {
+			h.server.logger.Error().
+				Str("path", r.RequestURI).
+				Str("mount", mount.Path).
+				Msg("blob mount requires blob store, which is disabled")
+			http.Error(w, "blob store is disabled", http.StatusInternalServerError)
+			return
+		}
+
+		f, err := h.server.blobs.Open(mount.BlobDigest())
+		if err != nil {
+			h.server.logger.Error().
+				Err(err).
+				Str("blob", mount.Blob).
+				Msgf("Could not get blob: %q", r.URL.Path)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		stat, err := f.Stat()
+		if err != nil {
+			h.server.logger.Error().
+				Err(err).
+				Msgf("could not stat blob: %q", mount.Blob)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var content io.ReadSeeker = f
+		if overlay != nil {
+			content = initrd.AppendSeeker(f, stat.Size(), overlay)
+		} else {
+			// content of a blob never changes
+			w.Header().Set("ETag", `"`+mount.Blob+`"`)
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, content)
 		return
 	} else {
 		// mount has neither .Path, .Proxy nor .LocalDir defined
@@ -224,3 +497,19 @@ func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	return
 }
+
+// logChecksumFailure logs content that could not be verified against the checksum pinned on its mount.
+func (h Handler) logChecksumFailure(err error, r *http.Request, raddr net.IP) {
+	event := h.server.logger.Error().
+		Err(err).
+		Str("path", r.RequestURI).
+		Str("client", raddr.String())
+	var cerr *checksum.Error
+	if errors.As(err, &cerr) {
+		event.Str("expected", cerr.Expected).
+			Str("actual", cerr.Actual).
+			Msg("checksum mismatch, refusing to serve content")
+		return
+	}
+	event.Msg("checksum verification failed")
+}
@@ -5,21 +5,45 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/DSpeichert/netbootd/blob"
+	"github.com/DSpeichert/netbootd/cache"
+	"github.com/DSpeichert/netbootd/grub"
+	"github.com/DSpeichert/netbootd/program"
+	"github.com/DSpeichert/netbootd/render"
 	"github.com/DSpeichert/netbootd/store"
+	"github.com/DSpeichert/netbootd/upstream"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
+// Deps are the services mounts of manifests are served with.
+type Deps struct {
+	// Cache of proxy mounts, nil if caching is disabled.
+	Cache     *cache.Cache
+	Upstreams *upstream.Pool
+	Programs  *program.Runner
+	// Blobs is nil if the blob store is disabled.
+	Blobs    *blob.Store
+	Renderer *render.Renderer
+	Grub     *grub.Loader
+}
+
 type Server struct {
 	httpClient *http.Client
 	httpServer *http.Server
 
-	logger   zerolog.Logger
-	store    *store.Store
-	rootPath string
+	logger    zerolog.Logger
+	store     *store.Store
+	rootPath  string
+	cache     *cache.Cache
+	upstreams *upstream.Pool
+	programs  *program.Runner
+	blobs     *blob.Store
+	renderer  *render.Renderer
+	grub      *grub.Loader
 }
 
-func NewServer(store *store.Store, rootPath string) (server *Server, err error) {
+func NewServer(store *store.Store, rootPath string, deps Deps) (server *Server, err error) {
 
 	server = &Server{
 		httpServer: &http.Server{
@@ -27,9 +51,15 @@ func NewServer(store *store.Store, rootPath string) (server *Server, err error)
 			MaxHeaderBytes: 1 << 20,
 			IdleTimeout:    10 * time.Second,
 		},
-		logger:   log.With().Str("service", "http").Logger(),
-		store:    store,
-		rootPath: rootPath,
+		logger:    log.With().Str("service", "http").Logger(),
+		store:     store,
+		rootPath:  rootPath,
+		cache:     deps.Cache,
+		upstreams: deps.Upstreams,
+		programs:  deps.Programs,
+		blobs:     deps.Blobs,
+		renderer:  deps.Renderer,
+		grub:      deps.Grub,
 	}
 
 	server.httpServer.Handler = Handler{server: server}
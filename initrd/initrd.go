@@ -0,0 +1,215 @@
+// Package initrd appends generated files to an initrd, as a newc cpio archive concatenated to it.
+// The kernel unpacks concatenated archives in order, so overlay files replace files of the original initrd.
+package initrd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultFileMode = 0o644
+	defaultDirMode  = 0o755
+
+	typeDir  = 0o040000
+	typeFile = 0o100000
+)
+
+// File is a file or directory of an overlay.
+type File struct {
+	// Path in the initrd. Parent directories are not created, as the kernel would apply the mode of their entries
+	// to existing directories (e.g. /tmp), so directories missing from the initrd have to be listed explicitly.
+	Path string
+	// Permissions, as returned by ParseMode.
+	Mode uint32
+	Dir  bool
+	Data []byte
+}
+
+// Archive returns files as a newc cpio archive. Directories come first, parents before their children,
+// so that files can be placed in them regardless of the order of files.
+func Archive(files []File) []byte {
+	w := &writer{}
+
+	var dirs []string
+	modes := make(map[string]uint32)
+	for _, f := range files {
+		if f.Dir {
+			dirs = append(dirs, cleanPath(f.Path))
+			modes[cleanPath(f.Path)] = f.Mode
+		}
+	}
+	sort.Strings(dirs)
+	for _, dir := range dirs {
+		w.entry(dir, typeDir|modes[dir], nil)
+	}
+
+	for _, f := range files {
+		if !f.Dir {
+			w.entry(cleanPath(f.Path), typeFile|f.Mode, f.Data)
+		}
+	}
+
+	w.entry("TRAILER!!!", 0, nil)
+	return w.buf.Bytes()
+}
+
+// ParseMode parses octal permissions of an overlay file or directory, empty mode defaults to 0644 for files
+// and 0755 for directories.
+func ParseMode(mode string, dir bool) (uint32, error) {
+	if mode == "" && dir {
+		return defaultDirMode, nil
+	} else if mode == "" {
+		return defaultFileMode, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 12)
+	if err != nil {
+		return 0, errors.New("invalid initrd overlay file mode: " + mode)
+	}
+	return uint32(m), nil
+}
+
+// cleanPath returns p relative to the initrd root, as stored in cpio archives.
+func cleanPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// writer writes newc (SVR4 without CRC) cpio archives.
+// Modification times are left at zero, so that identical content yields identical archives.
+type writer struct {
+	buf bytes.Buffer
+	ino int
+}
+
+func (w *writer) entry(name string, mode uint32, data []byte) {
+	w.ino++
+	nlink := 1
+	if mode&typeDir != 0 {
+		nlink = 2
+	}
+	fmt.Fprintf(&w.buf, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X",
+		w.ino, mode, 0, 0, nlink, 0, len(data), 0, 0, 0, 0, len(name)+1, 0)
+	w.buf.WriteString(name)
+	w.buf.WriteByte(0)
+	w.pad()
+	w.buf.Write(data)
+	w.pad()
+}
+
+// pad aligns the archive to 4 bytes, as required before names and data.
+func (w *writer) pad() {
+	for w.buf.Len()%4 != 0 {
+		w.buf.WriteByte(0)
+	}
+}
+
+// padding returns the number of zeros needed to align size bytes to 4 bytes.
+func padding(size int64) int64 {
+	return (4 - size%4) % 4
+}
+
+// Append returns initrd followed by overlay, with initrd zero-padded to 4 bytes as the kernel expects
+// between concatenated archives. If size of initrd is not known (-1), the returned size is -1 as well.
+// The result is an io.ReadSeeker if initrd is one and its size is known.
+func Append(initrd io.Reader, size int64, overlay []byte) (io.Reader, int64) {
+	if size < 0 {
+		c := &countingReader{r: initrd}
+		return io.MultiReader(c, &lazyReader{fn: func() io.Reader {
+			return bytes.NewReader(make([]byte, padding(c.n)))
+		}}, bytes.NewReader(overlay)), -1
+	}
+
+	total := size + padding(size) + int64(len(overlay))
+	if rs, ok := initrd.(io.ReadSeeker); ok {
+		return AppendSeeker(rs, size, overlay), total
+	}
+	pad := make([]byte, padding(size))
+	return io.MultiReader(io.LimitReader(initrd, size), bytes.NewReader(pad), bytes.NewReader(overlay)), total
+}
+
+// AppendSeeker is Append for seekable initrds of known size, as needed for range requests.
+func AppendSeeker(initrd io.ReadSeeker, size int64, overlay []byte) io.ReadSeeker {
+	pad := make([]byte, padding(size))
+	return &concatReader{
+		parts: []io.ReadSeeker{initrd, bytes.NewReader(pad), bytes.NewReader(overlay)},
+		sizes: []int64{size, int64(len(pad)), int64(len(overlay))},
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// lazyReader reads from the reader returned by fn, called on first read.
+type lazyReader struct {
+	fn func() io.Reader
+	r  io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.r == nil {
+		l.r = l.fn()
+	}
+	return l.r.Read(p)
+}
+
+// concatReader is a seekable concatenation of parts of known sizes.
+type concatReader struct {
+	parts []io.ReadSeeker
+	sizes []int64
+	pos   int64
+}
+
+func (c *concatReader) Read(p []byte) (int, error) {
+	offset := c.pos
+	for i, size := range c.sizes {
+		if offset >= size {
+			offset -= size
+			continue
+		}
+		if _, err := c.parts[i].Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		n, err := c.parts[i].Read(p[:min(int64(len(p)), size-offset)])
+		c.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	return 0, io.EOF
+}
+
+func (c *concatReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		for _, size := range c.sizes {
+			offset += size
+		}
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	c.pos = offset
+	return offset, nil
+}
@@ -0,0 +1,95 @@
+package initrd
+
+import (
+	"strconv"
+	"testing"
+)
+
+type entry struct {
+	name string
+	mode uint32
+	data string
+}
+
+// entries parses a newc cpio archive written by Archive.
+func entries(t *testing.T, archive []byte) []entry {
+	t.Helper()
+	var out []entry
+	for pos := 0; pos < len(archive); {
+		hdr := string(archive[pos : pos+110])
+		if hdr[:6] != "070701" {
+			t.Fatalf("bad magic at %d: %q", pos, hdr[:6])
+		}
+		field := func(i int) int {
+			n, err := strconv.ParseUint(hdr[6+8*i:14+8*i], 16, 32)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return int(n)
+		}
+		mode, size, nameSize := field(1), field(6), field(11)
+		pos += 110
+		name := string(archive[pos : pos+nameSize-1])
+		pos += nameSize + int(padding(int64(110+nameSize)))
+		data := string(archive[pos : pos+size])
+		pos += size + int(padding(int64(size)))
+		if name == "TRAILER!!!" {
+			if pos != len(archive) {
+				t.Errorf("%d bytes after trailer", len(archive)-pos)
+			}
+			return out
+		}
+		out = append(out, entry{name, uint32(mode), data})
+	}
+	t.Fatal("archive without trailer")
+	return nil
+}
+
+func TestArchive(t *testing.T) {
+	got := entries(t, Archive([]File{
+		{Path: "/preseed.cfg", Mode: 0o644, Data: []byte("d-i")},
+		{Path: "/root/.ssh/authorized_keys", Mode: 0o600, Data: []byte("ssh-ed25519 AAAA")},
+		{Path: "/root/.ssh/", Mode: 0o700, Dir: true},
+		{Path: "etc/netbootd", Mode: 0o755, Dir: true},
+		{Path: "/etc", Mode: 0o755, Dir: true},
+	}))
+	// directories first, parents before children, no entries for directories not listed (e.g. /root)
+	want := []entry{
+		{"etc", typeDir | 0o755, ""},
+		{"etc/netbootd", typeDir | 0o755, ""},
+		{"root/.ssh", typeDir | 0o700, ""},
+		{"preseed.cfg", typeFile | 0o644, "d-i"},
+		{"root/.ssh/authorized_keys", typeFile | 0o600, "ssh-ed25519 AAAA"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got entries %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("entry %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		dir  bool
+		want uint32
+	}{
+		{"", false, 0o644},
+		{"", true, 0o755},
+		{"0600", false, 0o600},
+		{"1777", true, 0o1777},
+	}
+	for _, tt := range tests {
+		if got, err := ParseMode(tt.mode, tt.dir); err != nil || got != tt.want {
+			t.Errorf("ParseMode(%q, %v) = %o, %v, want %o", tt.mode, tt.dir, got, err, tt.want)
+		}
+	}
+	for _, mode := range []string{"644a", "10000", "-1"} {
+		if _, err := ParseMode(mode, false); err == nil {
+			t.Errorf("ParseMode(%q) succeeded", mode)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package manifest
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Paths of boot loader configurations generated from BootSpec of a manifest.
+const (
+	BootPath         = "/boot/"
+	BootIPXEPath     = BootPath + "boot.ipxe"
+	BootGRUBPath     = BootPath + "grub.cfg"
+	BootPXELINUXPath = BootPath + "pxelinux.cfg"
+)
+
+// defaultBootMenuTimeout is used for menus of several entries when BootSpec.Timeout is not set.
+const defaultBootMenuTimeout = 5 * time.Second
+
+// BootSpec describes what to boot independently of the boot loader. netbootd generates an iPXE script
+// (BootIPXEPath), a GRUB configuration (BootGRUBPath) and a PXELINUX configuration (BootPXELINUXPath) from it,
+// so that a host boots the same way whichever loader it ends up with.
+// Either a single entry (Kernel, Initrds and Cmdline) or a menu of Entries is given.
+type BootSpec struct {
+	BootEntry `yaml:",inline"`
+
+	// Entries of a boot menu, the Default one is booted after Timeout.
+	Entries []BootEntry
+	// Label of the default entry, the first one if empty.
+	Default string
+	// Time to wait for a menu selection, defaults to 5s. Not used for a single entry.
+	Timeout time.Duration
+}
+
+// BootEntry is an operating system to boot. Kernel, Initrds and Cmdline are templates (passed through template/text)
+// executed with ContentContext like Mount.Content.
+type BootEntry struct {
+	// Label shown in menus.
+	Label string
+	// Kernel and Initrds are paths of mounts of the manifest, or http:// URLs (https:// with iPXE only).
+	// iPXE fetches paths over HTTP, GRUB and PXELINUX over TFTP. Templates may be used after the leading
+	// slash or URL scheme, which tell paths and URLs apart before they are rendered.
+	Kernel  string
+	Initrds []string
+	// Kernel command line.
+	Cmdline string
+}
+
+// PxelinuxBootFilename is the default BootFilename in PXELINUX mode.
+const PxelinuxBootFilename = "pxelinux.0"
+
+// GetBootFilename returns the boot file name of the manifest: BootFilename, or if it's not set,
+// pxelinux.0 in PXELINUX mode or the generated iPXE script if Boot is set.
+// It's the iPXE script booting from the local disk if suspended with SuspendedBootIPXE.
+func (m *Manifest) GetBootFilename() string {
+	switch {
+	case m.IsSuspendedBoot(SuspendedBootIPXE):
+		return strings.TrimPrefix(BootLocalIPXEPath, "/")
+	case m.BootFilename != "":
+		return m.BootFilename
+	case m.Pxelinux:
+		return PxelinuxBootFilename
+	case m.Boot != nil:
+		return strings.TrimPrefix(BootIPXEPath, "/")
+	}
+	return ""
+}
+
+// validateBoot validates Boot, if set.
+func (m Manifest) validateBoot() error {
+	if m.Boot == nil {
+		return nil
+	}
+	if err := m.Boot.validate(); err != nil {
+		return err
+	}
+	// the hostname titles iPXE menus, it or the ID labels a single entry
+	if hasControl(m.Hostname) || hasControl(m.ID) {
+		return errors.New("boot: hostname and id must not contain control characters")
+	}
+	if m.BootFilename == "" && !m.Ipxe && !m.Pxelinux {
+		// firmware would be given the generated iPXE script as its boot file
+		return errors.New("boot requires ipxe, pxelinux or bootFilename")
+	}
+	for _, e := range m.Boot.entries(nil) {
+		for _, p := range append([]string{e.Kernel}, e.Initrds...) {
+			if strings.HasPrefix(strings.TrimSpace(p), "{{") {
+				return fmt.Errorf("boot: %s must start with a path or URL, not a template", p)
+			}
+			if strings.HasPrefix(p, "https://") && (m.Grub || m.Pxelinux) {
+				return fmt.Errorf("boot: %s cannot be loaded by GRUB or PXELINUX, use http://", p)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *BootSpec) validate() error {
+	if len(b.Entries) > 0 && (b.Kernel != "" || len(b.Initrds) > 0 || b.Cmdline != "") {
+		return errors.New("boot: entries are mutually exclusive with kernel, initrds and cmdline")
+	}
+	labels := make(map[string]bool)
+	for _, e := range b.entries(nil) {
+		if e.Kernel == "" {
+			return fmt.Errorf("boot: entry %s needs kernel", e.Label)
+		}
+		// labels and paths are printed into lines of the configurations, where a line break would start a command
+		if hasControl(e.Label) {
+			return fmt.Errorf("boot: entry label must not contain control characters: %q", e.Label)
+		}
+		for _, p := range append([]string{e.Kernel}, e.Initrds...) {
+			if hasControl(p) {
+				return fmt.Errorf("boot: path must not contain control characters: %q", p)
+			}
+		}
+		if len(b.Entries) > 0 && e.Label == "" {
+			return errors.New("boot: entries need label")
+		}
+		if labels[e.Label] {
+			return fmt.Errorf("boot: duplicate entry label: %s", e.Label)
+		}
+		labels[e.Label] = true
+	}
+	if b.Default != "" && !labels[b.Default] {
+		return fmt.Errorf("boot: default entry not found: %s", b.Default)
+	}
+	if b.Timeout < 0 {
+		return errors.New("boot: timeout must not be negative")
+	}
+	return nil
+}
+
+func hasControl(s string) bool {
+	return strings.ContainsFunc(s, unicode.IsControl)
+}
+
+// entries returns Entries, or the single entry labeled after m.
+func (b *BootSpec) entries(m *Manifest) []BootEntry {
+	if len(b.Entries) > 0 {
+		return b.Entries
+	}
+	e := b.BootEntry
+	if e.Label == "" && m != nil {
+		e.Label = m.Hostname
+		if e.Label == "" {
+			e.Label = m.ID
+		}
+	}
+	return []BootEntry{e}
+}
+
+// defaultEntry returns index of the default entry.
+func (b *BootSpec) defaultEntry() int {
+	for i, e := range b.Entries {
+		if e.Label == b.Default {
+			return i
+		}
+	}
+	return 0
+}
+
+// timeout returns the menu timeout, 0 for a single entry.
+func (b *BootSpec) timeout() time.Duration {
+	if len(b.Entries) < 2 {
+		return 0
+	}
+	if b.Timeout == 0 {
+		return defaultBootMenuTimeout
+	}
+	return b.Timeout
+}
+
+// bootMounts returns content mounts serving configurations generated from Boot of m, if set.
+func (m *Manifest) bootMounts() []Mount {
+	if m.Boot == nil {
+		return nil
+	}
+	return []Mount{
+		{Path: BootIPXEPath, Content: m.Boot.ipxe(m)},
+		{Path: BootGRUBPath, Content: m.Boot.grub(m)},
+		{Path: BootPXELINUXPath, Content: m.Boot.pxelinux(m)},
+	}
+}
+
+// The generated configurations are templates: command lines are defined as named templates first,
+// so that they can be quoted for the loader once rendered.
+
+func cmdlineTemplate(i int) string {
+	return "netbootd/boot/cmdline/" + strconv.Itoa(i)
+}
+
+func (b *BootSpec) defineCmdlines(sb *strings.Builder, entries []BootEntry) {
+	for i, e := range entries {
+		fmt.Fprintf(sb, "{{- define %q }}%s{{ end -}}\n", cmdlineTemplate(i), e.Cmdline)
+	}
+}
+
+// literal returns a template action printing s as is.
+func literal(s string) string {
+	return "{{ " + strconv.Quote(s) + " }}"
+}
+
+func isURL(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+// absPath returns p with a leading slash.
+func absPath(p string) string {
+	return "/" + strings.TrimLeft(p, "/")
+}
+
+func (b *BootSpec) ipxe(m *Manifest) string {
+	entries := b.entries(m)
+	url := func(p string) string {
+		if isURL(p) {
+			return p
+		}
+		return "{{ .HttpBaseUrl }}" + absPath(p)
+	}
+
+	sb := new(strings.Builder)
+	b.defineCmdlines(sb, entries)
+	sb.WriteString("#!ipxe\n")
+	if len(entries) > 1 {
+		fmt.Fprintf(sb, "menu %s\n", literal(m.Hostname))
+		for i, e := range entries {
+			fmt.Fprintf(sb, "item entry%d %s\n", i, literal(e.Label))
+		}
+		fmt.Fprintf(sb, "choose --default entry%d --timeout %d entry || set entry entry%d\n",
+			b.defaultEntry(), b.timeout().Milliseconds(), b.defaultEntry())
+		sb.WriteString("goto ${entry}\n")
+	}
+	for i, e := range entries {
+		if len(entries) > 1 {
+			fmt.Fprintf(sb, "\n:entry%d\n", i)
+		}
+		sb.WriteString("kernel " + url(e.Kernel))
+		// needed by the EFI stub of the kernel to find initrds
+		for _, initrd := range e.Initrds {
+			sb.WriteString(" initrd=" + path.Base(initrd))
+		}
+		fmt.Fprintf(sb, " {{ include %q . }}\n", cmdlineTemplate(i))
+		for _, initrd := range e.Initrds {
+			sb.WriteString("initrd " + url(initrd) + "\n")
+		}
+		sb.WriteString("boot\n")
+	}
+	return sb.String()
+}
+
+func (b *BootSpec) grub(m *Manifest) string {
+	entries := b.entries(m)
+	file := func(p string) string {
+		// GRUB names HTTP files by device, paths are read from the TFTP server it was loaded from
+		if rest, ok := strings.CutPrefix(p, "http://"); ok {
+			host, p, _ := strings.Cut(rest, "/")
+			return "(http," + host + ")/" + p
+		}
+		return absPath(p)
+	}
+
+	sb := new(strings.Builder)
+	b.defineCmdlines(sb, entries)
+	fmt.Fprintf(sb, "set default=%d\n", b.defaultEntry())
+	fmt.Fprintf(sb, "set timeout=%d\n", int((b.timeout()+time.Second-1)/time.Second))
+	for i, e := range entries {
+		fmt.Fprintf(sb, "\nmenuentry {{ shellQuote %s }} {\n", strconv.Quote(e.Label))
+		fmt.Fprintf(sb, "  linux %s {{ include %q . | grubArgs }}\n", file(e.Kernel), cmdlineTemplate(i))
+		if len(e.Initrds) > 0 {
+			sb.WriteString("  initrd")
+			for _, initrd := range e.Initrds {
+				sb.WriteString(" " + file(initrd))
+			}
+			sb.WriteString("\n")
+		}
+		sb.WriteString("}\n")
+	}
+	return sb.String()
+}
+
+func (b *BootSpec) pxelinux(m *Manifest) string {
+	entries := b.entries(m)
+	file := func(p string) string {
+		if isURL(p) {
+			return p
+		}
+		return absPath(p)
+	}
+
+	sb := new(strings.Builder)
+	b.defineCmdlines(sb, entries)
+	fmt.Fprintf(sb, "DEFAULT entry%d\n", b.defaultEntry())
+	if len(entries) > 1 {
+		// tenths of a second
+		fmt.Fprintf(sb, "PROMPT 1\nTIMEOUT %d\n", max(b.timeout()/(100*time.Millisecond), 1))
+		for i, e := range entries {
+			fmt.Fprintf(sb, "SAY entry%d: %s\n", i, literal(e.Label))
+		}
+	} else {
+		sb.WriteString("PROMPT 0\n")
+	}
+	for i, e := range entries {
+		fmt.Fprintf(sb, "\nLABEL entry%d\n", i)
+		fmt.Fprintf(sb, "  MENU LABEL %s\n", literal(e.Label))
+		fmt.Fprintf(sb, "  KERNEL %s\n", file(e.Kernel))
+		if len(e.Initrds) > 0 {
+			initrds := make([]string, len(e.Initrds))
+			for j, initrd := range e.Initrds {
+				initrds[j] = file(initrd)
+			}
+			fmt.Fprintf(sb, "  INITRD %s\n", strings.Join(initrds, ","))
+		}
+		fmt.Fprintf(sb, "  APPEND {{ include %q . }}\n", cmdlineTemplate(i))
+	}
+	return sb.String()
+}
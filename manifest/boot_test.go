@@ -0,0 +1,44 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateBoot(t *testing.T) {
+	tests := []struct {
+		manifest string
+		err      string
+	}{
+		{"ipxe: true\nboot: {kernel: /vmlinuz, initrds: [/initrd.img], cmdline: quiet}", ""},
+		{"pxelinux: true\nboot: {entries: [{label: install, kernel: /vmlinuz}, {label: rescue, kernel: /rescue}], default: rescue}", ""},
+		{"grub: true\nipxe: true\nboot: {kernel: http://mirror/vmlinuz}", ""},
+		{"bootFilename: custom.efi\nboot: {kernel: /vmlinuz}", ""},
+		{"boot: {kernel: /vmlinuz}", "requires ipxe"},
+		{"ipxe: true\nboot: {cmdline: quiet}", "needs kernel"},
+		{"ipxe: true\nboot: {kernel: /vmlinuz, entries: [{label: install, kernel: /vmlinuz}]}", "mutually exclusive"},
+		{"ipxe: true\nboot: {entries: [{kernel: /vmlinuz}, {label: rescue, kernel: /rescue}]}", "need label"},
+		{"ipxe: true\nboot: {entries: [{label: install, kernel: /vmlinuz}, {label: install, kernel: /rescue}]}", "duplicate"},
+		{"ipxe: true\nboot: {entries: [{label: install, kernel: /vmlinuz}], default: rescue}", "default entry not found"},
+		{"ipxe: true\nboot: {kernel: /vmlinuz, timeout: -1s}", "negative"},
+		{`ipxe: true` + "\n" + `boot: {kernel: "{{ .Vars.kernel }}"}`, "not a template"},
+		{`ipxe: true` + "\n" + `boot: {kernel: "/{{ .Vars.kernel }}"}`, ""},
+		{"ipxe: true\nboot: {kernel: https://mirror/vmlinuz}", ""},
+		{"pxelinux: true\nboot: {kernel: https://mirror/vmlinuz}", "use http://"},
+		{"grub: true\nipxe: true\nboot: {initrds: [https://mirror/initrd.img], kernel: /vmlinuz}", "use http://"},
+		// printed into lines of the configurations
+		{`ipxe: true` + "\n" + `boot: {entries: [{label: "install\nshell", kernel: /vmlinuz}]}`, "control characters"},
+		{`pxelinux: true` + "\n" + `boot: {entries: [{label: "install\r", kernel: /vmlinuz}, {label: rescue, kernel: /rescue}]}`, "control characters"},
+		{`ipxe: true` + "\n" + `boot: {label: "a\tb", kernel: /vmlinuz}`, "control characters"},
+		{`ipxe: true` + "\n" + `boot: {kernel: "/vmlinuz\nshell"}`, "control characters"},
+		{`ipxe: true` + "\n" + `boot: {kernel: /vmlinuz, initrds: ["/initrd.img\nshell"]}`, "control characters"},
+		{`ipxe: true` + "\n" + `hostname: "host\nshell"` + "\n" + `boot: {kernel: /vmlinuz}`, "control characters"},
+		{"ipxe: true\nboot: {entries: [{label: Ubuntu 24.04 (install), kernel: /vmlinuz}]}", ""},
+	}
+	for _, tt := range tests {
+		_, err := ManifestFromYaml([]byte("id: host\nipv4: 192.0.2.10/24\n"+tt.manifest+"\n"), "")
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: got error %v, want %q", tt.manifest, err, tt.err)
+		}
+	}
+}
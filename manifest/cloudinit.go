@@ -0,0 +1,54 @@
+package manifest
+
+// NoCloudPath is the path under which the cloud-init NoCloud datasource of a manifest is served,
+// i.e. its seed URL is HttpBaseUrl followed by NoCloudPath.
+const NoCloudPath = "/nocloud/"
+
+// CloudInit configures the cloud-init NoCloud datasource served for a manifest at NoCloudPath:
+// meta-data, user-data, vendor-data and network-config. Templates (passed through template/text) are executed
+// with ContentContext like Mount.Content. Mounts of the manifest at the same paths take precedence.
+type CloudInit struct {
+	// InstanceID of meta-data, defaults to the ID of the manifest.
+	// cloud-init runs per-instance modules again whenever it changes.
+	InstanceID string `yaml:"instanceId"`
+	// UserData template, e.g. "#cloud-config ...", defaults to an empty cloud-config.
+	// Library templates can be used with {{ template "name" . }}.
+	UserData string `yaml:"userData"`
+	// VendorData template, defaults to an empty cloud-config.
+	VendorData string `yaml:"vendorData"`
+	// NetworkConfig template, defaults to a version 2 configuration generated from the manifest (cloudInitNetwork).
+	NetworkConfig string `yaml:"networkConfig"`
+}
+
+const emptyCloudConfig = "#cloud-config\n"
+
+// noCloudMounts returns content mounts serving the NoCloud datasource of m, if configured.
+func (m *Manifest) noCloudMounts() []Mount {
+	if m.CloudInit == nil {
+		return nil
+	}
+
+	metaData := "instance-id: {{ yamlQuote .Manifest.ID }}\n"
+	if m.CloudInit.InstanceID != "" {
+		metaData = "instance-id: {{ yamlQuote .Manifest.CloudInit.InstanceID }}\n"
+	}
+	if m.Hostname != "" {
+		metaData += "local-hostname: {{ yamlQuote .Manifest.Hostname }}\n"
+	}
+	files := []struct{ name, content, fallback string }{
+		{"meta-data", metaData, ""},
+		{"user-data", m.CloudInit.UserData, emptyCloudConfig},
+		{"vendor-data", m.CloudInit.VendorData, emptyCloudConfig},
+		{"network-config", m.CloudInit.NetworkConfig, "{{ cloudInitNetwork . }}"},
+	}
+
+	mounts := make([]Mount, 0, len(files))
+	for _, f := range files {
+		content := f.content
+		if content == "" {
+			content = f.fallback
+		}
+		mounts = append(mounts, Mount{Path: NoCloudPath + f.name, Content: content})
+	}
+	return mounts
+}
@@ -0,0 +1,33 @@
+package manifest
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/DSpeichert/netbootd/grub"
+)
+
+// grubConfigLookup matches names of configuration files GRUB probes when booted from the network:
+// grub.cfg-<machine UUID>, grub.cfg-01-<MAC>, grub.cfg-<hex IP> (with ever fewer digits) and grub.cfg.
+var grubConfigLookup = regexp.MustCompile(`^grub\.cfg(-[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|-01(-[0-9a-fA-F]{2}){6}|-[0-9A-F]{1,32})?$`)
+
+// IsGRUBConfigLookup reports whether GRUB requests path to find its configuration, which it does in its prefix,
+// the directory it was loaded from (e.g. /grub/amd64/grub.cfg-01-52-54-00-12-34-56), or in the root.
+func IsGRUBConfigLookup(p string) bool {
+	p = strings.TrimLeft(p, "/")
+	dir := path.Dir(p)
+	return grubConfigLookup.MatchString(path.Base(p)) && (dir == "." || grub.IsImageDirectory(dir))
+}
+
+// grubConfigMount returns the mount of the GRUB configuration of m for a GRUB lookup path in GRUB mode,
+// which is either generated from Boot or a mount at BootGRUBPath, or boots from the local disk if suspended.
+func (m *Manifest) grubConfigMount(p string) (Mount, bool) {
+	if !m.Grub || !IsGRUBConfigLookup(p) {
+		return Mount{}, false
+	}
+	if m.IsSuspendedBoot(SuspendedBootGRUB) {
+		return m.exactMount(BootLocalGRUBPath)
+	}
+	return m.exactMount(BootGRUBPath)
+}
@@ -0,0 +1,43 @@
+package manifest
+
+import "testing"
+
+func TestGRUBConfigLookup(t *testing.T) {
+	m := &Manifest{
+		Grub: true,
+		Boot: &BootSpec{BootEntry: BootEntry{Kernel: "/vmlinuz"}},
+		Mounts: []Mount{
+			{Path: "/", PathIsPrefix: true, LocalDir: "/srv/tftp"},
+		},
+	}
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"grub.cfg", BootGRUBPath},
+		{"/grub.cfg-01-52-54-00-12-34-56", BootGRUBPath},
+		{"grub/amd64/grub.cfg", BootGRUBPath},
+		{"grub/arm64/grub.cfg-C0A80A", BootGRUBPath},
+		{"grub/amd64/grub.cfg-0123abcd-0123-4567-89ab-0123456789ab", BootGRUBPath},
+		// not a prefix GRUB is loaded from
+		{"grub/grub.cfg", "/"},
+		{"grub/riscv64/grub.cfg", "/"},
+		{"images/grub.cfg", "/"},
+		{"grub/amd64/x86_64-efi/grub.cfg", "/"},
+		{"grub/amd64/grub.cfg.bak", "/"},
+	}
+	for _, tt := range tests {
+		mount, err := m.GetMount(tt.path)
+		if err != nil || mount.Path != tt.want {
+			t.Errorf("GetMount(%q) = %q, %v, want %q", tt.path, mount.Path, err, tt.want)
+		}
+	}
+
+	// not answered without GRUB mode
+	m.Grub = false
+	for _, p := range []string{"grub.cfg", "grub/amd64/grub.cfg"} {
+		if mount, err := m.GetMount(p); err != nil || mount.Path != "/" {
+			t.Errorf("GetMount(%q) without grub = %q, %v", p, mount.Path, err)
+		}
+	}
+}
@@ -1,9 +1,14 @@
 package manifest
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
@@ -37,8 +42,135 @@ func (m Manifest) Validate(rootPath string) error {
 				return fmt.Errorf("localDir needs to be absolute path when rootPath is not set")
 			}
 		}
+		if mount.ISO != "" && mount.Archive != "" {
+			return fmt.Errorf("mount %s: iso and archive are mutually exclusive", mount.Path)
+		}
+		if mount.ISO != "" || mount.Archive != "" {
+			if !filepath.IsAbs(mount.ArchivePath("")) && rootPath == "" {
+				return fmt.Errorf("mount %s: iso or archive needs to be absolute path when rootPath is not set", mount.Path)
+			}
+			if !mount.PathIsPrefix {
+				return fmt.Errorf("mount %s: iso or archive requires pathIsPrefix", mount.Path)
+			}
+		}
+		if mount.Blob != "" {
+			if mount.Proxy != "" || mount.Content != "" || mount.LocalDir != "" || mount.ISO != "" || mount.Archive != "" {
+				return fmt.Errorf("mount %s: blob is mutually exclusive with proxy, content, localDir, iso and archive", mount.Path)
+			}
+			if !strings.HasPrefix(mount.Blob, BlobDigestPrefix) {
+				return fmt.Errorf("mount %s: blob must be a digest starting with %s", mount.Path, BlobDigestPrefix)
+			}
+			if err := validateChecksum(mount.BlobDigest(), 32); err != nil {
+				return fmt.Errorf("mount %s: invalid blob digest: %w", mount.Path, err)
+			}
+		}
+		if mount.Redirect != "" {
+			if mount.Proxy != "" || mount.Content != "" || mount.LocalDir != "" || mount.ISO != "" || mount.Archive != "" || mount.Blob != "" {
+				return fmt.Errorf("mount %s: redirect is mutually exclusive with proxy, content, localDir, iso, archive and blob", mount.Path)
+			}
+		}
+		if mount.Exec != nil {
+			if mount.Proxy != "" || mount.Redirect != "" || mount.Content != "" || mount.LocalDir != "" || mount.ISO != "" || mount.Archive != "" || mount.Blob != "" {
+				return fmt.Errorf("mount %s: exec is mutually exclusive with proxy, redirect, content, localDir, iso, archive and blob", mount.Path)
+			}
+			if len(mount.Exec.Command) == 0 || mount.Exec.Command[0] == "" {
+				return fmt.Errorf("mount %s: exec needs command", mount.Path)
+			}
+			switch mount.Exec.Input {
+			case "", ExecInputStdin, ExecInputEnv:
+			default:
+				return fmt.Errorf("mount %s: unknown exec input: %s", mount.Path, mount.Exec.Input)
+			}
+		}
+		switch mount.RedirectStatus {
+		case 0, http.StatusFound, http.StatusTemporaryRedirect:
+		default:
+			return fmt.Errorf("mount %s: redirectStatus must be 302 or 307", mount.Path)
+		}
+		if len(mount.InitrdOverlay) > 0 {
+			if mount.Proxy == "" && mount.LocalDir == "" && mount.ISO == "" && mount.Archive == "" && mount.Blob == "" {
+				return fmt.Errorf("mount %s: initrdOverlay requires proxy, localDir, iso, archive or blob", mount.Path)
+			}
+			for _, f := range mount.InitrdOverlay {
+				if strings.Trim(f.Path, "/") == "" {
+					return fmt.Errorf("mount %s: initrdOverlay file needs path", mount.Path)
+				}
+				if _, err := strconv.ParseUint(f.Mode, 8, 12); f.Mode != "" && err != nil {
+					return fmt.Errorf("mount %s: invalid initrdOverlay file mode: %s", mount.Path, f.Mode)
+				}
+				if f.Directory && f.Content != "" {
+					return fmt.Errorf("mount %s: initrdOverlay directory %s cannot have content", mount.Path, f.Path)
+				}
+			}
+		}
+		if len(mount.Mirrors) > 0 && mount.Proxy == "" {
+			return fmt.Errorf("mount %s: mirrors require proxy", mount.Path)
+		}
+		for _, mirror := range mount.Mirrors {
+			if _, err := url.Parse(mirror); err != nil {
+				return fmt.Errorf("mount %s: invalid mirror: %w", mount.Path, err)
+			}
+		}
+		switch mount.MirrorPolicy {
+		case "", MirrorPolicyFailover, MirrorPolicyRoundRobin:
+		default:
+			return fmt.Errorf("mount %s: unknown mirrorPolicy: %s", mount.Path, mount.MirrorPolicy)
+		}
+		if (len(mount.ProxyHeaders) > 0 || mount.ProxyAuth != nil || mount.ProxyTLS != nil) && mount.Proxy == "" && mount.Redirect == "" {
+			return fmt.Errorf("mount %s: proxyHeaders, proxyAuth and proxyTLS require proxy or redirect", mount.Path)
+		}
+		if auth := mount.ProxyAuth; auth != nil {
+			if (auth.Username != "" || auth.PasswordFile != "") == (auth.TokenFile != "") {
+				return fmt.Errorf("mount %s: proxyAuth needs either username and passwordFile, or tokenFile", mount.Path)
+			}
+			for _, file := range []string{auth.PasswordFile, auth.TokenFile} {
+				if file != "" && !IsSecretPath(file) {
+					return fmt.Errorf("mount %s: proxyAuth files must be clean paths relative to the secrets directory: %s", mount.Path, file)
+				}
+			}
+		}
+		if tls := mount.ProxyTLS; tls != nil && (tls.CertFile == "") != (tls.KeyFile == "") {
+			return fmt.Errorf("mount %s: proxyTLS certFile and keyFile must be set together", mount.Path)
+		}
+		if mount.Sha256 != "" || mount.Sha512 != "" {
+			if mount.PathIsPrefix {
+				return fmt.Errorf("mount %s: checksum cannot be used with pathIsPrefix", mount.Path)
+			}
+			if mount.Proxy == "" && mount.LocalDir == "" {
+				return fmt.Errorf("mount %s: checksum requires proxy or localDir", mount.Path)
+			}
+		}
+		if err := validateChecksum(mount.Sha256, 32); err != nil {
+			return fmt.Errorf("mount %s: invalid sha256: %w", mount.Path, err)
+		}
+		if err := validateChecksum(mount.Sha512, 64); err != nil {
+			return fmt.Errorf("mount %s: invalid sha512: %w", mount.Path, err)
+		}
 	}
+	if err := m.validateBoot(); err != nil {
+		return err
+	}
+	if err := m.validateSuspendedBoot(); err != nil {
+		return err
+	}
+	if err := m.validateProfiles(rootPath); err != nil {
+		return err
+	}
+
+	return nil
+}
 
+func validateChecksum(checksum string, size int) error {
+	if checksum == "" {
+		return nil
+	}
+	b, err := hex.DecodeString(checksum)
+	if err != nil {
+		return err
+	}
+	if len(b) != size {
+		return fmt.Errorf("expected %d bytes, got %d", size, len(b))
+	}
 	return nil
 }
 
@@ -0,0 +1,39 @@
+package manifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateProxyAuth(t *testing.T) {
+	tests := []struct {
+		auth  string
+		valid bool
+	}{
+		{"{username: netboot, passwordFile: artifacts-password}", true},
+		{"{tokenFile: artifacts/token}", true},
+		{"{tokenFile: /etc/shadow}", false},
+		{"{tokenFile: ../api-token}", false},
+		{"{tokenFile: artifacts/../token}", false},
+		{"{tokenFile: ./token}", false},
+		{"{tokenFile: token..bak}", false},
+		{"{username: netboot, passwordFile: /etc/netbootd/secrets/password}", false},
+		{"{username: netboot, tokenFile: token}", false},
+	}
+	for _, tt := range tests {
+		_, err := ManifestFromYaml([]byte(`
+id: host
+ipv4: 192.0.2.10/24
+mounts:
+  - path: /private/
+    pathIsPrefix: true
+    proxy: https://artifacts.example.com/
+    proxyAuth: `+tt.auth+`
+`), "")
+		if (err == nil) != tt.valid {
+			t.Errorf("proxyAuth %s: %v", tt.auth, err)
+		} else if err != nil && !strings.Contains(err.Error(), "proxyAuth") {
+			t.Errorf("proxyAuth %s: unexpected error %v", tt.auth, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package manifest
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Profile is a named way to boot a host, e.g. "install", "rescue" or "local", selected with Manifest.ActiveProfile.
+// Fields that are set replace those of the manifest, except Mounts, which take precedence over those of the manifest
+// at the same paths, and Vars, which are merged into those of the manifest.
+type Profile struct {
+	BootFilename string `yaml:"bootFilename"`
+	Ipxe         *bool
+	Grub         *bool `yaml:"grub"`
+	Pxelinux     *bool `yaml:"pxelinux"`
+	// Boot replaces Boot of the manifest, as well as its BootFilename unless the profile sets one.
+	Boot      *BootSpec `yaml:"boot"`
+	Mounts    []Mount
+	Suspended *bool
+	// SuspendedBoot replaces SuspendedBoot of the manifest if set.
+	SuspendedBoot string `yaml:"suspendedBoot"`
+	Vars          map[string]interface{}
+}
+
+// ProfileNames returns names of Profiles in alphabetical order.
+func (m *Manifest) ProfileNames() []string {
+	names := make([]string, 0, len(m.Profiles))
+	for name := range m.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithProfile returns a copy of m with profile name applied, which is served to the host.
+// An empty name returns m as is.
+func (m Manifest) WithProfile(name string) (Manifest, error) {
+	if name == "" {
+		return m, nil
+	}
+	p, ok := m.Profiles[name]
+	if !ok {
+		return m, fmt.Errorf("profile not found: %s", name)
+	}
+
+	if p.Boot != nil {
+		m.Boot = p.Boot
+		m.BootFilename = ""
+	}
+	if p.BootFilename != "" {
+		m.BootFilename = p.BootFilename
+	}
+	if p.Ipxe != nil {
+		m.Ipxe = *p.Ipxe
+	}
+	if p.Grub != nil {
+		m.Grub = *p.Grub
+	}
+	if p.Pxelinux != nil {
+		m.Pxelinux = *p.Pxelinux
+	}
+	if p.Suspended != nil {
+		m.Suspended = *p.Suspended
+	}
+	if p.SuspendedBoot != "" {
+		m.SuspendedBoot = p.SuspendedBoot
+	}
+	if len(p.Mounts) > 0 {
+		// matched first, so they take precedence over mounts of the manifest at the same paths
+		m.Mounts = append(append([]Mount{}, p.Mounts...), m.Mounts...)
+	}
+	if len(p.Vars) > 0 {
+		vars := make(map[string]interface{}, len(m.Vars)+len(p.Vars))
+		for k, v := range m.Vars {
+			vars[k] = v
+		}
+		for k, v := range p.Vars {
+			vars[k] = v
+		}
+		m.Vars = vars
+	}
+	return m, nil
+}
+
+func (m Manifest) validateProfiles(rootPath string) error {
+	if _, ok := m.Profiles[m.ActiveProfile]; m.ActiveProfile != "" && !ok {
+		return fmt.Errorf("activeProfile not found: %s", m.ActiveProfile)
+	}
+	for _, name := range m.ProfileNames() {
+		if name == "" {
+			return fmt.Errorf("profiles need name")
+		}
+		applied, _ := m.WithProfile(name)
+		applied.Profiles = nil
+		applied.ActiveProfile = ""
+		if err := applied.Validate(rootPath); err != nil {
+			return fmt.Errorf("profile %s: %w", name, err)
+		}
+	}
+	return nil
+}
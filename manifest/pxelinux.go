@@ -0,0 +1,62 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// ErrNotServed is returned by GetMount for configuration lookups of boot loaders that are deliberately not answered,
+// so that the loader moves on to the one that is.
+var ErrNotServed = errors.New("configuration lookup not served")
+
+var (
+	pxelinuxUUIDLookup = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+	pxelinuxMACLookup  = regexp.MustCompile(`^01(-[0-9a-f]{2}){6}$`)
+	pxelinuxIPLookup   = regexp.MustCompile(`^[0-9A-F]{1,8}$`)
+)
+
+// pxelinuxConfigMount returns the mount of the PXELINUX configuration of m for PXELINUX lookup path p
+// (pxelinux.cfg/<name> in the directory of pxelinux.0), which is either generated from Boot or
+// a mount at BootPXELINUXPath. Only lookups of default, the MAC addresses and the IP address of m are answered,
+// other lookups of UUIDs, MAC or (partial) IP addresses fail with ErrNotServed.
+func (m *Manifest) pxelinuxConfigMount(p string) (Mount, bool, error) {
+	if !m.Pxelinux || path.Base(path.Dir(p)) != "pxelinux.cfg" {
+		return Mount{}, false, nil
+	}
+
+	switch name := path.Base(p); {
+	case name == "default":
+	case pxelinuxMACLookup.MatchString(name):
+		mac, _ := hex.DecodeString(strings.ReplaceAll(strings.TrimPrefix(name, "01-"), "-", ""))
+		if !m.hasMAC(mac) {
+			return Mount{}, false, fmt.Errorf("%w: %s", ErrNotServed, p)
+		}
+	case pxelinuxIPLookup.MatchString(name):
+		ip := m.IPv4.IP.To4()
+		if ip == nil || name != strings.ToUpper(hex.EncodeToString(ip)) {
+			return Mount{}, false, fmt.Errorf("%w: %s", ErrNotServed, p)
+		}
+	case pxelinuxUUIDLookup.MatchString(name):
+		return Mount{}, false, fmt.Errorf("%w: %s", ErrNotServed, p)
+	default:
+		// other files, e.g. menus included by the configuration
+		return Mount{}, false, nil
+	}
+
+	mount, ok := m.exactMount(BootPXELINUXPath)
+	return mount, ok, nil
+}
+
+func (m *Manifest) hasMAC(mac []byte) bool {
+	for _, a := range m.MAC {
+		if bytes.Equal(a, mac) {
+			return true
+		}
+	}
+	return false
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
@@ -29,6 +30,46 @@ type Manifest struct {
 	Mounts        []Mount
 	Suspended     bool
 	Vars          map[string]interface{}
+	TFTP          TFTPOptions `yaml:"tftp"`
+	// Grub boots UEFI clients (not running iPXE) with shim and GRUB binaries from the GRUB directory of the server,
+	// which load the GRUB configuration of Boot. Takes precedence over Ipxe for these clients.
+	Grub bool `yaml:"grub"`
+	// Pxelinux answers configuration lookups of PXELINUX (pxelinux.cfg/...) with the PXELINUX configuration of Boot,
+	// and makes pxelinux.0 the default BootFilename. pxelinux.0 and its modules have to be provided by mounts.
+	Pxelinux bool `yaml:"pxelinux"`
+	// Boot generates boot loader configurations, see BootSpec. BootFilename defaults to its iPXE script.
+	Boot *BootSpec `yaml:"boot"`
+	// CloudInit, if set, serves a cloud-init NoCloud datasource for the manifest, see NoCloudPath.
+	CloudInit *CloudInit `yaml:"cloudInit"`
+	// Profiles are named alternatives to the boot configuration above, see Profile.
+	Profiles map[string]Profile `yaml:"profiles"`
+	// ActiveProfile selects one of Profiles to serve to the host, none if empty.
+	// A one-shot profile for the next boot only can be set through the API.
+	ActiveProfile string `yaml:"activeProfile"`
+	// SuspendedBoot selects how a Suspended host is booted: SuspendedBootOmit (default), SuspendedBootIPXE,
+	// SuspendedBootGRUB or SuspendedBootIgnore.
+	SuspendedBoot string `yaml:"suspendedBoot"`
+	// Revision is assigned by the store whenever the manifest is put, so that content derived from
+	// a manifest (such as parsed templates) can be reused until it changes.
+	Revision uint64 `yaml:"revision"`
+}
+
+// TFTPOptions tunes TFTP transfers. Zero values fall back to the server-wide defaults.
+type TFTPOptions struct {
+	// Largest block size (RFC 2348) accepted from clients.
+	// Some older PXE ROMs fail with large blocks, 512 effectively disables the option.
+	BlksizeMax int `yaml:"blksizeMax"`
+
+	// Largest window size (RFC 7440) accepted from clients.
+	// 1 disables windowing and falls back to lock-step transfers.
+	WindowsizeMax int `yaml:"windowsizeMax"`
+
+	// Time to wait for an acknowledgement before retransmitting.
+	// A client may still request its own value with the timeout option (RFC 2349).
+	Timeout time.Duration
+
+	// Number of retransmits before the transfer is aborted.
+	Retries int
 }
 
 // Mount represents a path exposed via TFTP and HTTP.
@@ -42,9 +83,47 @@ type Mount struct {
 	// The proxy destination used when handling requests.
 	// Mutually exclusive with Content option.
 	Proxy string
-	// If PathIsPrefix is true and AppendSuffix is true, the suffix to Path Prefix will also be appended to Proxy Or LocalDir.
+	// Mirrors are additional upstream URLs serving the same content as Proxy, used when it fails.
+	Mirrors []string
+	// MirrorPolicy selects the order in which Proxy and Mirrors are tried:
+	// "failover" (default) always starts with Proxy, "roundRobin" spreads requests across all of them.
+	// Upstreams that failed recently are tried last either way.
+	MirrorPolicy string `yaml:"mirrorPolicy"`
+	// ProxyTimeout limits how long each upstream attempt may wait for response headers.
+	ProxyTimeout time.Duration `yaml:"proxyTimeout"`
+	// ProxyRetries is the number of additional upstream attempts after the first one fails.
+	// Defaults to trying each of Proxy and Mirrors once.
+	ProxyRetries int `yaml:"proxyRetries"`
+	// ProxyHeaders are added to upstream requests. Values are templates (text/template) executed with ContentContext.
+	ProxyHeaders map[string]string `yaml:"proxyHeaders"`
+	// ProxyAuth provides credentials for upstream requests.
+	ProxyAuth *ProxyAuth `yaml:"proxyAuth"`
+	// ProxyTLS configures TLS of upstream connections.
+	ProxyTLS *ProxyTLS `yaml:"proxyTLS"`
+	// Redirect is a URL template (passed through template/text, with ContentContext) HTTP clients are redirected to,
+	// so that they fetch content directly. TFTP clients can't be redirected, the URL is proxied for them instead.
+	// Mutually exclusive with Proxy, Content, LocalDir, ISO, Archive and Blob options.
+	Redirect string
+	// RedirectStatus is the HTTP status of redirects, 302 (default) or 307.
+	RedirectStatus int `yaml:"redirectStatus"`
+	// If PathIsPrefix is true and AppendSuffix is true, the suffix to Path Prefix will also be appended to Proxy, Redirect or LocalDir.
 	// Otherwise, it will be many to one proxy.
 	AppendSuffix bool `yaml:"appendSuffix"`
+	// If Spool is true, TFTP transfers of a Proxy mount wait until the whole upstream response is received.
+	// This provides exact transfer size to clients even when upstream omits Content-Length,
+	// and keeps slow upstreams from stalling the transfer into client timeouts.
+	Spool bool
+	// If Cache is true, Proxy responses are stored in the local cache and served from it while fresh,
+	// over both HTTP and TFTP.
+	Cache bool
+	// CacheTTL, if set, is used as freshness lifetime of cached responses instead of upstream cache headers.
+	CacheTTL time.Duration `yaml:"cacheTTL"`
+
+	// Hex-encoded SHA-256 or SHA-512 checksum of the content expected from Proxy or LocalDir.
+	// Content that does not match is not served, a transfer already in progress fails before completing.
+	// Only valid for mounts serving a single file, i.e. when PathIsPrefix is false.
+	Sha256 string `yaml:"sha256"`
+	Sha512 string `yaml:"sha512"`
 
 	// Provides content template (passed through template/text) to serve.
 	// Mutually exclusive with Proxy option.
@@ -57,8 +136,98 @@ type Mount struct {
 	// So that RootPath: /tftpboot, LocalDir: ./files, path: /subdir and client request: /subdir/file.x on the host
 	// becomes /tftpboot/files/file.x
 	LocalDir string `yaml:"localDir"`
+
+	// Provides a path on the host to an ISO 9660 image (with Rock Ridge or Joliet names) to serve files from.
+	// The suffix to Path selects the file inside the image, so that ISO: /srv/installer.iso, path: /installer/
+	// and client request: /installer/casper/vmlinuz serves casper/vmlinuz from the image.
+	// Requires PathIsPrefix. A relative path is relative to rootPath, like LocalDir.
+	ISO string `yaml:"iso"`
+
+	// Provides a path on the host to a .tar, .tar.gz, .tar.zst or .zip archive to serve members of.
+	// Members are selected like files of an ISO image. Requires PathIsPrefix.
+	Archive string `yaml:"archive"`
+
+	// Blob serves content uploaded to the blob store (PUT /api/blobs), referenced by its digest as "sha256:<hex>".
+	// Blobs referenced by any manifest are kept, others are garbage-collected.
+	Blob string `yaml:"blob"`
+
+	// Exec generates content by running a local program, its standard output is served.
+	// Mutually exclusive with Proxy, Redirect, Content, LocalDir, ISO, Archive and Blob options.
+	Exec *ExecOptions `yaml:"exec"`
+
+	// InitrdOverlay lists files appended to the served content (an initrd) as a generated newc cpio archive,
+	// so that per-host configuration can be passed to installers. Requires Proxy, LocalDir, ISO, Archive or Blob.
+	InitrdOverlay []InitrdFile `yaml:"initrdOverlay"`
 }
 
+// ExecOptions configures the program of an exec mount.
+type ExecOptions struct {
+	// Program to run, followed by its arguments.
+	Command []string
+	// Input selects how the request is passed to the program: "stdin" (default) writes it as JSON
+	// to standard input, "env" sets NETBOOTD_* environment variables.
+	Input string
+	// Time the program may run, including waiting for a free slot under the concurrency limit. Defaults to 10s.
+	Timeout time.Duration
+	// Largest output in bytes, the program fails when it writes more. Defaults to 16 MiB.
+	MaxOutput int64 `yaml:"maxOutput"`
+}
+
+// BlobDigestPrefix starts Blob of mounts, the algorithm of blob digests.
+const BlobDigestPrefix = "sha256:"
+
+const (
+	ExecInputStdin = "stdin"
+	ExecInputEnv   = "env"
+)
+
+// InitrdFile is a file or directory of an initrd overlay.
+type InitrdFile struct {
+	// Path of the file in the initrd. Directories missing from the initrd must be listed as well.
+	Path string
+	// Octal permissions, defaults to 0644 for files and 0755 for directories.
+	Mode string
+	// Directory creates a directory at Path (or sets the permissions of an existing one) instead of a file.
+	Directory bool `yaml:"directory"`
+	// Content template (passed through template/text), with ContentContext like Mount.Content.
+	Content string
+}
+
+// ProxyAuth provides credentials for upstream requests of a proxy mount.
+// Credentials are read from files on every request, so they can be rotated without updating manifests.
+// Files are relative to the secrets directory of the server (see IsSecretPath).
+type ProxyAuth struct {
+	// HTTP basic authentication with Username and password read from PasswordFile.
+	Username     string `yaml:"username"`
+	PasswordFile string `yaml:"passwordFile"`
+	// Bearer token authentication with token read from TokenFile.
+	TokenFile string `yaml:"tokenFile"`
+}
+
+// IsSecretPath reports whether file is a clean relative path inside the secrets directory,
+// without any ".." element, so that manifests can't read other files as credentials.
+func IsSecretPath(file string) bool {
+	return file != "" && filepath.IsLocal(file) && filepath.Clean(file) == file &&
+		!strings.Contains(filepath.ToSlash(file), "..")
+}
+
+// ProxyTLS configures TLS of upstream connections of a proxy mount.
+// Files are loaded when the configuration is first used.
+type ProxyTLS struct {
+	// PEM-encoded CA certificates trusted instead of system roots.
+	CAFile string `yaml:"caFile"`
+	// PEM-encoded client certificate and its private key.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// Disables verification of upstream certificates, use for testing only.
+	InsecureSkipVerify bool `yaml:"insecureSkipVerify"`
+}
+
+const (
+	MirrorPolicyFailover   = "failover"
+	MirrorPolicyRoundRobin = "roundRobin"
+)
+
 func (m Mount) hostPathPrefix(rootPath string) string {
 	if filepath.IsAbs(m.LocalDir) {
 		return m.LocalDir
@@ -78,8 +247,83 @@ func (m Mount) ValidateHostPath(rootPath string, hostPath string) bool {
 	return strings.HasPrefix(hostPath, m.hostPathPrefix(rootPath))
 }
 
+// ArchivePath returns path of the ISO image or archive on the host.
+func (m Mount) ArchivePath(rootPath string) string {
+	p := m.ISO
+	if p == "" {
+		p = m.Archive
+	}
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(rootPath, p)
+}
+
+// MemberPath returns path of the file requested with requestPath relative to the root of an image or archive.
+func (m Mount) MemberPath(requestPath string) string {
+	suffix := strings.TrimPrefix(strings.TrimLeft(requestPath, "/"), strings.TrimLeft(m.Path, "/"))
+	return strings.TrimPrefix(path.Clean("/"+suffix), "/")
+}
+
+// BlobDigest returns the hex-encoded SHA-256 digest of Blob, without the "sha256:" prefix.
+func (m Mount) BlobDigest() string {
+	return strings.ToLower(strings.TrimPrefix(m.Blob, BlobDigestPrefix))
+}
+
+// declaredMounts returns Mounts followed by mounts of all profiles.
+func (m Manifest) declaredMounts() []Mount {
+	mounts := append([]Mount{}, m.Mounts...)
+	for _, name := range m.ProfileNames() {
+		mounts = append(mounts, m.Profiles[name].Mounts...)
+	}
+	return mounts
+}
+
+// Blobs returns digests of blobs referenced by mounts of the manifest and its profiles, as returned by Mount.BlobDigest.
+func (m Manifest) Blobs() []string {
+	var digests []string
+	for _, mount := range m.declaredMounts() {
+		if mount.Blob != "" {
+			digests = append(digests, mount.BlobDigest())
+		}
+	}
+	return digests
+}
+
+// ExecCommands returns programs run by exec mounts of the manifest and its profiles.
+func (m Manifest) ExecCommands() []string {
+	var commands []string
+	for _, mount := range m.declaredMounts() {
+		if mount.Exec != nil && len(mount.Exec.Command) > 0 {
+			commands = append(commands, mount.Exec.Command[0])
+		}
+	}
+	return commands
+}
+
+// Upstreams returns Proxy followed by Mirrors.
+func (m Mount) Upstreams() []string {
+	if m.Proxy == "" {
+		return nil
+	}
+	return append([]string{m.Proxy}, m.Mirrors...)
+}
+
+// ProxyURL returns URL of requestPath at upstream, which is either Proxy, one of Mirrors or the Redirect target.
+func (m Mount) ProxyURL(upstream, requestPath string) string {
+	if m.AppendSuffix {
+		return upstream + strings.TrimPrefix(requestPath, m.Path)
+	}
+	return upstream
+}
+
 func (m Mount) ProxyDirector() (func(req *http.Request), error) {
-	target, err := url.Parse(m.Proxy)
+	return m.ProxyDirectorFor(m.Proxy)
+}
+
+// ProxyDirectorFor returns a reverse proxy director for upstream, which is either Proxy or one of Mirrors.
+func (m Mount) ProxyDirectorFor(upstream string) (func(req *http.Request), error) {
+	target, err := url.Parse(upstream)
 	if err != nil {
 		return nil, err
 	}
@@ -133,16 +377,77 @@ type ContentContext struct {
 	SyslogHost string
 	// Copy of Manifest
 	Manifest *Manifest
+
+	// Protocol of the request, "http" or "tftp"
+	Protocol string
+	// Path requested by the client
+	Path string
+	// Suffix of Path to the path of a prefix mount, empty for other mounts
+	Suffix string
+	// Query parameters of HTTP requests
+	Query url.Values
+	// User-Agent header of HTTP requests
+	UserAgent string
+	// Facts of the last DHCP request answered for this manifest, nil if none since start
+	DHCP *DHCPFacts
+}
+
+// DHCPFacts describes the DHCP request of a client, as recorded when it is answered.
+type DHCPFacts struct {
+	// Hardware address of the interface that sent the request, i.e. the one booting
+	MAC net.HardwareAddr `json:"mac"`
+	// Client system architecture (option 93) as a number, -1 if not sent
+	ArchCode int `json:"archCode"`
+	// Architecture derived from ArchCode: "x86" (BIOS, either 32 or 64-bit), "i386", "amd64", "arm", "arm64",
+	// "riscv32", "riscv64" or empty if unknown
+	Arch string `json:"arch"`
+	// Firmware derived from ArchCode: "bios", "uefi", "uboot" or empty if unknown
+	Firmware string `json:"firmware"`
+	// HTTPBoot is true for UEFI HTTP boot (and similar) clients
+	HTTPBoot bool `json:"httpBoot"`
+	// Vendor class identifier (option 60), e.g. "PXEClient:Arch:00007:UNDI:003016"
+	VendorClass string `json:"vendorClass"`
+	// User class (option 77), e.g. "iPXE"
+	UserClass []string `json:"userClass"`
+	// Hostname sent by the client (option 12)
+	Hostname string `json:"hostname"`
+	// Address of the relay agent (giaddr), nil if not relayed
+	RelayIP net.IP `json:"relayIP"`
+	// Time the request was answered
+	Time time.Time `json:"time"`
+}
+
+// allMounts returns Mounts followed by mounts generated from the manifest.
+func (m *Manifest) allMounts() []Mount {
+	mounts := make([]Mount, 0, len(m.Mounts))
+	mounts = append(mounts, m.Mounts...)
+	mounts = append(mounts, m.bootMounts()...)
+	mounts = append(mounts, m.suspendedMounts()...)
+	return append(mounts, m.noCloudMounts()...)
+}
+
+// exactMount returns the mount at path, if it is not a prefix mount.
+func (m *Manifest) exactMount(path string) (Mount, bool) {
+	path = strings.TrimLeft(path, "/")
+	for _, mount := range m.allMounts() {
+		if !mount.PathIsPrefix && strings.TrimLeft(mount.Path, "/") == path {
+			return mount, true
+		}
+	}
+	return Mount{}, false
 }
 
 // GetMount returns best matching Mount, respecting exact and prefix-based mount paths.
 // Longest path match is considered "best".
 // If the path in the Mount or being matched begins with a slash (/), it is ignored.
+// Mounts generated from the manifest (e.g. of CloudInit) are matched after Mounts.
+// Configuration lookups of GRUB and PXELINUX are answered with the configuration of the manifest
+// (see BootGRUBPath and BootPXELINUXPath) unless a mount matches them exactly.
 func (m *Manifest) GetMount(path string) (Mount, error) {
 	path = strings.TrimLeft(path, "/")
 	var bestMount Mount
 	var found bool
-	for _, mount := range m.Mounts {
+	for _, mount := range m.allMounts() {
 		mountPath := strings.TrimLeft(mount.Path, "/")
 		if !mount.PathIsPrefix && mountPath == path {
 			return mount, nil
@@ -154,6 +459,15 @@ func (m *Manifest) GetMount(path string) (Mount, error) {
 		}
 	}
 
+	// boot loaders probe several per-host paths for their configuration, these take precedence over prefix mounts
+	// serving the rest of their files
+	if mount, ok := m.grubConfigMount(path); ok {
+		return mount, nil
+	}
+	if mount, ok, err := m.pxelinuxConfigMount(path); ok || err != nil {
+		return mount, err
+	}
+
 	if found {
 		return bestMount, nil
 	}
@@ -0,0 +1,86 @@
+package manifest
+
+import "fmt"
+
+// Behaviors of suspended manifests, see Manifest.SuspendedBoot.
+const (
+	// SuspendedBootOmit omits the TFTP server name and boot file from DHCP responses,
+	// so that the firmware falls through to the next boot option once network boot times out.
+	SuspendedBootOmit = "omit"
+	// SuspendedBootIPXE serves an iPXE script (BootLocalIPXEPath) booting from the local disk:
+	// sanboot of the first disk with BIOS, exit to the next boot option with UEFI. Requires Ipxe.
+	SuspendedBootIPXE = "ipxe"
+	// SuspendedBootGRUB serves a GRUB configuration (BootLocalGRUBPath) chainloading the removable media loader
+	// of the EFI system partition, to clients booting with GRUB. Requires Grub.
+	SuspendedBootGRUB = "grub"
+	// SuspendedBootIgnore doesn't answer DHCP requests of the host at all.
+	SuspendedBootIgnore = "ignore"
+)
+
+// Paths of local disk boot configurations of suspended manifests.
+const (
+	BootLocalIPXEPath = BootPath + "local.ipxe"
+	BootLocalGRUBPath = BootPath + "local.grub.cfg"
+)
+
+const localIPXE = `#!ipxe
+iseq ${platform} pcbios && sanboot --no-describe --drive 0x80 ||
+exit
+`
+
+const localGRUB = `set timeout=0
+insmod part_gpt
+insmod part_msdos
+insmod fat
+insmod chain
+if [ "$grub_cpu" = "arm64" ]; then
+  set loader=/EFI/BOOT/BOOTAA64.EFI
+else
+  set loader=/EFI/BOOT/BOOTX64.EFI
+fi
+if search --no-floppy --file --set=root $loader; then
+  chainloader $loader
+  boot
+fi
+exit
+`
+
+// IsSuspendedBoot reports whether m is suspended with behavior, see SuspendedBoot.
+func (m *Manifest) IsSuspendedBoot(behavior string) bool {
+	if !m.Suspended {
+		return false
+	}
+	if m.SuspendedBoot == "" {
+		return behavior == SuspendedBootOmit
+	}
+	return m.SuspendedBoot == behavior
+}
+
+func (m Manifest) validateSuspendedBoot() error {
+	switch m.SuspendedBoot {
+	case "", SuspendedBootOmit, SuspendedBootIgnore:
+	case SuspendedBootIPXE:
+		// without iPXE, the firmware would be given the script as its boot file
+		if !m.Ipxe {
+			return fmt.Errorf("suspendedBoot %s requires ipxe", m.SuspendedBoot)
+		}
+	case SuspendedBootGRUB:
+		if !m.Grub {
+			return fmt.Errorf("suspendedBoot %s requires grub", m.SuspendedBoot)
+		}
+	default:
+		return fmt.Errorf("unknown suspendedBoot: %s", m.SuspendedBoot)
+	}
+	return nil
+}
+
+// suspendedMounts returns content mounts booting m from the local disk, if suspended with such a behavior.
+func (m *Manifest) suspendedMounts() []Mount {
+	switch {
+	case m.IsSuspendedBoot(SuspendedBootIPXE):
+		return []Mount{{Path: BootLocalIPXEPath, Content: localIPXE}}
+	case m.IsSuspendedBoot(SuspendedBootGRUB):
+		return []Mount{{Path: BootLocalGRUBPath, Content: localGRUB}}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// Package netconfig generates static network configuration of the interface a manifest describes,
+// in formats of common installers and distributions: netplan, cloud-init network config (version 2),
+// NetworkManager keyfiles and RHEL ifcfg files. Interfaces are matched by MAC address, not by name.
+package netconfig
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/google/uuid"
+)
+
+// Name identifies the generated connection (netplan ID, NetworkManager connection and ifcfg NAME).
+const Name = "netboot0"
+
+// namespace of NetworkManager connection UUIDs, which are derived from the MAC address to stay stable
+var namespace = uuid.MustParse("0cf7e75a-d6ef-4d1b-9f0d-5bca5b2e14c7")
+
+// Interface is the network configuration of the interface of a manifest.
+type Interface struct {
+	MAC net.HardwareAddr
+	// Static address, nil for DHCP
+	IP net.IP
+	// Prefix length of IP
+	Prefix  int
+	Gateway net.IP
+	DNS     []net.IP
+	// DNS search domain, empty if none
+	Domain string
+}
+
+// New returns the configuration of the interface with hardware address mac, which must be one of m.MAC,
+// configured statically with m.IPv4, m.Router and m.DNS.
+// If mac is nil, the first address of m.MAC is used.
+func New(m *manifest.Manifest, mac net.HardwareAddr) (Interface, error) {
+	if m == nil {
+		return Interface{}, errors.New("no manifest")
+	}
+	if mac == nil {
+		if len(m.MAC) == 0 {
+			return Interface{}, fmt.Errorf("manifest %s has no MAC address", m.ID)
+		}
+		mac = net.HardwareAddr(m.MAC[0])
+	}
+
+	i := Interface{
+		MAC:    mac,
+		DNS:    m.DNS,
+		Domain: m.Domain,
+	}
+	if ip := m.IPv4.IP.To4(); ip != nil {
+		i.IP = ip
+		i.Prefix, _ = m.IPv4.Net.Mask.Size()
+		if len(m.Router) > 0 {
+			i.Gateway = m.Router[0]
+		}
+	}
+	return i, nil
+}
+
+// Address returns IP in CIDR notation, e.g. 10.0.0.5/24.
+func (i Interface) Address() string {
+	return i.IP.String() + "/" + strconv.Itoa(i.Prefix)
+}
+
+// Netplan returns a netplan configuration file.
+func (i Interface) Netplan() string {
+	buf := new(bytes.Buffer)
+	buf.WriteString("network:\n")
+	i.writeV2(buf, "  ")
+	return buf.String()
+}
+
+// CloudInit returns a cloud-init network configuration (version 2), e.g. for network-config of NoCloud.
+func (i Interface) CloudInit() string {
+	buf := new(bytes.Buffer)
+	i.writeV2(buf, "")
+	return buf.String()
+}
+
+// writeV2 writes configuration in the format shared by netplan and cloud-init, indented by indent.
+func (i Interface) writeV2(buf *bytes.Buffer, indent string) {
+	line := func(depth int, format string, args ...any) {
+		buf.WriteString(indent + strings.Repeat("  ", depth))
+		fmt.Fprintf(buf, format, args...)
+		buf.WriteByte('\n')
+	}
+	line(0, "version: 2")
+	line(0, "ethernets:")
+	line(1, "%s:", Name)
+	line(2, "match:")
+	line(3, "macaddress: %q", i.MAC.String())
+	if i.IP == nil {
+		line(2, "dhcp4: true")
+		return
+	}
+	line(2, "dhcp4: false")
+	line(2, "addresses:")
+	line(3, "- %s", i.Address())
+	if i.Gateway != nil {
+		line(2, "routes:")
+		line(3, "- to: 0.0.0.0/0")
+		line(3, "  via: %s", i.Gateway)
+	}
+	if len(i.DNS) > 0 || i.Domain != "" {
+		line(2, "nameservers:")
+		if len(i.DNS) > 0 {
+			line(3, "addresses:")
+			for _, dns := range i.DNS {
+				line(4, "- %s", dns)
+			}
+		}
+		if i.Domain != "" {
+			line(3, "search:")
+			line(4, "- %q", i.Domain)
+		}
+	}
+}
+
+// NMKeyfile returns a NetworkManager connection keyfile, to be stored in /etc/NetworkManager/system-connections
+// with mode 0600.
+func (i Interface) NMKeyfile() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "[connection]\nid=%s\nuuid=%s\ntype=ethernet\nautoconnect=true\n\n", Name,
+		uuid.NewSHA1(namespace, i.MAC))
+	fmt.Fprintf(buf, "[ethernet]\nmac-address=%s\n\n", strings.ToUpper(i.MAC.String()))
+	if i.IP == nil {
+		buf.WriteString("[ipv4]\nmethod=auto\n")
+		return buf.String()
+	}
+	buf.WriteString("[ipv4]\nmethod=manual\n")
+	if i.Gateway != nil {
+		fmt.Fprintf(buf, "address1=%s,%s\n", i.Address(), i.Gateway)
+	} else {
+		fmt.Fprintf(buf, "address1=%s\n", i.Address())
+	}
+	if len(i.DNS) > 0 {
+		buf.WriteString("dns=")
+		for _, dns := range i.DNS {
+			buf.WriteString(dns.String() + ";")
+		}
+		buf.WriteByte('\n')
+	}
+	if i.Domain != "" {
+		fmt.Fprintf(buf, "dns-search=%s;\n", i.Domain)
+	}
+	return buf.String()
+}
+
+// Ifcfg returns a RHEL network-scripts file, to be stored as /etc/sysconfig/network-scripts/ifcfg-<Name>.
+func (i Interface) Ifcfg() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "NAME=%s\nHWADDR=%s\nTYPE=Ethernet\nONBOOT=yes\n", Name, strings.ToUpper(i.MAC.String()))
+	if i.IP == nil {
+		buf.WriteString("BOOTPROTO=dhcp\n")
+		return buf.String()
+	}
+	fmt.Fprintf(buf, "BOOTPROTO=none\nIPADDR=%s\nPREFIX=%d\n", i.IP, i.Prefix)
+	if i.Gateway != nil {
+		fmt.Fprintf(buf, "GATEWAY=%s\nDEFROUTE=yes\n", i.Gateway)
+	}
+	for n, dns := range i.DNS {
+		fmt.Fprintf(buf, "DNS%d=%s\n", n+1, dns)
+	}
+	if i.Domain != "" {
+		fmt.Fprintf(buf, "DOMAIN=%q\n", i.Domain)
+	}
+	return buf.String()
+}
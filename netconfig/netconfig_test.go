@@ -0,0 +1,211 @@
+package netconfig
+
+import (
+	"net"
+	"testing"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+func parseManifest(t *testing.T, s string) *manifest.Manifest {
+	t.Helper()
+	m, err := manifest.ManifestFromYaml([]byte(s), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &m
+}
+
+func TestNew(t *testing.T) {
+	m := parseManifest(t, `
+id: host
+ipv4: 192.0.2.10/24
+mac: [52:54:00:12:34:56, 52:54:00:12:34:57]
+router: [192.0.2.1, 192.0.2.2]
+`)
+	i, err := New(m, nil)
+	if err != nil || i.MAC.String() != "52:54:00:12:34:56" || i.Address() != "192.0.2.10/24" || !i.Gateway.Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Errorf("New(%s, nil) = %+v, %v", m.ID, i, err)
+	}
+	mac, _ := net.ParseMAC("52:54:00:12:34:57")
+	if i, err := New(m, mac); err != nil || i.MAC.String() != mac.String() {
+		t.Errorf("New(%s, %s) = %+v, %v", m.ID, mac, i, err)
+	}
+
+	if _, err := New(parseManifest(t, "id: host\nipv4: 192.0.2.10/24\n"), nil); err == nil {
+		t.Error("interface of manifest without MAC")
+	}
+	if _, err := New(nil, nil); err == nil {
+		t.Error("interface without manifest")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		// generated configurations, by format
+		netplan, cloudInit, nmKeyfile, ifcfg string
+	}{
+		{"static", `
+id: host
+ipv4: 192.0.2.10/24
+mac: [52:54:00:12:34:56]
+router: [192.0.2.1]
+dns: [192.0.2.53, 198.51.100.53]
+domain: example.com
+`, `network:
+  version: 2
+  ethernets:
+    netboot0:
+      match:
+        macaddress: "52:54:00:12:34:56"
+      dhcp4: false
+      addresses:
+        - 192.0.2.10/24
+      routes:
+        - to: 0.0.0.0/0
+          via: 192.0.2.1
+      nameservers:
+        addresses:
+          - 192.0.2.53
+          - 198.51.100.53
+        search:
+          - "example.com"
+`, `version: 2
+ethernets:
+  netboot0:
+    match:
+      macaddress: "52:54:00:12:34:56"
+    dhcp4: false
+    addresses:
+      - 192.0.2.10/24
+    routes:
+      - to: 0.0.0.0/0
+        via: 192.0.2.1
+    nameservers:
+      addresses:
+        - 192.0.2.53
+        - 198.51.100.53
+      search:
+        - "example.com"
+`, `[connection]
+id=netboot0
+uuid=5e075976-c605-5238-aafb-2b9cb13f40b7
+type=ethernet
+autoconnect=true
+
+[ethernet]
+mac-address=52:54:00:12:34:56
+
+[ipv4]
+method=manual
+address1=192.0.2.10/24,192.0.2.1
+dns=192.0.2.53;198.51.100.53;
+dns-search=example.com;
+`, `NAME=netboot0
+HWADDR=52:54:00:12:34:56
+TYPE=Ethernet
+ONBOOT=yes
+BOOTPROTO=none
+IPADDR=192.0.2.10
+PREFIX=24
+GATEWAY=192.0.2.1
+DEFROUTE=yes
+DNS1=192.0.2.53
+DNS2=198.51.100.53
+DOMAIN="example.com"
+`},
+		{"static without gateway and DNS", `
+id: host
+ipv4: 10.0.0.5/8
+mac: [52:54:00:12:34:56]
+`, `network:
+  version: 2
+  ethernets:
+    netboot0:
+      match:
+        macaddress: "52:54:00:12:34:56"
+      dhcp4: false
+      addresses:
+        - 10.0.0.5/8
+`, `version: 2
+ethernets:
+  netboot0:
+    match:
+      macaddress: "52:54:00:12:34:56"
+    dhcp4: false
+    addresses:
+      - 10.0.0.5/8
+`, `[connection]
+id=netboot0
+uuid=5e075976-c605-5238-aafb-2b9cb13f40b7
+type=ethernet
+autoconnect=true
+
+[ethernet]
+mac-address=52:54:00:12:34:56
+
+[ipv4]
+method=manual
+address1=10.0.0.5/8
+`, `NAME=netboot0
+HWADDR=52:54:00:12:34:56
+TYPE=Ethernet
+ONBOOT=yes
+BOOTPROTO=none
+IPADDR=10.0.0.5
+PREFIX=8
+`},
+		{"DHCP", `
+id: host
+mac: [52:54:00:12:34:56]
+dns: [192.0.2.53]
+`, `network:
+  version: 2
+  ethernets:
+    netboot0:
+      match:
+        macaddress: "52:54:00:12:34:56"
+      dhcp4: true
+`, `version: 2
+ethernets:
+  netboot0:
+    match:
+      macaddress: "52:54:00:12:34:56"
+    dhcp4: true
+`, `[connection]
+id=netboot0
+uuid=5e075976-c605-5238-aafb-2b9cb13f40b7
+type=ethernet
+autoconnect=true
+
+[ethernet]
+mac-address=52:54:00:12:34:56
+
+[ipv4]
+method=auto
+`, `NAME=netboot0
+HWADDR=52:54:00:12:34:56
+TYPE=Ethernet
+ONBOOT=yes
+BOOTPROTO=dhcp
+`},
+	}
+	for _, tt := range tests {
+		i, err := New(parseManifest(t, tt.manifest), nil)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for format, got := range map[string][2]string{
+			"netplan":   {i.Netplan(), tt.netplan},
+			"cloudInit": {i.CloudInit(), tt.cloudInit},
+			"nmKeyfile": {i.NMKeyfile(), tt.nmKeyfile},
+			"ifcfg":     {i.Ifcfg(), tt.ifcfg},
+		} {
+			if got[0] != got[1] {
+				t.Errorf("%s: %s =\n%s\nwant\n%s", tt.name, format, got[0], got[1])
+			}
+		}
+	}
+}
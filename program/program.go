@@ -0,0 +1,242 @@
+// Package program generates content of exec mounts by running local programs.
+package program
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+const (
+	defaultTimeout   = 10 * time.Second
+	defaultMaxOutput = 16 << 20
+	// stderr is kept only for error messages
+	maxStderr = 4096
+)
+
+// ErrBusy is returned when no program could be started before the timeout because of the concurrency limit.
+var ErrBusy = errors.New("too many programs running")
+
+// ErrNotAllowed is returned for programs not in Config.Commands.
+var ErrNotAllowed = errors.New("program not allowed")
+
+// defaultPath is the only environment variable programs get besides those describing the request,
+// the environment of netbootd itself may hold secrets.
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// ExitError is returned when a program exits with a non-zero status.
+type ExitError struct {
+	Command  string
+	ExitCode int
+	Stderr   string
+}
+
+func (e *ExitError) Error() string {
+	msg := fmt.Sprintf("%s exited with status %d", e.Command, e.ExitCode)
+	if e.Stderr != "" {
+		msg += ": " + e.Stderr
+	}
+	return msg
+}
+
+type Config struct {
+	// Maximum number of programs running at the same time, 0 means no limit.
+	Concurrency int
+	// Absolute paths of programs exec mounts may run, none if empty.
+	Commands []string
+}
+
+type Runner struct {
+	slots    chan struct{}
+	commands map[string]bool
+}
+
+func NewRunner(cfg Config) *Runner {
+	r := &Runner{commands: make(map[string]bool)}
+	if cfg.Concurrency > 0 {
+		r.slots = make(chan struct{}, cfg.Concurrency)
+	}
+	for _, command := range cfg.Commands {
+		if filepath.IsAbs(command) {
+			r.commands[filepath.Clean(command)] = true
+		}
+	}
+	return r
+}
+
+// Allowed returns ErrNotAllowed unless command is one of the programs configured in Config.Commands.
+// Commands are compared by absolute path, so that PATH does not select the program.
+func (r *Runner) Allowed(command string) error {
+	if !filepath.IsAbs(command) || !r.commands[filepath.Clean(command)] {
+		return fmt.Errorf("%w: %s", ErrNotAllowed, command)
+	}
+	return nil
+}
+
+// request is the template context of a request as passed to programs in JSON.
+type request struct {
+	Protocol    string              `json:"protocol"`
+	Path        string              `json:"path"`
+	Suffix      string              `json:"suffix"`
+	Query       url.Values          `json:"query,omitempty"`
+	UserAgent   string              `json:"userAgent,omitempty"`
+	LocalIP     string              `json:"localIP"`
+	RemoteIP    string              `json:"remoteIP"`
+	HttpBaseUrl string              `json:"httpBaseUrl"`
+	ApiBaseUrl  string              `json:"apiBaseUrl"`
+	SyslogHost  string              `json:"syslogHost"`
+	DHCP        *manifest.DHCPFacts `json:"dhcp"`
+	Manifest    *manifest.Manifest  `json:"manifest"`
+}
+
+func newRequest(in manifest.ContentContext) request {
+	req := request{
+		Protocol:   in.Protocol,
+		Path:       in.Path,
+		Suffix:     in.Suffix,
+		Query:      in.Query,
+		UserAgent:  in.UserAgent,
+		SyslogHost: in.SyslogHost,
+		DHCP:       in.DHCP,
+		Manifest:   in.Manifest,
+	}
+	if in.LocalIP != nil {
+		req.LocalIP = in.LocalIP.String()
+	}
+	if in.RemoteIP != nil {
+		req.RemoteIP = in.RemoteIP.String()
+	}
+	if in.HttpBaseUrl != nil {
+		req.HttpBaseUrl = in.HttpBaseUrl.String()
+	}
+	if in.ApiBaseUrl != nil {
+		req.ApiBaseUrl = in.ApiBaseUrl.String()
+	}
+	return req
+}
+
+// Run runs the program configured by opts for the request described by in and returns its standard output.
+func (r *Runner) Run(ctx context.Context, opts manifest.ExecOptions, in manifest.ContentContext) ([]byte, error) {
+	if err := r.Allowed(opts.Command[0]); err != nil {
+		return nil, err
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	maxOutput := opts.MaxOutput
+	if maxOutput <= 0 {
+		maxOutput = defaultMaxOutput
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if r.slots != nil {
+		select {
+		case r.slots <- struct{}{}:
+			defer func() { <-r.slots }()
+		case <-ctx.Done():
+			return nil, ErrBusy
+		}
+	}
+
+	req, err := json.Marshal(newRequest(in))
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, opts.Command[0], opts.Command[1:]...)
+	// do not wait for descendants holding on to output pipes once the program is killed
+	cmd.WaitDelay = time.Second
+	cmd.Env = []string{defaultPath}
+	if opts.Input == manifest.ExecInputEnv {
+		cmd.Env = append(cmd.Env, environment(newRequest(in), req)...)
+	} else {
+		cmd.Stdin = bytes.NewReader(req)
+	}
+	stdout := &limitedBuffer{max: maxOutput, exceeded: cancel}
+	stderr := &limitedBuffer{max: maxStderr, truncate: true}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err = cmd.Run()
+	var exitErr *exec.ExitError
+	if stdout.overflow {
+		return nil, fmt.Errorf("%s: output exceeds %d bytes", opts.Command[0], maxOutput)
+	} else if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("%s: timed out after %s", opts.Command[0], timeout)
+	} else if errors.As(err, &exitErr) {
+		return nil, &ExitError{
+			Command:  opts.Command[0],
+			ExitCode: exitErr.ExitCode(),
+			Stderr:   strings.TrimSpace(stderr.buf.String()),
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return stdout.buf.Bytes(), nil
+}
+
+// environment returns variables describing the request, for programs configured to read them instead of stdin.
+func environment(req request, encoded []byte) []string {
+	var manifest []byte
+	if req.Manifest != nil {
+		manifest, _ = json.Marshal(req.Manifest)
+	}
+	var mac, arch, firmware string
+	if req.DHCP != nil {
+		mac, arch, firmware = req.DHCP.MAC.String(), req.DHCP.Arch, req.DHCP.Firmware
+	}
+	return []string{
+		"NETBOOTD_PROTOCOL=" + req.Protocol,
+		"NETBOOTD_PATH=" + req.Path,
+		"NETBOOTD_SUFFIX=" + req.Suffix,
+		"NETBOOTD_QUERY=" + req.Query.Encode(),
+		"NETBOOTD_USER_AGENT=" + req.UserAgent,
+		"NETBOOTD_MAC=" + mac,
+		"NETBOOTD_ARCH=" + arch,
+		"NETBOOTD_FIRMWARE=" + firmware,
+		"NETBOOTD_LOCAL_IP=" + req.LocalIP,
+		"NETBOOTD_REMOTE_IP=" + req.RemoteIP,
+		"NETBOOTD_HTTP_BASE_URL=" + req.HttpBaseUrl,
+		"NETBOOTD_API_BASE_URL=" + req.ApiBaseUrl,
+		"NETBOOTD_SYSLOG_HOST=" + req.SyslogHost,
+		"NETBOOTD_MANIFEST=" + string(manifest),
+		"NETBOOTD_REQUEST=" + string(encoded),
+	}
+}
+
+// limitedBuffer stores up to max bytes. Beyond that, it either drops the rest (truncate)
+// or fails the write and calls exceeded.
+type limitedBuffer struct {
+	buf      bytes.Buffer
+	max      int64
+	truncate bool
+	exceeded func()
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.max - int64(b.buf.Len())
+	if int64(len(p)) <= room {
+		return b.buf.Write(p)
+	}
+	if b.truncate {
+		b.buf.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	b.overflow = true
+	b.exceeded()
+	return 0, errors.New("output too large")
+}
@@ -0,0 +1,166 @@
+package program
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+func shell(script string) manifest.ExecOptions {
+	return manifest.ExecOptions{Command: []string{"/bin/sh", "-c", script}}
+}
+
+func testContext() manifest.ContentContext {
+	mac, _ := net.ParseMAC("52:54:00:12:34:56")
+	m := manifest.Manifest{ID: "host", IPv4: manifest.IPWithNet{IP: net.IPv4(192, 0, 2, 10)}}
+	m.IPv4.Net.IP, m.IPv4.Net.Mask = net.IPv4(192, 0, 2, 0), net.CIDRMask(24, 32)
+	return manifest.ContentContext{
+		LocalIP:     net.IPv4(192, 0, 2, 1),
+		RemoteIP:    net.IPv4(192, 0, 2, 10),
+		HttpBaseUrl: &url.URL{Scheme: "http", Host: "192.0.2.1:8080"},
+		Manifest:    &m,
+		Protocol:    "http",
+		Path:        "/config/host.ign",
+		Suffix:      "host.ign",
+		Query:       url.Values{"stage": {"install"}},
+		DHCP:        &manifest.DHCPFacts{MAC: mac, Arch: "amd64", Firmware: "uefi"},
+	}
+}
+
+func TestRun(t *testing.T) {
+	r := NewRunner(Config{Commands: []string{"/bin/sh"}})
+	t.Setenv("NETBOOTD_TEST_SECRET", "secret")
+
+	// the request as JSON on stdin
+	out, err := r.Run(context.Background(), shell("cat"), testContext())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the manifest as far as it is read back, the JSON of its addresses doesn't round-trip
+	var req struct {
+		request
+		Manifest struct{ ID string } `json:"manifest"`
+	}
+	if err := json.Unmarshal(out, &req); err != nil {
+		t.Fatalf("%s: %v", out, err)
+	}
+	if req.Path != "/config/host.ign" || req.RemoteIP != "192.0.2.10" || req.HttpBaseUrl != "http://192.0.2.1:8080" ||
+		req.Query.Get("stage") != "install" || req.DHCP.Arch != "amd64" || req.Manifest.ID != "host" {
+		t.Errorf("got request %s", out)
+	}
+
+	// or in the environment, without that of netbootd
+	opts := shell(`printf '%s %s %s %s|%s' "$NETBOOTD_PATH" "$NETBOOTD_MAC" "$NETBOOTD_FIRMWARE" "$NETBOOTD_QUERY" "$NETBOOTD_TEST_SECRET"; cat`)
+	opts.Input = manifest.ExecInputEnv
+	out, err = r.Run(context.Background(), opts, testContext())
+	if want := "/config/host.ign 52:54:00:12:34:56 uefi stage=install|"; err != nil || string(out) != want {
+		t.Errorf("got %q, %v, want %q", out, err, want)
+	}
+	opts = shell(`printf '%s' "$NETBOOTD_REQUEST"`)
+	opts.Input = manifest.ExecInputEnv
+	out, err = r.Run(context.Background(), opts, testContext())
+	if err != nil || json.Unmarshal(out, &req) != nil || req.Suffix != "host.ign" {
+		t.Errorf("got %q, %v", out, err)
+	}
+
+	// non-zero exit status
+	_, err = r.Run(context.Background(), shell("echo partial; echo failure >&2; exit 3"), testContext())
+	var exitErr *ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode != 3 || exitErr.Stderr != "failure" {
+		t.Errorf("got error %v", err)
+	}
+	// of which stderr is kept only in part
+	_, err = r.Run(context.Background(), shell("head -c 100000 /dev/zero | tr '\\0' x >&2; exit 1"), testContext())
+	if !errors.As(err, &exitErr) || len(exitErr.Stderr) != maxStderr {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestRunNotAllowed(t *testing.T) {
+	r := NewRunner(Config{Commands: []string{"/bin/sh", "relative"}})
+	for _, command := range []string{"/bin/echo", "sh", "relative", "/bin/../bin/echo"} {
+		opts := manifest.ExecOptions{Command: []string{command}}
+		if _, err := r.Run(context.Background(), opts, testContext()); !errors.Is(err, ErrNotAllowed) {
+			t.Errorf("running %s: %v", command, err)
+		}
+	}
+	opts := manifest.ExecOptions{Command: []string{"/bin/./sh", "-c", "printf ok"}}
+	if out, err := r.Run(context.Background(), opts, testContext()); err != nil || string(out) != "ok" {
+		t.Errorf("got %q, %v", out, err)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	r := NewRunner(Config{Commands: []string{"/bin/sh"}})
+	for _, script := range []string{
+		"sleep 10",
+		// a descendant holding on to the output
+		"sleep 10 & sleep 10",
+	} {
+		opts := shell(script)
+		opts.Timeout = 100 * time.Millisecond
+		start := time.Now()
+		_, err := r.Run(context.Background(), opts, testContext())
+		if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+			t.Errorf("%s: got error %v", script, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s: took %s", script, d)
+		}
+	}
+}
+
+func TestRunMaxOutput(t *testing.T) {
+	r := NewRunner(Config{Commands: []string{"/bin/sh"}})
+	for _, script := range []string{"head -c 1001 /dev/zero", "yes"} {
+		opts := shell(script)
+		opts.MaxOutput = 1000
+		if out, err := r.Run(context.Background(), opts, testContext()); err == nil || !strings.Contains(err.Error(), "output exceeds 1000 bytes") || out != nil {
+			t.Errorf("%s: got %d bytes, %v", script, len(out), err)
+		}
+	}
+	opts := shell("head -c 1000 /dev/zero")
+	opts.MaxOutput = 1000
+	if out, err := r.Run(context.Background(), opts, testContext()); err != nil || len(out) != 1000 {
+		t.Errorf("got %d bytes, %v", len(out), err)
+	}
+}
+
+func TestRunBusy(t *testing.T) {
+	r := NewRunner(Config{Concurrency: 1, Commands: []string{"/bin/sh"}})
+	release := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		opts := shell("sleep 10")
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-release
+			cancel()
+		}()
+		_, err := r.Run(ctx, opts, testContext())
+		done <- err
+	}()
+	for len(r.slots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// waits for a slot until its timeout
+	opts := shell("printf ok")
+	opts.Timeout = 100 * time.Millisecond
+	if _, err := r.Run(context.Background(), opts, testContext()); !errors.Is(err, ErrBusy) {
+		t.Errorf("got error %v, want ErrBusy", err)
+	}
+
+	close(release)
+	<-done
+	if out, err := r.Run(context.Background(), opts, testContext()); err != nil || string(out) != "ok" {
+		t.Errorf("got %q, %v after slot was freed", out, err)
+	}
+}
@@ -0,0 +1,142 @@
+package render
+
+import (
+	"net"
+	"testing"
+
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/store"
+	"github.com/DSpeichert/netbootd/templates"
+)
+
+func TestBootConfigs(t *testing.T) {
+	s, err := store.NewStore(store.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.GlobalHints.HttpPort = 8080
+	library, err := templates.NewLibrary(templates.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRenderer(s, library)
+
+	tests := []struct {
+		name     string
+		manifest string
+		// rendered configurations, by path
+		want map[string]string
+	}{
+		{"single entry", `id: host
+hostname: node1
+ipv4: 192.0.2.10/24
+ipxe: true
+boot:
+  kernel: /ubuntu/vmlinuz
+  initrds: [/ubuntu/initrd.img, http://mirror.example.com/firmware.cpio]
+  cmdline: ip=dhcp url={{ .HttpBaseUrl }}/ubuntu.iso autoinstall "ds=nocloud;s={{ .HttpBaseUrl }}/nocloud/"
+`, map[string]string{
+			manifest.BootIPXEPath: `#!ipxe
+kernel http://192.0.2.1:8080/ubuntu/vmlinuz initrd=initrd.img initrd=firmware.cpio ip=dhcp url=http://192.0.2.1:8080/ubuntu.iso autoinstall "ds=nocloud;s=http://192.0.2.1:8080/nocloud/"
+initrd http://192.0.2.1:8080/ubuntu/initrd.img
+initrd http://mirror.example.com/firmware.cpio
+boot
+`,
+			manifest.BootGRUBPath: `set default=0
+set timeout=0
+
+menuentry 'node1' {
+  linux /ubuntu/vmlinuz ip=dhcp url=http://192.0.2.1:8080/ubuntu.iso autoinstall 'ds=nocloud;s=http://192.0.2.1:8080/nocloud/'
+  initrd /ubuntu/initrd.img (http,mirror.example.com)/firmware.cpio
+}
+`,
+			manifest.BootPXELINUXPath: `DEFAULT entry0
+PROMPT 0
+
+LABEL entry0
+  MENU LABEL node1
+  KERNEL /ubuntu/vmlinuz
+  INITRD /ubuntu/initrd.img,http://mirror.example.com/firmware.cpio
+  APPEND ip=dhcp url=http://192.0.2.1:8080/ubuntu.iso autoinstall "ds=nocloud;s=http://192.0.2.1:8080/nocloud/"
+`,
+		}},
+		{"menu", `id: host
+hostname: node1
+ipv4: 192.0.2.10/24
+ipxe: true
+boot:
+  entries:
+    - label: Install Ubuntu
+      kernel: /ubuntu/vmlinuz
+      initrds: [/ubuntu/initrd.img]
+      cmdline: autoinstall quiet
+    - label: Rescue "shell"
+      kernel: http://mirror.example.com/rescue/vmlinuz
+      cmdline: rescue
+  default: Rescue "shell"
+  timeout: 10s
+`, map[string]string{
+			manifest.BootIPXEPath: `#!ipxe
+menu node1
+item entry0 Install Ubuntu
+item entry1 Rescue "shell"
+choose --default entry1 --timeout 10000 entry || set entry entry1
+goto ${entry}
+
+:entry0
+kernel http://192.0.2.1:8080/ubuntu/vmlinuz initrd=initrd.img autoinstall quiet
+initrd http://192.0.2.1:8080/ubuntu/initrd.img
+boot
+
+:entry1
+kernel http://mirror.example.com/rescue/vmlinuz rescue
+boot
+`,
+			manifest.BootGRUBPath: `set default=1
+set timeout=10
+
+menuentry 'Install Ubuntu' {
+  linux /ubuntu/vmlinuz autoinstall quiet
+  initrd /ubuntu/initrd.img
+}
+
+menuentry 'Rescue "shell"' {
+  linux (http,mirror.example.com)/rescue/vmlinuz rescue
+}
+`,
+			manifest.BootPXELINUXPath: `DEFAULT entry1
+PROMPT 1
+TIMEOUT 100
+SAY entry0: Install Ubuntu
+SAY entry1: Rescue "shell"
+
+LABEL entry0
+  MENU LABEL Install Ubuntu
+  KERNEL /ubuntu/vmlinuz
+  INITRD /ubuntu/initrd.img
+  APPEND autoinstall quiet
+
+LABEL entry1
+  MENU LABEL Rescue "shell"
+  KERNEL http://mirror.example.com/rescue/vmlinuz
+  APPEND rescue
+`,
+		}},
+	}
+	for _, tt := range tests {
+		m, err := manifest.ManifestFromYaml([]byte(tt.manifest), "")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		for p, want := range tt.want {
+			mount, err := m.GetMount(p)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			got, err := r.Content(mount, r.Context(&m, mount, "tftp", p, net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 10)))
+			if err != nil || string(got) != want {
+				t.Errorf("%s: %s = %v\n%s\nwant\n%s", tt.name, p, err, got, want)
+			}
+		}
+	}
+}
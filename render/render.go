@@ -0,0 +1,195 @@
+// Package render renders templates of mounts (content, proxy headers, redirects and initrd overlays)
+// for HTTP and TFTP alike. Parsed templates are cached per manifest revision.
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/DSpeichert/netbootd/initrd"
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/store"
+	"github.com/DSpeichert/netbootd/templates"
+)
+
+// parsed holds templates parsed for one revision of a manifest, by name.
+type parsed struct {
+	revision        uint64
+	libraryRevision uint64
+	templates       map[string]*templates.Template
+}
+
+type Renderer struct {
+	store   *store.Store
+	library *templates.Library
+
+	mutex sync.Mutex
+	// by manifest ID
+	parsed map[string]*parsed
+}
+
+func NewRenderer(store *store.Store, library *templates.Library) *Renderer {
+	return &Renderer{
+		store:   store,
+		library: library,
+		parsed:  make(map[string]*parsed),
+	}
+}
+
+// Context returns the template context of a request of path on mount of m by client raddr, received on laddr.
+// Base URLs point to laddr, except HttpBaseUrl if an advertised one is configured (GlobalHints.HttpBaseUrl).
+func (r *Renderer) Context(m *manifest.Manifest, mount manifest.Mount, protocol, path string, laddr, raddr net.IP) manifest.ContentContext {
+	httpBaseUrl := &url.URL{
+		Scheme: "http",
+		Host:   net.JoinHostPort(laddr.String(), strconv.Itoa(r.store.GlobalHints.HttpPort)),
+	}
+	if advertised := r.store.GlobalHints.HttpBaseUrl; advertised != nil {
+		u := *advertised
+		httpBaseUrl = &u
+	}
+	ctx := manifest.ContentContext{
+		LocalIP:     laddr,
+		RemoteIP:    raddr,
+		HttpBaseUrl: httpBaseUrl,
+		ApiBaseUrl: &url.URL{
+			Scheme: "http",
+			Host:   net.JoinHostPort(laddr.String(), strconv.Itoa(r.store.GlobalHints.ApiPort)),
+		},
+		SyslogHost: net.JoinHostPort(laddr.String(), strconv.Itoa(r.store.GlobalHints.SyslogPort)),
+		Manifest:   m,
+		Protocol:   protocol,
+		Path:       path,
+	}
+	if mount.PathIsPrefix {
+		ctx.Suffix = mount.MemberPath(path)
+	}
+	if m != nil {
+		ctx.DHCP = r.store.DHCPFacts(m.ID)
+	}
+	return ctx
+}
+
+// HTTPContext returns the template context of HTTP request req, see Context.
+// Unless an advertised one is configured, HttpBaseUrl points to the host the client requested,
+// which reaches netbootd through NAT and reverse proxies as well.
+func (r *Renderer) HTTPContext(req *http.Request, m *manifest.Manifest, mount manifest.Mount, laddr, raddr net.IP) manifest.ContentContext {
+	ctx := r.Context(m, mount, "http", req.URL.Path, laddr, raddr)
+	if r.store.GlobalHints.HttpBaseUrl == nil && req.Host != "" {
+		ctx.HttpBaseUrl = &url.URL{Scheme: "http", Host: req.Host}
+	}
+	ctx.Query = req.URL.Query()
+	ctx.UserAgent = req.UserAgent()
+	return ctx
+}
+
+// Content renders Content of mount.
+func (r *Renderer) Content(mount manifest.Mount, ctx manifest.ContentContext) ([]byte, error) {
+	return r.render(ctx, "content "+mount.Path, mount.Content)
+}
+
+// Headers renders ProxyHeaders of mount.
+func (r *Renderer) Headers(mount manifest.Mount, ctx manifest.ContentContext) (http.Header, error) {
+	header := http.Header{}
+	for name, value := range mount.ProxyHeaders {
+		rendered, err := r.render(ctx, "header "+mount.Path+" "+name, value)
+		if err != nil {
+			return nil, fmt.Errorf("header %s: %w", name, err)
+		}
+		header.Set(name, string(rendered))
+	}
+	return header, nil
+}
+
+// Redirect renders Redirect of mount and returns the target URL, without the suffix to Path.
+func (r *Renderer) Redirect(mount manifest.Mount, ctx manifest.ContentContext) (string, error) {
+	target, err := r.render(ctx, "redirect "+mount.Path, mount.Redirect)
+	if err != nil {
+		return "", fmt.Errorf("redirect: %w", err)
+	}
+	return strings.TrimSpace(string(target)), nil
+}
+
+// InitrdOverlay renders files of InitrdOverlay of mount and returns them as a cpio archive.
+func (r *Renderer) InitrdOverlay(mount manifest.Mount, ctx manifest.ContentContext) ([]byte, error) {
+	files := make([]initrd.File, 0, len(mount.InitrdOverlay))
+	for _, f := range mount.InitrdOverlay {
+		data, err := r.render(ctx, "initrdOverlay "+mount.Path+" "+f.Path, f.Content)
+		if err != nil {
+			return nil, fmt.Errorf("initrd overlay file %s: %w", f.Path, err)
+		}
+		mode, err := initrd.ParseMode(f.Mode, f.Directory)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, initrd.File{Path: f.Path, Mode: mode, Dir: f.Directory, Data: data})
+	}
+	return initrd.Archive(files), nil
+}
+
+// render executes text with ctx. Templates of the manifest in ctx are parsed once for each of its revisions,
+// name identifies text within the manifest.
+func (r *Renderer) render(ctx manifest.ContentContext, name, text string) ([]byte, error) {
+	tmpl, err := r.template(ctx.Manifest, name, text)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse template: %w", err)
+	}
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, ctx); err != nil {
+		return nil, fmt.Errorf("cannot execute template: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (r *Renderer) template(m *manifest.Manifest, name, text string) (*templates.Template, error) {
+	// manifests not (or no longer) in the store are not cached, as nothing would evict them
+	if m == nil || r.store.FindServed(m.ID) != m {
+		return r.library.Parse(name, text)
+	}
+
+	libraryRevision := r.library.Revision()
+	r.mutex.Lock()
+	p, ok := r.parsed[m.ID]
+	if !ok || p.revision != m.Revision || p.libraryRevision != libraryRevision {
+		if !ok {
+			r.evict()
+		}
+		p = &parsed{
+			revision:        m.Revision,
+			libraryRevision: libraryRevision,
+			templates:       make(map[string]*templates.Template),
+		}
+		r.parsed[m.ID] = p
+	}
+	tmpl, ok := p.templates[name]
+	r.mutex.Unlock()
+	if ok {
+		return tmpl, nil
+	}
+
+	// parsed outside the lock, concurrent requests may parse the same template twice
+	tmpl, err := r.library.Parse(name, text)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	if r.parsed[m.ID] == p {
+		p.templates[name] = tmpl
+	}
+	r.mutex.Unlock()
+	return tmpl, nil
+}
+
+// evict drops templates of manifests removed from the store. Called with mutex held.
+func (r *Renderer) evict() {
+	for id := range r.parsed {
+		if r.store.Find(id) == nil {
+			delete(r.parsed, id)
+		}
+	}
+}
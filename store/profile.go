@@ -0,0 +1,158 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+// ErrNotFound is returned for operations on manifests not in the store.
+var ErrNotFound = errors.New("manifest not found")
+
+// bootAttemptWindow is the time after a host starts booting with its next boot profile during which
+// it may start over (e.g. trying another NIC or protocol) and still get that profile.
+const bootAttemptWindow = time.Minute
+
+type nextBoot struct {
+	profile string
+	// time the host started booting with profile, zero until then
+	started time.Time
+}
+
+// serve applies the active or next boot profile to m and makes the result the manifest served to the host.
+// Called with mutex held.
+func (s *Store) serve(m *manifest.Manifest) {
+	profile := m.ActiveProfile
+	if nb := s.nextBoot[m.ID]; nb != nil {
+		profile = nb.profile
+	}
+	served, err := m.WithProfile(profile)
+	if err != nil {
+		// profiles are validated with the manifest, the next boot profile when set
+		s.logger.Error().
+			Err(err).
+			Str("manifest", m.ID).
+			Msg("cannot apply profile, serving manifest without it")
+		served = *m
+	}
+	s.revision++
+	served.Revision = s.revision
+
+	s.served[m.ID] = &served
+	s.ip[string(served.IPv4.IP.To16())] = &served
+	for _, mac := range served.MAC {
+		s.mac[mac.String()] = &served
+	}
+}
+
+// SetActiveProfile selects profile of manifest id, persistently. An empty profile selects none.
+func (s *Store) SetActiveProfile(id, profile string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, ok := s.manifests[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if _, ok := m.Profiles[profile]; profile != "" && !ok {
+		return fmt.Errorf("profile not found: %s", profile)
+	}
+
+	// manifests are replaced rather than modified, they may be in use
+	updated := *m
+	updated.ActiveProfile = profile
+	s.revision++
+	updated.Revision = s.revision
+	s.manifests[id] = &updated
+	s.serve(&updated)
+
+	if s.config.PersistenceDirectory != "" {
+		return s.putPersistentManifest(updated)
+	}
+	return nil
+}
+
+// SetSuspended sets Suspended of manifest id.
+func (s *Store) SetSuspended(id string, suspended bool) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, ok := s.manifests[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	updated := *m
+	updated.Suspended = suspended
+	s.revision++
+	updated.Revision = s.revision
+	s.manifests[id] = &updated
+	s.serve(&updated)
+
+	if s.config.PersistenceDirectory != "" {
+		return s.putPersistentManifest(updated)
+	}
+	return nil
+}
+
+// SetNextBootProfile selects profile of manifest id for its next boot only, see StartBoot.
+// An empty profile cancels a previous selection.
+func (s *Store) SetNextBootProfile(id, profile string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	m, ok := s.manifests[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if profile == "" {
+		delete(s.nextBoot, id)
+	} else if _, ok := m.Profiles[profile]; !ok {
+		return fmt.Errorf("profile not found: %s", profile)
+	} else {
+		s.nextBoot[id] = &nextBoot{profile: profile}
+	}
+	s.serve(m)
+	return nil
+}
+
+// NextBootProfile returns the profile selected for the next boot of manifest id, empty if none.
+func (s *Store) NextBootProfile(id string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if nb := s.nextBoot[id]; nb != nil {
+		return nb.profile
+	}
+	return ""
+}
+
+// StartBoot is called when the firmware of the host of manifest id starts booting from the network.
+// The first call after SetNextBootProfile starts the boot with the next boot profile, which is served
+// until the host starts booting again (after bootAttemptWindow), e.g. when rebooting after an installation.
+// It returns the manifest served from then on, nil if id is not in the store.
+func (s *Store) StartBoot(id string) *manifest.Manifest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nb := s.nextBoot[id]
+	switch {
+	case nb == nil:
+	case nb.started.IsZero():
+		nb.started = time.Now()
+		s.logger.Info().
+			Str("manifest", id).
+			Str("profile", nb.profile).
+			Msg("booting with next boot profile")
+	case time.Since(nb.started) > bootAttemptWindow:
+		delete(s.nextBoot, id)
+		s.serve(s.manifests[id])
+		s.logger.Info().
+			Str("manifest", id).
+			Str("profile", nb.profile).
+			Msg("next boot profile used, reverting to active profile")
+	}
+	return s.served[id]
+}
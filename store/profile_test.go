@@ -0,0 +1,140 @@
+package store
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	s, err := NewStore(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := manifest.ManifestFromYaml([]byte(`
+id: host
+ipv4: 192.0.2.10/24
+mac:
+  - 00:11:22:33:44:55
+bootFilename: local.efi
+profiles:
+  install:
+    bootFilename: install.efi
+  rescue:
+    bootFilename: rescue.efi
+`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// checkServed checks the boot filename served to the host, as found by ID, MAC and IP.
+func checkServed(t *testing.T, s *Store, served *manifest.Manifest, want string) {
+	t.Helper()
+	mac, _ := net.ParseMAC("00:11:22:33:44:55")
+	for _, m := range []*manifest.Manifest{served, s.FindServed("host"), s.FindByMAC(mac), s.FindByIP(net.ParseIP("192.0.2.10"))} {
+		if m == nil || m.BootFilename != want {
+			t.Fatalf("served %+v, want boot filename %s", m, want)
+		}
+	}
+}
+
+func TestStartBoot(t *testing.T) {
+	s := newTestStore(t)
+	checkServed(t, s, s.StartBoot("host"), "local.efi")
+
+	if err := s.SetNextBootProfile("host", "install"); err != nil {
+		t.Fatal(err)
+	}
+	// served right away, e.g. to the host booting already
+	checkServed(t, s, s.FindServed("host"), "install.efi")
+	revision := s.FindServed("host").Revision
+
+	m := s.StartBoot("host")
+	if m.Revision != revision {
+		t.Errorf("revision changed from %d to %d when starting the boot", revision, m.Revision)
+	}
+	checkServed(t, s, m, "install.efi")
+	started := s.nextBoot["host"].started
+	if started.IsZero() {
+		t.Fatal("boot not started")
+	}
+
+	// starting over within the window, e.g. with another NIC or protocol
+	checkServed(t, s, s.StartBoot("host"), "install.efi")
+	if s.nextBoot["host"].started != started || s.NextBootProfile("host") != "install" {
+		t.Errorf("boot started again within the window")
+	}
+	if s.FindServed("host") != m {
+		t.Errorf("served manifest changed within the window")
+	}
+
+	// rebooting after the installation
+	s.nextBoot["host"].started = time.Now().Add(-bootAttemptWindow - time.Second)
+	m = s.StartBoot("host")
+	checkServed(t, s, m, "local.efi")
+	if s.NextBootProfile("host") != "" {
+		t.Errorf("next boot profile %s left after boot", s.NextBootProfile("host"))
+	}
+	if m.Revision <= revision {
+		t.Errorf("revision %d not increased from %d", m.Revision, revision)
+	}
+	checkServed(t, s, s.StartBoot("host"), "local.efi")
+}
+
+func TestStartBootActiveProfile(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.SetActiveProfile("host", "rescue"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetNextBootProfile("host", "install"); err != nil {
+		t.Fatal(err)
+	}
+	checkServed(t, s, s.StartBoot("host"), "install.efi")
+	s.nextBoot["host"].started = time.Now().Add(-bootAttemptWindow - time.Second)
+	// reverts to the active profile, not the manifest without profile
+	checkServed(t, s, s.StartBoot("host"), "rescue.efi")
+}
+
+func TestSetNextBootProfile(t *testing.T) {
+	s := newTestStore(t)
+	if err := s.SetNextBootProfile("other", "install"); err != ErrNotFound {
+		t.Errorf("next boot profile of missing manifest: %v", err)
+	}
+	if err := s.SetNextBootProfile("host", "missing"); err == nil {
+		t.Error("missing next boot profile set")
+	}
+	if s.StartBoot("other") != nil {
+		t.Error("boot of missing manifest started")
+	}
+
+	// cancelled
+	if err := s.SetNextBootProfile("host", "install"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetNextBootProfile("host", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkServed(t, s, s.StartBoot("host"), "local.efi")
+
+	// dropped when the manifest is put without the profile
+	if err := s.SetNextBootProfile("host", "install"); err != nil {
+		t.Fatal(err)
+	}
+	m := *s.Find("host")
+	m.Profiles = map[string]manifest.Profile{"rescue": m.Profiles["rescue"]}
+	if err := s.PutManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	if s.NextBootProfile("host") != "" {
+		t.Errorf("next boot profile %s left", s.NextBootProfile("host"))
+	}
+	checkServed(t, s, s.StartBoot("host"), "local.efi")
+}
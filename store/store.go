@@ -3,6 +3,7 @@ package store
 import (
 	"errors"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -20,25 +21,39 @@ type Config struct {
 type Store struct {
 	config Config
 
-	// mapping Manifest ID to Manifest
+	// mapping Manifest ID to Manifest, as put
 	manifests map[string]*manifest.Manifest
 
-	// mapping IP Address to Manifest
+	// mapping Manifest ID to Manifest as served to the host, with its profile applied
+	served map[string]*manifest.Manifest
+
+	// mapping IP Address to served Manifest
 	// IP is normalized string(ip.To16)
 	ip map[string]*manifest.Manifest
 
-	// mapping Mac Address to Manifest
+	// mapping Mac Address to served Manifest
 	mac map[string]*manifest.Manifest
 
+	// mapping Manifest ID to the profile served for its next boot only
+	nextBoot map[string]*nextBoot
+
 	logger zerolog.Logger
 
 	mutex sync.RWMutex
 
+	// last Revision assigned to a manifest
+	revision uint64
+
+	// mapping Manifest ID to facts of the last DHCP request answered for it
+	dhcp map[string]*manifest.DHCPFacts
+
 	// sort of global config
 	GlobalHints struct {
 		HttpPort   int
 		ApiPort    int
 		SyslogPort int
+		// URL of the HTTP server as reachable by clients (e.g. through NAT or a reverse proxy), nil if not set
+		HttpBaseUrl *url.URL
 	}
 }
 
@@ -46,8 +61,11 @@ func NewStore(cfg Config) (*Store, error) {
 	store := Store{
 		config:    cfg,
 		manifests: make(map[string]*manifest.Manifest),
+		served:    make(map[string]*manifest.Manifest),
 		ip:        make(map[string]*manifest.Manifest),
 		mac:       make(map[string]*manifest.Manifest),
+		dhcp:      make(map[string]*manifest.DHCPFacts),
+		nextBoot:  make(map[string]*nextBoot),
 		logger:    log.With().Str("module", "store").Logger(),
 	}
 
@@ -106,11 +124,15 @@ func (s *Store) PutManifest(m manifest.Manifest) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	s.revision++
+	m.Revision = s.revision
 	s.manifests[m.ID] = &m
-	s.ip[string(m.IPv4.IP.To16())] = &m
-	for _, mac := range m.MAC {
-		s.mac[mac.String()] = &m
+	if nb := s.nextBoot[m.ID]; nb != nil {
+		if _, ok := m.Profiles[nb.profile]; !ok {
+			delete(s.nextBoot, m.ID)
+		}
 	}
+	s.serve(&m)
 
 	if s.config.PersistenceDirectory != "" {
 		return s.putPersistentManifest(m)
@@ -131,6 +153,9 @@ func (s *Store) ForgetManifest(id string) error {
 	defer s.mutex.Unlock()
 
 	delete(s.manifests, m.ID)
+	delete(s.served, m.ID)
+	delete(s.dhcp, m.ID)
+	delete(s.nextBoot, m.ID)
 	delete(s.ip, string(m.IPv4.IP.To16()))
 	for _, mac := range m.MAC {
 		delete(s.mac, mac.String())
@@ -143,6 +168,7 @@ func (s *Store) ForgetManifest(id string) error {
 	return nil
 }
 
+// Find returns the manifest id as put.
 func (s *Store) Find(id string) *manifest.Manifest {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
@@ -150,6 +176,15 @@ func (s *Store) Find(id string) *manifest.Manifest {
 	return s.manifests[id]
 }
 
+// FindServed returns the manifest id as served to the host, with its active or next boot profile applied.
+// Like FindByIP and FindByMAC, it returns the same manifest until the manifest or its profile changes.
+func (s *Store) FindServed(id string) *manifest.Manifest {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.served[id]
+}
+
 func (s *Store) FindByIP(ip net.IP) *manifest.Manifest {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
@@ -164,9 +199,30 @@ func (s *Store) FindByMAC(mac net.HardwareAddr) *manifest.Manifest {
 	return s.mac[mac.String()]
 }
 
+// RecordDHCP stores facts of a DHCP request answered for manifest id.
+func (s *Store) RecordDHCP(id string, facts manifest.DHCPFacts) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.dhcp[id] = &facts
+}
+
+// DHCPFacts returns facts of the last DHCP request answered for manifest id, nil if none.
+func (s *Store) DHCPFacts(id string) *manifest.DHCPFacts {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.dhcp[id]
+}
+
+// GetAll returns a copy of the mapping of Manifest ID to Manifest (as put), safe to iterate while manifests change.
 func (s *Store) GetAll() map[string]*manifest.Manifest {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
 
-	return s.manifests
+	manifests := make(map[string]*manifest.Manifest, len(s.manifests))
+	for id, m := range s.manifests {
+		manifests[id] = m
+	}
+	return manifests
 }
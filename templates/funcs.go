@@ -0,0 +1,558 @@
+package templates
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/netconfig"
+)
+
+// netbootdFunctions are functions for provisioning tasks sprig doesn't cover, see README.md.
+func netbootdFunctions() template.FuncMap {
+	return template.FuncMap{
+		"netmaskToPrefix": netmaskToPrefix,
+		"prefixToNetmask": prefixToNetmask,
+		"cidrIP":          cidrIP,
+		"cidrPrefix":      cidrPrefix,
+		"cidrNetmask":     cidrNetmask,
+		"cidrNetwork":     cidrNetwork,
+		"cidrBroadcast":   cidrBroadcast,
+		"cidrHost":        cidrHost,
+		"cidrSubnet":      cidrSubnet,
+		"cidrContains":    cidrContains,
+
+		"macColon":    func(v any) (string, error) { return formatMAC(v, ":", "") },
+		"macDash":     func(v any) (string, error) { return formatMAC(v, "-", "") },
+		"macPlain":    func(v any) (string, error) { return formatMAC(v, "", "") },
+		"macPxelinux": func(v any) (string, error) { return formatMAC(v, "-", "01-") },
+
+		"sha512crypt": sha512crypt,
+
+		"ipxeEscape": ipxeEscape,
+		"shellQuote": shellQuote,
+		"grubArgs":   grubArgs,
+		"yamlQuote":  yamlQuote,
+
+		"gzipB64enc": gzipB64enc,
+
+		"netplan":          networkFunction(netconfig.Interface.Netplan),
+		"cloudInitNetwork": networkFunction(netconfig.Interface.CloudInit),
+		"nmKeyfile":        networkFunction(netconfig.Interface.NMKeyfile),
+		"ifcfg":            networkFunction(netconfig.Interface.Ifcfg),
+
+		"nocloudDatasource": nocloudDatasource,
+	}
+}
+
+// toPrefix converts v (a CIDR string, which may use a dotted netmask, manifest.IPWithNet or net.IPNet)
+// to a prefix, keeping its address.
+func toPrefix(v any) (netip.Prefix, error) {
+	var ip net.IP
+	var mask net.IPMask
+	switch v := v.(type) {
+	case string:
+		addr, length, ok := strings.Cut(v, "/")
+		if !ok {
+			return netip.Prefix{}, fmt.Errorf("%q is not in CIDR notation", v)
+		}
+		if strings.Contains(length, ".") {
+			bits, err := netmaskToPrefix(length)
+			if err != nil {
+				return netip.Prefix{}, err
+			}
+			v = addr + "/" + strconv.Itoa(bits)
+		}
+		p, err := netip.ParsePrefix(v)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()), nil
+	case manifest.IPWithNet:
+		ip, mask = v.IP, v.Net.Mask
+	case *manifest.IPWithNet:
+		ip, mask = v.IP, v.Net.Mask
+	case net.IPNet:
+		ip, mask = v.IP, v.Mask
+	case *net.IPNet:
+		ip, mask = v.IP, v.Mask
+	default:
+		return netip.Prefix{}, fmt.Errorf("cannot use %T as CIDR", v)
+	}
+
+	addr, err := toAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return netip.Prefix{}, fmt.Errorf("%s is not a valid netmask", mask)
+	}
+	if addr.Is4() && bits == 8*net.IPv6len {
+		ones -= 8 * (net.IPv6len - net.IPv4len)
+	}
+	return netip.PrefixFrom(addr, ones), nil
+}
+
+// toAddr converts v (a string, net.IP or the address of manifest.IPWithNet) to an address.
+func toAddr(v any) (netip.Addr, error) {
+	switch v := v.(type) {
+	case string:
+		addr, err := netip.ParseAddr(v)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		return addr.Unmap(), nil
+	case net.IP:
+		addr, ok := netip.AddrFromSlice(v)
+		if !ok {
+			return netip.Addr{}, fmt.Errorf("%q is not a valid IP address", v)
+		}
+		return addr.Unmap(), nil
+	case manifest.IPWithNet:
+		return toAddr(v.IP)
+	case *manifest.IPWithNet:
+		return toAddr(v.IP)
+	default:
+		return netip.Addr{}, fmt.Errorf("cannot use %T as IP address", v)
+	}
+}
+
+// netmaskToPrefix returns the prefix length of a netmask, e.g. 24 for 255.255.255.0.
+func netmaskToPrefix(netmask string) (int, error) {
+	ip := net.ParseIP(netmask)
+	if ip == nil {
+		return 0, fmt.Errorf("%q is not a valid netmask", netmask)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	ones, bits := net.IPMask(ip).Size()
+	if bits == 0 {
+		return 0, fmt.Errorf("%q is not a valid netmask", netmask)
+	}
+	return ones, nil
+}
+
+// prefixToNetmask returns the IPv4 netmask of a prefix length, e.g. 255.255.255.0 for 24.
+func prefixToNetmask(prefix int) (string, error) {
+	if prefix < 0 || prefix > 32 {
+		return "", fmt.Errorf("%d is not a valid IPv4 prefix length", prefix)
+	}
+	return net.IP(net.CIDRMask(prefix, 32)).String(), nil
+}
+
+func cidrIP(cidr any) (string, error) {
+	p, err := toPrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	return p.Addr().String(), nil
+}
+
+func cidrPrefix(cidr any) (int, error) {
+	p, err := toPrefix(cidr)
+	if err != nil {
+		return 0, err
+	}
+	return p.Bits(), nil
+}
+
+func cidrNetmask(cidr any) (string, error) {
+	p, err := toPrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	return net.IP(net.CIDRMask(p.Bits(), p.Addr().BitLen())).String(), nil
+}
+
+func cidrNetwork(cidr any) (string, error) {
+	return cidrHost(cidr, 0)
+}
+
+func cidrBroadcast(cidr any) (string, error) {
+	return cidrHost(cidr, -1)
+}
+
+// cidrHost returns address number n of the network of cidr, counting from its last address when n is negative.
+func cidrHost(cidr any, n int) (string, error) {
+	p, err := toPrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	size := new(big.Int).Lsh(big.NewInt(1), uint(p.Addr().BitLen()-p.Bits()))
+	host := big.NewInt(int64(n))
+	if n < 0 {
+		host.Add(host, size)
+	}
+	if host.Sign() < 0 || host.Cmp(size) >= 0 {
+		return "", fmt.Errorf("cidrHost: %d is out of range for %s", n, p.Masked())
+	}
+	return addrAdd(p.Masked().Addr(), host).String(), nil
+}
+
+// cidrSubnet returns subnet number num of cidr with its prefix extended by newbits.
+func cidrSubnet(cidr any, newbits, num int) (string, error) {
+	p, err := toPrefix(cidr)
+	if err != nil {
+		return "", err
+	}
+	bits := p.Bits() + newbits
+	if newbits < 0 || bits > p.Addr().BitLen() {
+		return "", fmt.Errorf("cidrSubnet: cannot extend %s by %d bits", p.Masked(), newbits)
+	}
+	if num < 0 || big.NewInt(int64(num)).Cmp(new(big.Int).Lsh(big.NewInt(1), uint(newbits))) >= 0 {
+		return "", fmt.Errorf("cidrSubnet: %d is out of range for %d new bits", num, newbits)
+	}
+	offset := new(big.Int).Lsh(big.NewInt(int64(num)), uint(p.Addr().BitLen()-bits))
+	return netip.PrefixFrom(addrAdd(p.Masked().Addr(), offset), bits).String(), nil
+}
+
+// cidrContains reports whether ip is within the network of cidr.
+func cidrContains(cidr any, ip any) (bool, error) {
+	p, err := toPrefix(cidr)
+	if err != nil {
+		return false, err
+	}
+	addr, err := toAddr(ip)
+	if err != nil {
+		return false, err
+	}
+	return p.Masked().Contains(addr), nil
+}
+
+func addrAdd(addr netip.Addr, n *big.Int) netip.Addr {
+	sum := new(big.Int).Add(new(big.Int).SetBytes(addr.AsSlice()), n)
+	result, _ := netip.AddrFromSlice(sum.FillBytes(make([]byte, addr.BitLen()/8)))
+	return result
+}
+
+// formatMAC formats v (a string in any notation net.ParseMAC accepts or without separators,
+// net.HardwareAddr or manifest.HardwareAddr) as lowercase hex bytes joined by sep, after prefix.
+func formatMAC(v any, sep, prefix string) (string, error) {
+	var mac []byte
+	switch v := v.(type) {
+	case string:
+		var err error
+		mac, err = net.ParseMAC(v)
+		if err != nil {
+			// e.g. 525400123456
+			if b, hexErr := hex.DecodeString(v); hexErr == nil && len(b) == 6 {
+				mac, err = b, nil
+			}
+		}
+		if err != nil {
+			return "", err
+		}
+	case net.HardwareAddr:
+		mac = v
+	case manifest.HardwareAddr:
+		mac = v
+	default:
+		return "", fmt.Errorf("cannot use %T as MAC address", v)
+	}
+	if len(mac) == 0 {
+		return "", errors.New("empty MAC address")
+	}
+
+	parts := make([]string, len(mac))
+	for i, b := range mac {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return prefix + strings.Join(parts, sep), nil
+}
+
+const (
+	// alphabet of salts and hashes of crypt(3)
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	sha512cryptPrefix      = "$6$"
+	sha512cryptRoundsKey   = "rounds="
+	sha512cryptRounds      = 5000
+	sha512cryptMinRounds   = 1000
+	sha512cryptMaxRounds   = 999999999
+	sha512cryptMaxSaltSize = 16
+
+	// rounds accepted by templates, whose executions can't be interrupted while hashing
+	sha512cryptRoundsLimit = 1000000
+)
+
+// sha512crypt hashes password with SHA-512 crypt ("$6$"), as used by /etc/shadow, preseed and kickstart.
+// The optional salt may start with "rounds=<n>$" and is truncated to 16 characters, a random one is used if omitted.
+func sha512crypt(password string, salt ...string) (string, error) {
+	var setting string
+	switch len(salt) {
+	case 0:
+		b := make([]byte, sha512cryptMaxSaltSize)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i := range b {
+			b[i] = cryptAlphabet[int(b[i])%len(cryptAlphabet)]
+		}
+		setting = string(b)
+	case 1:
+		setting = strings.TrimPrefix(salt[0], sha512cryptPrefix)
+	default:
+		return "", errors.New("sha512crypt: too many arguments")
+	}
+
+	rounds, custom := sha512cryptRounds, false
+	if rest, ok := strings.CutPrefix(setting, sha512cryptRoundsKey); ok {
+		n, s, _ := strings.Cut(rest, "$")
+		r, err := strconv.Atoi(n)
+		if err != nil {
+			return "", fmt.Errorf("sha512crypt: invalid rounds %q", n)
+		}
+		if r > sha512cryptRoundsLimit {
+			return "", fmt.Errorf("sha512crypt: rounds exceed maximum of %d", sha512cryptRoundsLimit)
+		}
+		rounds, custom, setting = min(max(r, sha512cryptMinRounds), sha512cryptMaxRounds), true, s
+	}
+	s, _, _ := strings.Cut(setting, "$")
+	if len(s) > sha512cryptMaxSaltSize {
+		s = s[:sha512cryptMaxSaltSize]
+	}
+	pw, saltBytes := []byte(password), []byte(s)
+
+	b := sha512.New()
+	b.Write(pw)
+	b.Write(saltBytes)
+	b.Write(pw)
+	digestB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(pw)
+	a.Write(saltBytes)
+	a.Write(repeatBytes(digestB, len(pw)))
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(digestB)
+		} else {
+			a.Write(pw)
+		}
+	}
+	digest := a.Sum(nil)
+
+	dp := sha512.New()
+	for range pw {
+		dp.Write(pw)
+	}
+	p := repeatBytes(dp.Sum(nil), len(pw))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(digest[0]); i++ {
+		ds.Write(saltBytes)
+	}
+	sb := repeatBytes(ds.Sum(nil), len(saltBytes))
+
+	for i := 0; i < rounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(digest)
+		}
+		if i%3 != 0 {
+			c.Write(sb)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(digest)
+		} else {
+			c.Write(p)
+		}
+		digest = c.Sum(digest[:0])
+	}
+
+	out := new(strings.Builder)
+	out.WriteString(sha512cryptPrefix)
+	if custom {
+		out.WriteString(sha512cryptRoundsKey + strconv.Itoa(rounds) + "$")
+	}
+	out.WriteString(s)
+	out.WriteByte('$')
+	encode := func(b2, b1, b0 byte, n int) {
+		w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+		for ; n > 0; n-- {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	for i := 0; i < 21; i++ {
+		// bytes are taken 21 apart, rotating which of them comes first
+		j, k, l := i, i+21, i+42
+		switch i % 3 {
+		case 1:
+			j, k, l = i+21, i+42, i
+		case 2:
+			j, k, l = i+42, i, i+21
+		}
+		encode(digest[j], digest[k], digest[l], 4)
+	}
+	encode(0, 0, digest[63], 2)
+	return out.String(), nil
+}
+
+// repeatBytes returns b repeated up to length n.
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+// ipxeEscape returns s for use as an argument in iPXE scripts. iPXE has no means of escaping ${...} settings
+// expansion or line breaks, so values containing them fail instead of altering the script.
+func ipxeEscape(s string) (string, error) {
+	if strings.Contains(s, "${") {
+		return "", fmt.Errorf("ipxeEscape: %q would be expanded by iPXE", s)
+	}
+	for _, r := range s {
+		if r < ' ' && r != '\t' || r == 0x7f {
+			return "", fmt.Errorf("ipxeEscape: %q contains control characters", s)
+		}
+	}
+	return s, nil
+}
+
+// shellQuote returns s quoted as a single word for POSIX shells.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// grubArgs returns kernel command line s as arguments of GRUB's linux command, each quoted if needed.
+// GRUB passes each argument containing spaces to the kernel in double quotes, so parameters like
+// foo="a b" are split by the rules of the kernel and have their double quotes removed first.
+func grubArgs(s string) string {
+	var args []string
+	arg := new(strings.Builder)
+	inArg, inQuote := false, false
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inArg, inQuote = true, !inQuote
+		case unicode.IsSpace(r) && !inQuote:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	for i, a := range args {
+		if a == "" || strings.IndexFunc(a, func(r rune) bool {
+			return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("_-+=,./:@%", r))
+		}) >= 0 {
+			args[i] = shellQuote(a)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// yamlQuote returns s as a double-quoted YAML scalar.
+func yamlQuote(s string) (string, error) {
+	// JSON strings are valid double-quoted YAML scalars
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+// gzipB64enc returns s compressed with gzip and encoded with base64, e.g. for cloud-init write_files
+// with "encoding: gz+b64".
+func gzipB64enc(s string) (string, error) {
+	buf := new(bytes.Buffer)
+	w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write([]byte(s)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// networkFunction returns a function generating network configuration with format for the interface
+// of a manifest (given directly or as the template context, see networkInterface).
+func networkFunction(format func(netconfig.Interface) string) func(any) (string, error) {
+	return func(v any) (string, error) {
+		i, err := networkInterface(v)
+		if err != nil {
+			return "", err
+		}
+		return format(i), nil
+	}
+}
+
+// networkInterface returns the interface of a manifest given as v, or of the manifest of the template context v.
+// With the context, the interface the client last booted from is configured if it belongs to the manifest.
+func networkInterface(v any) (netconfig.Interface, error) {
+	switch v := v.(type) {
+	case *manifest.Manifest:
+		return netconfig.New(v, nil)
+	case manifest.ContentContext:
+		return networkInterface(&v)
+	case *manifest.ContentContext:
+		var mac net.HardwareAddr
+		if v.DHCP != nil && v.Manifest != nil {
+			for _, m := range v.Manifest.MAC {
+				if bytes.Equal(m, v.DHCP.MAC) {
+					mac = v.DHCP.MAC
+				}
+			}
+		}
+		return netconfig.New(v.Manifest, mac)
+	default:
+		return netconfig.Interface{}, fmt.Errorf("cannot generate network configuration from %T", v)
+	}
+}
+
+// nocloudDatasource returns the kernel argument pointing cloud-init to the NoCloud datasource of the manifest
+// of the template context ctx. GRUB requires quoting it, as it contains a semicolon.
+func nocloudDatasource(ctx any) (string, error) {
+	var base *url.URL
+	switch ctx := ctx.(type) {
+	case manifest.ContentContext:
+		base = ctx.HttpBaseUrl
+	case *manifest.ContentContext:
+		base = ctx.HttpBaseUrl
+	default:
+		return "", fmt.Errorf("nocloudDatasource: cannot use %T as template context", ctx)
+	}
+	if base == nil {
+		return "", errors.New("nocloudDatasource: HTTP base URL is unknown")
+	}
+	return "ds=nocloud-net;s=" + strings.TrimSuffix(base.String(), "/") + manifest.NoCloudPath, nil
+}
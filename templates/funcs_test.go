@@ -0,0 +1,331 @@
+package templates
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+func TestSha512crypt(t *testing.T) {
+	// test vectors of glibc (crypt/sha512c-test.c)
+	tests := []struct {
+		salt, password, want string
+	}{
+		{"$6$saltstring", "Hello world!",
+			"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$6$rounds=10000$saltstringsaltstring", "Hello world!",
+			"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v."},
+		{"$6$rounds=5000$toolongsaltstring", "This is just a test",
+			"$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+		{"$6$rounds=1400$anotherlongsaltstring", "a very much longer text to encrypt.  This one even stretches over morethan one line.",
+			"$6$rounds=1400$anotherlongsalts$POfYwTEok97VWcjxIiSOjiykti.o/pQs.wPvMxQ6Fm7I6IoYN3CmLs66x9t0oSwbtEW7o7UmJEiDwGqd8p4ur1"},
+		{"$6$rounds=77777$short", "we have a short salt string but not a short password",
+			"$6$rounds=77777$short$WuQyW2YR.hBNpjjRhpYD/ifIw05xdfeEyQoMxIXbkvr0gge1a1x3yRULJ5CCaUeOxFmtlcGZelFl5CxtgfiAc0"},
+		{"$6$rounds=123456$asaltof16chars..", "a short string",
+			"$6$rounds=123456$asaltof16chars..$BtCwjqMJGx5hrJhZywWvt0RLE8uZ4oPwcelCjmw2kSYu.Ec6ycULevoBK25fs2xXgMNrCzIMVcgEJAstJeonj1"},
+		{"$6$rounds=10$roundstoolow", "the minimum number is still observed",
+			"$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for _, tt := range tests {
+		got, err := sha512crypt(tt.password, tt.salt)
+		if err != nil {
+			t.Errorf("sha512crypt(%q, %q): %v", tt.password, tt.salt, err)
+		} else if got != tt.want {
+			t.Errorf("sha512crypt(%q, %q) = %q, want %q", tt.password, tt.salt, got, tt.want)
+		}
+	}
+
+	// random salt, verified by hashing again with the result as salt
+	hash, err := sha512crypt("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := sha512crypt("secret", hash); err != nil || again != hash {
+		t.Errorf("sha512crypt with salt %q = %q, %v", hash, again, err)
+	}
+
+	for _, salt := range []string{"$6$rounds=x$salt", "$6$rounds=1000001$salt"} {
+		if _, err := sha512crypt("secret", salt); err == nil {
+			t.Errorf("sha512crypt with salt %q succeeded", salt)
+		}
+	}
+}
+
+func TestNetmask(t *testing.T) {
+	tests := []struct {
+		netmask string
+		prefix  int
+	}{
+		{"0.0.0.0", 0},
+		{"255.0.0.0", 8},
+		{"255.255.255.0", 24},
+		{"255.255.255.252", 30},
+		{"255.255.255.255", 32},
+	}
+	for _, tt := range tests {
+		if got, err := netmaskToPrefix(tt.netmask); err != nil || got != tt.prefix {
+			t.Errorf("netmaskToPrefix(%q) = %d, %v, want %d", tt.netmask, got, err, tt.prefix)
+		}
+		if got, err := prefixToNetmask(tt.prefix); err != nil || got != tt.netmask {
+			t.Errorf("prefixToNetmask(%d) = %q, %v, want %q", tt.prefix, got, err, tt.netmask)
+		}
+	}
+
+	for _, netmask := range []string{"255.0.255.0", "255.255.255", "foo"} {
+		if _, err := netmaskToPrefix(netmask); err == nil {
+			t.Errorf("netmaskToPrefix(%q) succeeded", netmask)
+		}
+	}
+	for _, prefix := range []int{-1, 33} {
+		if _, err := prefixToNetmask(prefix); err == nil {
+			t.Errorf("prefixToNetmask(%d) succeeded", prefix)
+		}
+	}
+}
+
+func TestCIDR(t *testing.T) {
+	_, ipNet, _ := net.ParseCIDR("10.1.2.3/16")
+	withNet := manifest.IPWithNet{IP: net.ParseIP("10.1.2.3"), Net: *ipNet}
+
+	tests := []struct {
+		cidr any
+		ip   string
+		bits int
+		mask string
+		net  string
+		bc   string
+	}{
+		{"192.168.1.10/24", "192.168.1.10", 24, "255.255.255.0", "192.168.1.0", "192.168.1.255"},
+		{"192.168.1.10/255.255.255.128", "192.168.1.10", 25, "255.255.255.128", "192.168.1.0", "192.168.1.127"},
+		{withNet, "10.1.2.3", 16, "255.255.0.0", "10.1.0.0", "10.1.255.255"},
+		{&withNet, "10.1.2.3", 16, "255.255.0.0", "10.1.0.0", "10.1.255.255"},
+		{ipNet, "10.1.0.0", 16, "255.255.0.0", "10.1.0.0", "10.1.255.255"},
+		{"2001:db8::5/64", "2001:db8::5", 64, "ffff:ffff:ffff:ffff::", "2001:db8::", "2001:db8::ffff:ffff:ffff:ffff"},
+	}
+	for _, tt := range tests {
+		if got, err := cidrIP(tt.cidr); err != nil || got != tt.ip {
+			t.Errorf("cidrIP(%v) = %q, %v, want %q", tt.cidr, got, err, tt.ip)
+		}
+		if got, err := cidrPrefix(tt.cidr); err != nil || got != tt.bits {
+			t.Errorf("cidrPrefix(%v) = %d, %v, want %d", tt.cidr, got, err, tt.bits)
+		}
+		if got, err := cidrNetmask(tt.cidr); err != nil || got != tt.mask {
+			t.Errorf("cidrNetmask(%v) = %q, %v, want %q", tt.cidr, got, err, tt.mask)
+		}
+		if got, err := cidrNetwork(tt.cidr); err != nil || got != tt.net {
+			t.Errorf("cidrNetwork(%v) = %q, %v, want %q", tt.cidr, got, err, tt.net)
+		}
+		if got, err := cidrBroadcast(tt.cidr); err != nil || got != tt.bc {
+			t.Errorf("cidrBroadcast(%v) = %q, %v, want %q", tt.cidr, got, err, tt.bc)
+		}
+	}
+
+	for _, cidr := range []any{"192.168.1.10", "192.168.1.10/33", "foo/24", 42} {
+		if _, err := cidrPrefix(cidr); err == nil {
+			t.Errorf("cidrPrefix(%v) succeeded", cidr)
+		}
+	}
+}
+
+func TestCIDRHost(t *testing.T) {
+	tests := []struct {
+		cidr string
+		n    int
+		want string
+	}{
+		{"192.168.1.10/24", 1, "192.168.1.1"},
+		{"192.168.1.10/24", 255, "192.168.1.255"},
+		{"192.168.1.10/24", -1, "192.168.1.255"},
+		{"192.168.1.10/24", -2, "192.168.1.254"},
+		{"192.168.1.10/24", -256, "192.168.1.0"},
+		{"10.0.0.0/8", 65536, "10.1.0.0"},
+		{"2001:db8::/64", 1, "2001:db8::1"},
+		{"2001:db8::/64", -1, "2001:db8::ffff:ffff:ffff:ffff"},
+		{"2001:db8::/120", 255, "2001:db8::ff"},
+	}
+	for _, tt := range tests {
+		if got, err := cidrHost(tt.cidr, tt.n); err != nil || got != tt.want {
+			t.Errorf("cidrHost(%q, %d) = %q, %v, want %q", tt.cidr, tt.n, got, err, tt.want)
+		}
+	}
+
+	for _, n := range []int{256, -257} {
+		if _, err := cidrHost("192.168.1.0/24", n); err == nil {
+			t.Errorf("cidrHost(192.168.1.0/24, %d) succeeded", n)
+		}
+	}
+	if _, err := cidrHost("2001:db8::/120", 256); err == nil {
+		t.Error("cidrHost(2001:db8::/120, 256) succeeded")
+	}
+}
+
+func TestCIDRSubnet(t *testing.T) {
+	tests := []struct {
+		cidr          string
+		newbits, num  int
+		want          string
+		wantContained string
+	}{
+		{"10.0.0.0/16", 8, 0, "10.0.0.0/24", "10.0.0.1"},
+		{"10.0.0.0/16", 8, 255, "10.0.255.0/24", "10.0.255.1"},
+		{"10.0.5.7/16", 4, 3, "10.0.48.0/20", "10.0.63.255"},
+		{"192.168.1.0/24", 0, 0, "192.168.1.0/24", "192.168.1.9"},
+		{"2001:db8::/48", 16, 1, "2001:db8:0:1::/64", "2001:db8:0:1::1"},
+		{"2001:db8::/32", 32, 65536, "2001:db8:1::/64", "2001:db8:1::1"},
+	}
+	for _, tt := range tests {
+		got, err := cidrSubnet(tt.cidr, tt.newbits, tt.num)
+		if err != nil || got != tt.want {
+			t.Errorf("cidrSubnet(%q, %d, %d) = %q, %v, want %q", tt.cidr, tt.newbits, tt.num, got, err, tt.want)
+			continue
+		}
+		if ok, err := cidrContains(got, tt.wantContained); err != nil || !ok {
+			t.Errorf("cidrContains(%q, %q) = %v, %v", got, tt.wantContained, ok, err)
+		}
+	}
+
+	for _, tt := range []struct {
+		cidr         string
+		newbits, num int
+	}{
+		{"10.0.0.0/16", 8, 256},
+		{"10.0.0.0/16", 8, -1},
+		{"10.0.0.0/16", 17, 0},
+		{"10.0.0.0/16", -1, 0},
+		{"2001:db8::/64", 65, 0},
+	} {
+		if _, err := cidrSubnet(tt.cidr, tt.newbits, tt.num); err == nil {
+			t.Errorf("cidrSubnet(%q, %d, %d) succeeded", tt.cidr, tt.newbits, tt.num)
+		}
+	}
+}
+
+func TestFormatMAC(t *testing.T) {
+	hw, _ := net.ParseMAC("52:54:00:AB:cd:EF")
+	for _, v := range []any{"52:54:00:ab:cd:ef", "52-54-00-AB-CD-EF", "5254.00ab.cdef", "525400abcdef", hw, manifest.HardwareAddr(hw)} {
+		tests := []struct {
+			sep, prefix, want string
+		}{
+			{":", "", "52:54:00:ab:cd:ef"},       // macColon
+			{"-", "", "52-54-00-ab-cd-ef"},       // macDash
+			{"", "", "525400abcdef"},             // macPlain
+			{"-", "01-", "01-52-54-00-ab-cd-ef"}, // macPxelinux
+		}
+		for _, tt := range tests {
+			if got, err := formatMAC(v, tt.sep, tt.prefix); err != nil || got != tt.want {
+				t.Errorf("formatMAC(%v, %q, %q) = %q, %v, want %q", v, tt.sep, tt.prefix, got, err, tt.want)
+			}
+		}
+	}
+
+	for _, v := range []any{"", "52:54:00", "52540012345", "zz5400abcdef", 42, net.HardwareAddr{}} {
+		if _, err := formatMAC(v, ":", ""); err == nil {
+			t.Errorf("formatMAC(%v) succeeded", v)
+		}
+	}
+}
+
+func TestYamlQuote(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"", `""`},
+		{"plain", `"plain"`},
+		{"yes", `"yes"`},
+		{"a: b # c", `"a: b # c"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{`back\slash`, `"back\\slash"`},
+		{"two\nlines\ttab", `"two\nlines\ttab"`},
+		{"<&>", `"<&>"`},
+		{"ünïcode", `"ünïcode"`},
+	}
+	for _, tt := range tests {
+		if got, err := yamlQuote(tt.s); err != nil || got != tt.want {
+			t.Errorf("yamlQuote(%q) = %q, %v, want %q", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"", `''`},
+		{"plain", `'plain'`},
+		{"it's", `'it'\''s'`},
+		{"''", `''\'''\'''`},
+		{"$(rm -rf /) `x` \\", "'$(rm -rf /) `x` \\'"},
+		{"two\nlines", "'two\nlines'"},
+	}
+	for _, tt := range tests {
+		if got := shellQuote(tt.s); got != tt.want {
+			t.Errorf("shellQuote(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestGrubArgs(t *testing.T) {
+	tests := []struct {
+		s, want string
+	}{
+		{"", ""},
+		{"  ", ""},
+		{"console=ttyS0,115200n8 ro quiet", "console=ttyS0,115200n8 ro quiet"},
+		{"  root=/dev/sda1\t\tip=dhcp  ", "root=/dev/sda1 ip=dhcp"},
+		{`foo="a b" bar`, `'foo=a b' bar`},
+		{`foo="" bar`, `foo= bar`},
+		{`""`, `''`},
+		{`"unterminated quote`, `'unterminated quote'`},
+		{"x=$y;z", `'x=$y;z'`},
+		{"it's", `'it'\''s'`},
+		{"url=http://host:8080/a%20b", "url=http://host:8080/a%20b"},
+	}
+	for _, tt := range tests {
+		if got := grubArgs(tt.s); got != tt.want {
+			t.Errorf("grubArgs(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestIpxeEscape(t *testing.T) {
+	for _, s := range []string{"", "plain", "console=ttyS0 quiet", "tab\tseparated", "$dollar {braces}", "ünïcode"} {
+		if got, err := ipxeEscape(s); err != nil || got != s {
+			t.Errorf("ipxeEscape(%q) = %q, %v, want it unchanged", s, got, err)
+		}
+	}
+	for _, s := range []string{"${net0/ip}", "a${b", "two\nlines", "carriage\rreturn", "nul\x00", "del\x7f"} {
+		if _, err := ipxeEscape(s); err == nil {
+			t.Errorf("ipxeEscape(%q) succeeded", s)
+		}
+	}
+}
+
+func TestGzipB64enc(t *testing.T) {
+	for _, s := range []string{"", "hello world\n", strings.Repeat("netbootd ", 10000), "\x00\xff binary"} {
+		enc, err := gzipB64enc(s)
+		if err != nil {
+			t.Fatalf("gzipB64enc(%q): %v", s, err)
+		}
+		b, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil {
+			t.Fatalf("gzipB64enc(%q) is not base64: %v", s, err)
+		}
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("gzipB64enc(%q) is not gzip: %v", s, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("gzipB64enc(%q) is not gzip: %v", s, err)
+		}
+		if string(got) != s {
+			t.Errorf("gzipB64enc(%q) decodes to %q", s, got)
+		}
+	}
+}
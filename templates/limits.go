@@ -0,0 +1,225 @@
+package templates
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+	"text/template"
+	"text/template/parse"
+)
+
+// text/template can't interrupt an execution, so templates are instrumented to check their limits regularly:
+// range and template actions pass their pipeline through a checkpoint, and functions are wrapped to check
+// the size of what they return. Between checkpoints, an execution does an amount of work bounded by the size
+// of the template.
+
+const (
+	// maxSteps bounds iterations of range actions plus template invocations of an execution,
+	// so that executions stop even when nobody is waiting for them anymore.
+	maxSteps = 1000000
+	// maxValueDepth bounds nesting of values returned by functions, which may even be cyclic (set $d "d" $d).
+	maxValueDepth = 32
+
+	// names of the checkpoints of range and template actions, bound for each execution
+	rangeCheckpoint    = "netbootd_range"
+	templateCheckpoint = "netbootd_template"
+)
+
+// ErrTooComplex is returned when an execution iterates or invokes templates more than maxSteps times.
+var ErrTooComplex = errors.New("template execution exceeds maximum number of steps")
+
+// instrument inserts checkpoints into tree and adds names of functions it calls to functions.
+func instrument(tree *parse.Tree, functions map[string]bool) {
+	var walk func(node parse.Node)
+	walkPipe := func(pipe *parse.PipeNode) {
+		if pipe == nil {
+			return
+		}
+		for _, cmd := range pipe.Cmds {
+			for _, arg := range cmd.Args {
+				walk(arg)
+			}
+		}
+	}
+	checkpoint := func(pipe *parse.PipeNode, name string, pos parse.Pos) {
+		pipe.Cmds = append(pipe.Cmds, &parse.CommandNode{
+			NodeType: parse.NodeCommand,
+			Pos:      pos,
+			Args:     []parse.Node{parse.NewIdentifier(name).SetTree(tree).SetPos(pos)},
+		})
+	}
+	walk = func(node parse.Node) {
+		switch n := node.(type) {
+		case *parse.ListNode:
+			if n != nil {
+				for _, child := range n.Nodes {
+					walk(child)
+				}
+			}
+		case *parse.ActionNode:
+			walkPipe(n.Pipe)
+		case *parse.PipeNode:
+			walkPipe(n)
+		case *parse.ChainNode:
+			walk(n.Node)
+		case *parse.IdentifierNode:
+			functions[n.Ident] = true
+		case *parse.IfNode:
+			walkPipe(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.WithNode:
+			walkPipe(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+		case *parse.RangeNode:
+			walkPipe(n.Pipe)
+			walk(n.List)
+			walk(n.ElseList)
+			checkpoint(n.Pipe, rangeCheckpoint, n.Pos)
+		case *parse.TemplateNode:
+			walkPipe(n.Pipe)
+			if n.Pipe == nil {
+				n.Pipe = &parse.PipeNode{NodeType: parse.NodePipe, Pos: n.Pos, Line: n.Line}
+			}
+			checkpoint(n.Pipe, templateCheckpoint, n.Pos)
+		}
+	}
+	if tree != nil {
+		walk(tree.Root)
+	}
+}
+
+// execution tracks the limits of a single execution of a template.
+type execution struct {
+	aborted atomic.Bool
+	steps   int
+	maxSize int64
+}
+
+// check fails once the execution is aborted.
+func (e *execution) check() error {
+	if e.aborted.Load() {
+		return ErrTimeout
+	}
+	return nil
+}
+
+// step accounts for n steps of the execution.
+func (e *execution) step(n int) error {
+	if err := e.check(); err != nil {
+		return err
+	}
+	e.steps += n
+	if e.steps > maxSteps {
+		return ErrTooComplex
+	}
+	return nil
+}
+
+// funcs returns checkpoints and functions named by used (as far as they are in all) bound to e.
+func (e *execution) funcs(all template.FuncMap, used map[string]bool) template.FuncMap {
+	funcs := template.FuncMap{
+		rangeCheckpoint: func(v any) (any, error) {
+			return v, e.step(rangeLength(v))
+		},
+		templateCheckpoint: func(v ...any) (any, error) {
+			var dot any
+			if len(v) > 0 {
+				dot = v[0]
+			}
+			return dot, e.step(1)
+		},
+	}
+	for name := range used {
+		if f, ok := all[name]; ok && name != "include" && funcs[name] == nil {
+			funcs[name] = e.wrap(f)
+		}
+	}
+	return funcs
+}
+
+// rangeLength returns the number of iterations of range over v, 1 if unknown.
+func rangeLength(v any) int {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Array, reflect.Slice, reflect.Map:
+		return rv.Len()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(max(rv.Int(), 0))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return int(min(rv.Uint(), maxSteps+1))
+	}
+	return 1
+}
+
+// wrap returns f checking the execution before it's called and the size of its result afterwards.
+// Errors are raised as panics, which text/template turns into errors of the call.
+func (e *execution) wrap(f any) any {
+	fv := reflect.ValueOf(f)
+	if fv.Kind() != reflect.Func {
+		return f
+	}
+	ft := fv.Type()
+	return reflect.MakeFunc(ft, func(args []reflect.Value) []reflect.Value {
+		if err := e.check(); err != nil {
+			panic(err)
+		}
+		var out []reflect.Value
+		if ft.IsVariadic() {
+			out = fv.CallSlice(args)
+		} else {
+			out = fv.Call(args)
+		}
+		if e.maxSize > 0 && len(out) > 0 && valueSize(out[0], e.maxSize, 0) > e.maxSize {
+			panic(ErrTooLarge)
+		}
+		return out
+	}).Interface()
+}
+
+// valueSize approximates the memory held by v, it stops counting once it exceeds limit.
+// Values nested deeper than maxValueDepth count as exceeding limit.
+func valueSize(v reflect.Value, limit int64, depth int) int64 {
+	if depth > maxValueDepth {
+		return limit + 1
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		return 0
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return 8
+		}
+		return 8 + valueSize(v.Elem(), limit, depth+1)
+	case reflect.String:
+		return 16 + int64(v.Len())
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return 24 + int64(v.Len())
+		}
+		size := int64(24)
+		for i := 0; i < v.Len() && size <= limit; i++ {
+			size += valueSize(v.Index(i), limit-size, depth+1)
+		}
+		return size
+	case reflect.Map:
+		size := int64(48)
+		iter := v.MapRange()
+		for iter.Next() && size <= limit {
+			size += valueSize(iter.Key(), limit-size, depth+1)
+			size += valueSize(iter.Value(), limit-size, depth+1)
+		}
+		return size
+	case reflect.Struct:
+		size := int64(0)
+		for i := 0; i < v.NumField() && size <= limit; i++ {
+			size += valueSize(v.Field(i), limit-size, depth+1)
+		}
+		return size
+	}
+	return 8
+}
@@ -0,0 +1,108 @@
+package templates
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func execute(t *testing.T, cfg Config, text string) (string, error) {
+	t.Helper()
+	l, err := NewLibrary(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := l.Parse("content", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = tmpl.Execute(&out, nil)
+	return out.String(), err
+}
+
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		text    string
+		maxSize int64
+		want    error
+	}{
+		// ten billion iterations, stopped after a million
+		{`{{ range until 100000 }}{{ range until 100000 }}{{ end }}{{ end }}`, 0, ErrTooComplex},
+		{`{{ range $i := 1000000000000 }}{{ end }}`, 0, ErrTooComplex},
+		{`{{ define "loop" }}{{ range 1000 }}{{ template "loop" }}{{ end }}{{ end }}{{ template "loop" }}`, 0, ErrTooComplex},
+		// output over the cap, written at once or bit by bit
+		{`{{ repeat 2000 "x" }}`, 1000, ErrTooLarge},
+		{`{{ range 2000 }}x{{ end }}`, 1000, ErrTooLarge},
+		// values over the cap, even if not written
+		{`{{ $s := repeat 2000 "x" }}`, 1000, ErrTooLarge},
+		{`{{ $l := list }}{{ range until 200 }}{{ $l = append $l "xxxxxxxxxx" }}{{ end }}`, 1000, ErrTooLarge},
+		// capped even without size limit, failing with errors of their own
+		{`{{ $s := repeat 100000000 "x" }}`, 0, nil},
+		{`{{ range until 1000000000 }}{{ end }}`, 0, nil},
+	}
+	for _, tt := range tests {
+		got, err := execute(t, Config{MaxSize: tt.maxSize}, tt.text)
+		if tt.want != nil && !errors.Is(err, tt.want) || tt.want == nil && err == nil || got != "" {
+			t.Errorf("execute %s = %d bytes, %v, want %v", tt.text, len(got), err, tt.want)
+		}
+	}
+
+	if got, err := execute(t, Config{MaxSize: 1000}, `{{ repeat 500 "x" }}{{ repeat 500 "x" }}`); err != nil || len(got) != 1000 {
+		t.Errorf("output at the cap = %d bytes, %v", len(got), err)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// each bcrypt takes a while, the execution stops at the next one after timing out
+	start := time.Now()
+	_, err := execute(t, Config{Timeout: 100 * time.Millisecond}, `{{ range until 1000 }}{{ bcrypt "secret" }}{{ end }}`)
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("got error %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("took %s", d)
+	}
+}
+
+func TestFunctions(t *testing.T) {
+	blocked := []string{"env", "expandenv", "getHostByName", "genPrivateKey", "genCA"}
+	l, err := NewLibrary(Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range blocked {
+		if _, err := l.Parse("content", `{{ `+name+` "x" }}`); err == nil || !strings.Contains(err.Error(), "not defined") {
+			t.Errorf("parsing %s: %v", name, err)
+		}
+	}
+	if _, err := l.Parse("content", `{{ upper "x" }}{{ netplan . }}{{ printf "%s" "x" }}`); err != nil {
+		t.Errorf("default functions: %v", err)
+	}
+
+	// allowed explicitly
+	t.Setenv("NETBOOTD_TEST", "value")
+	if got, err := execute(t, Config{Functions: []string{"default", "env"}}, `{{ env "NETBOOTD_TEST" | upper }}`); err != nil || got != "VALUE" {
+		t.Errorf("env = %q, %v", got, err)
+	}
+	l, err = NewLibrary(Config{Functions: []string{"env"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Parse("content", `{{ upper "x" }}`); err == nil {
+		t.Error("upper available without default")
+	}
+
+	// every function of the default allow-list exists
+	all := allFunctions()
+	for _, name := range defaultFunctions {
+		if _, ok := all[name]; !ok {
+			t.Errorf("default function %s does not exist", name)
+		}
+	}
+	if _, err := Functions([]string{"default", "missing"}); err == nil {
+		t.Error("unknown function allowed")
+	}
+}
@@ -0,0 +1,286 @@
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"text/template"
+
+	"github.com/Masterminds/sprig/v3"
+)
+
+const (
+	// DefaultFunctions in Config.Functions stands for the functions allowed by default, see defaultFunctions.
+	DefaultFunctions = "default"
+
+	// maxSequence caps the length of sequences generated by until, untilStep and seq.
+	maxSequence = 100000
+	// maxGenerated caps the size of strings generated by functions whose output grows with an argument
+	// rather than with their input, such as repeat, checked before they allocate it.
+	maxGenerated = maxSequence * 100
+)
+
+var (
+	// ErrTimeout is returned when a template does not finish executing within the timeout.
+	ErrTimeout = errors.New("template execution timed out")
+	// ErrTooLarge is returned when a template renders more than the maximum size.
+	ErrTooLarge = errors.New("template output exceeds maximum size")
+)
+
+// defaultFunctions are the functions DefaultFunctions stands for. It's an allow-list, so that functions added
+// to sprig are not available to templates before being reviewed. Not included are functions exposing the environment
+// of netbootd, which may contain secrets, or reaching out to the network (env, expandenv, getHostByName),
+// and those generating keys and certificates, which may keep running long after an execution timed out.
+var defaultFunctions = []string{
+	// sprig
+	"abbrev", "abbrevboth", "add", "add1", "add1f", "addf", "adler32sum", "ago", "all", "any", "append", "atoi",
+	"b32dec", "b32enc", "b64dec", "b64enc", "base", "bcrypt", "biggest", "camelcase", "cat", "ceil", "chunk",
+	"clean", "coalesce", "compact", "concat", "contains", "date", "dateInZone", "dateModify", "date_in_zone",
+	"date_modify", "decryptAES", "deepCopy", "deepEqual", "default", "derivePassword", "dict", "dig", "dir", "div",
+	"divf", "duration", "durationRound", "empty", "encryptAES", "ext", "fail", "first", "float64", "floor",
+	"fromJson", "get", "has", "hasKey", "hasPrefix", "hasSuffix", "hello", "htmlDate", "htmlDateInZone", "htpasswd",
+	"indent", "initial", "initials", "int", "int64", "isAbs", "join", "kebabcase", "keys", "kindIs", "kindOf",
+	"last", "list", "lower", "max", "maxf", "merge", "mergeOverwrite", "min", "minf", "mod", "mul", "mulf",
+	"mustAppend", "mustChunk", "mustCompact", "mustDateModify", "mustDeepCopy", "mustFirst", "mustFromJson",
+	"mustHas", "mustInitial", "mustLast", "mustMerge", "mustMergeOverwrite", "mustPrepend", "mustPush",
+	"mustRegexFind", "mustRegexFindAll", "mustRegexMatch", "mustRegexReplaceAll", "mustRegexReplaceAllLiteral",
+	"mustRegexSplit", "mustRest", "mustReverse", "mustSlice", "mustToDate", "mustToJson", "mustToPrettyJson",
+	"mustToRawJson", "mustUniq", "mustWithout", "must_date_modify", "nindent", "nospace", "now", "omit", "osBase",
+	"osClean", "osDir", "osExt", "osIsAbs", "pick", "pluck", "plural", "prepend", "push", "quote", "randAlpha",
+	"randAlphaNum", "randAscii", "randBytes", "randInt", "randNumeric", "regexFind", "regexFindAll", "regexMatch",
+	"regexQuoteMeta", "regexReplaceAll", "regexReplaceAllLiteral", "regexSplit", "repeat", "replace", "rest",
+	"reverse", "round", "semver", "semverCompare", "seq", "set", "sha1sum", "sha256sum", "sha512sum", "shuffle",
+	"slice", "snakecase", "sortAlpha", "split", "splitList", "splitn", "squote", "sub", "subf", "substr", "swapcase",
+	"ternary", "title", "toDate", "toDecimal", "toJson", "toPrettyJson", "toRawJson", "toString", "toStrings",
+	"trim", "trimAll", "trimPrefix", "trimSuffix", "trimall", "trunc", "tuple", "typeIs", "typeIsLike", "typeOf",
+	"uniq", "unixEpoch", "unset", "until", "untilStep", "untitle", "upper", "urlJoin", "urlParse", "uuidv4",
+	"values", "without", "wrap", "wrapWith",
+	// netbootd, see netbootdFunctions
+	"cidrBroadcast", "cidrContains", "cidrHost", "cidrIP", "cidrNetmask", "cidrNetwork", "cidrPrefix", "cidrSubnet",
+	"cloudInitNetwork", "grubArgs", "gzipB64enc", "ifcfg", "ipxeEscape", "macColon", "macDash", "macPlain",
+	"macPxelinux", "netmaskToPrefix", "netplan", "nmKeyfile", "nocloudDatasource", "prefixToNetmask", "sha512crypt",
+	"shellQuote", "yamlQuote",
+}
+
+// allFunctions returns every function templates may be allowed to use.
+func allFunctions() template.FuncMap {
+	funcs := sprig.TxtFuncMap()
+	for name, f := range netbootdFunctions() {
+		funcs[name] = f
+	}
+	// replaced for each execution, see Template.Execute
+	funcs["include"] = func(string, any) (string, error) {
+		return "", errors.New("include is not available")
+	}
+
+	// sprig does not bound these, a template could exhaust memory before writing anything
+	until, untilStep, seq, repeat := funcs["until"].(func(int) []int), funcs["untilStep"].(func(int, int, int) []int),
+		funcs["seq"].(func(...int) string), funcs["repeat"].(func(int, string) string)
+	funcs["until"] = func(count int) ([]int, error) {
+		if count > maxSequence {
+			return nil, fmt.Errorf("until: %d exceeds maximum of %d", count, maxSequence)
+		}
+		return until(count), nil
+	}
+	funcs["untilStep"] = func(start, stop, step int) ([]int, error) {
+		if step != 0 && (stop-start)/step > maxSequence {
+			return nil, fmt.Errorf("untilStep: sequence exceeds maximum length of %d", maxSequence)
+		}
+		return untilStep(start, stop, step), nil
+	}
+	funcs["seq"] = func(params ...int) (string, error) {
+		start, stop, step := 1, 0, 1
+		switch len(params) {
+		case 1:
+			stop = params[0]
+		case 2:
+			start, stop = params[0], params[1]
+		case 3:
+			start, step, stop = params[0], params[1], params[2]
+		}
+		if step == 0 {
+			step = 1
+		}
+		if n := (stop - start) / step; n > maxSequence || -n > maxSequence {
+			return "", fmt.Errorf("seq: sequence exceeds maximum length of %d", maxSequence)
+		}
+		return seq(params...), nil
+	}
+	funcs["repeat"] = func(count int, str string) (string, error) {
+		if int64(count)*int64(len(str)) > maxGenerated {
+			return "", fmt.Errorf("repeat: result exceeds maximum length of %d", maxGenerated)
+		}
+		return repeat(count, str), nil
+	}
+	for _, name := range []string{"randAlphaNum", "randAlpha", "randAscii", "randNumeric"} {
+		name, rand := name, funcs[name].(func(int) string)
+		funcs[name] = func(count int) (string, error) {
+			if count > maxGenerated {
+				return "", fmt.Errorf("%s: result exceeds maximum length of %d", name, maxGenerated)
+			}
+			return rand(count), nil
+		}
+	}
+	for _, name := range []string{"indent", "nindent"} {
+		name, indent := name, funcs[name].(func(int, string) string)
+		funcs[name] = func(spaces int, v string) (string, error) {
+			if int64(spaces)*int64(strings.Count(v, "\n")+1)+int64(len(v)) > maxGenerated {
+				return "", fmt.Errorf("%s: result exceeds maximum length of %d", name, maxGenerated)
+			}
+			return indent(spaces, v), nil
+		}
+	}
+	replace, wrapWith, join := funcs["replace"].(func(string, string, string) string),
+		funcs["wrapWith"].(func(int, string, string) string), funcs["join"].(func(string, any) string)
+	funcs["replace"] = func(old, new, src string) (string, error) {
+		n := strings.Count(src, old)
+		if int64(len(src))+int64(n)*int64(len(new)-len(old)) > maxGenerated {
+			return "", fmt.Errorf("replace: result exceeds maximum length of %d", maxGenerated)
+		}
+		return replace(old, new, src), nil
+	}
+	funcs["wrapWith"] = func(l int, sep, str string) (string, error) {
+		if int64(len(str))*int64(len(sep)+1) > maxGenerated {
+			return "", fmt.Errorf("wrapWith: result exceeds maximum length of %d", maxGenerated)
+		}
+		return wrapWith(l, sep, str), nil
+	}
+	funcs["join"] = func(sep string, v any) (string, error) {
+		if n := rangeLength(v); n > 1 && int64(n-1)*int64(len(sep)) > maxGenerated {
+			return "", fmt.Errorf("join: result exceeds maximum length of %d", maxGenerated)
+		}
+		return join(sep, v), nil
+	}
+	for _, name := range []string{"regexReplaceAll", "mustRegexReplaceAll", "regexReplaceAllLiteral", "mustRegexReplaceAllLiteral"} {
+		name, literal := name, strings.HasSuffix(name, "Literal")
+		funcs[name] = func(regex, s, repl string) (string, error) {
+			re, err := regexp.Compile(regex)
+			if err != nil {
+				return "", err
+			}
+			if n := replacedSize(re, s, repl, literal); n > maxGenerated {
+				return "", fmt.Errorf("%s: result exceeds maximum length of %d", name, maxGenerated)
+			}
+			if literal {
+				return re.ReplaceAllLiteralString(s, repl), nil
+			}
+			return re.ReplaceAllString(s, repl), nil
+		}
+	}
+
+	// builtins, replaced so that they are wrapped like other functions, see execution.wrap
+	funcs["print"] = fmt.Sprint
+	funcs["println"] = fmt.Sprintln
+	funcs["printf"] = func(format string, args ...any) (string, error) {
+		if err := checkFormat(format, args); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf(format, args...), nil
+	}
+	funcs["html"] = template.HTMLEscaper
+	funcs["js"] = template.JSEscaper
+	funcs["urlquery"] = template.URLQueryEscaper
+	return funcs
+}
+
+// builtinFunctions are always available, as text/template provides them anyway.
+var builtinFunctions = []string{"print", "println", "printf", "html", "js", "urlquery"}
+
+// replacedSize returns an upper bound of the size of s with matches of re replaced by repl, without allocating it.
+// Expanded replacements are at most as long as repl plus its group references, each as long as the match.
+func replacedSize(re *regexp.Regexp, s, repl string, literal bool) int64 {
+	refs := int64(0)
+	if !literal {
+		refs = int64(strings.Count(repl, "$"))
+	}
+	size := int64(len(s))
+	re.ReplaceAllStringFunc(s, func(match string) string {
+		size += int64(len(repl)) + refs*int64(len(match)) - int64(len(match))
+		return ""
+	})
+	return size
+}
+
+// checkFormat fails for widths and precisions of format larger than maxGenerated, which fmt would pad to.
+func checkFormat(format string, args []any) error {
+	for i := 0; i < len(format); i++ {
+		if format[i] == '*' {
+			for _, arg := range args {
+				if n, ok := arg.(int); ok && (n > maxGenerated || -n > maxGenerated) {
+					return fmt.Errorf("printf: width or precision exceeds maximum of %d", maxGenerated)
+				}
+			}
+		}
+		if format[i] < '0' || format[i] > '9' {
+			continue
+		}
+		j := i
+		for j < len(format) && format[j] >= '0' && format[j] <= '9' {
+			j++
+		}
+		if n, err := strconv.Atoi(format[i:j]); err != nil || n > maxGenerated {
+			return fmt.Errorf("printf: width or precision exceeds maximum of %d", maxGenerated)
+		}
+		i = j - 1
+	}
+	return nil
+}
+
+// Functions returns the functions available to templates: all functions named by allowed,
+// where DefaultFunctions (also used when allowed is empty) stands for defaultFunctions.
+func Functions(allowed []string) (template.FuncMap, error) {
+	all := allFunctions()
+	if len(allowed) == 0 {
+		allowed = []string{DefaultFunctions}
+	}
+
+	funcs := template.FuncMap{
+		// needed to parse templates, but fails unless allowed
+		"include": all["include"],
+	}
+	for _, name := range builtinFunctions {
+		funcs[name] = all[name]
+	}
+	var unknown []string
+	for _, name := range allowed {
+		names := []string{name}
+		if name == DefaultFunctions {
+			names = defaultFunctions
+		}
+		for _, name := range names {
+			if f, ok := all[name]; ok {
+				funcs[name] = f
+			} else {
+				unknown = append(unknown, name)
+			}
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, errors.New("unknown template functions: " + strings.Join(unknown, ", "))
+	}
+	return funcs, nil
+}
+
+// limitedWriter collects output of an execution up to max bytes (unless max is 0).
+// Once aborted, all writes fail.
+type limitedWriter struct {
+	buf     []byte
+	max     int64
+	aborted *atomic.Bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.aborted.Load() {
+		return 0, ErrTimeout
+	}
+	if w.max > 0 && int64(len(w.buf)+len(p)) > w.max {
+		return 0, ErrTooLarge
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
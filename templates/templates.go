@@ -0,0 +1,419 @@
+// Package templates maintains the library of named templates shared by content of all mounts.
+package templates
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Extension of template files in the library directory, not part of template names.
+	Extension = ".tmpl"
+
+	// maxIncludeDepth stops templates including themselves endlessly.
+	maxIncludeDepth = 100
+	// changes to the library directory arriving within this time are reloaded at once
+	reloadDelay = 100 * time.Millisecond
+)
+
+var (
+	// ErrNotFound is returned for names of templates not in the library.
+	ErrNotFound = errors.New("template not found")
+	// ErrNoDirectory is returned when changing a library without directory.
+	ErrNoDirectory = errors.New("template library directory is not set")
+)
+
+type Config struct {
+	// Directory from which the library is loaded, each file with Extension defines a template
+	// named by its path relative to Directory, without Extension. Empty means the library is empty.
+	Directory string
+
+	// Functions allowed in templates, see Functions.
+	Functions []string
+	// Maximum duration of an execution, 0 means no limit.
+	Timeout time.Duration
+	// Maximum size of rendered output in bytes, 0 means no limit.
+	MaxSize int64
+}
+
+// Library is a set of named templates, which content templates can use with {{ template "name" . }}
+// or {{ include "name" . }}.
+type Library struct {
+	config Config
+	logger zerolog.Logger
+	funcs  template.FuncMap
+
+	mutex   sync.RWMutex
+	sources map[string]string
+	// parsed library, content templates are parsed into clones of it
+	set *template.Template
+	// functions called by the library
+	functions map[string]bool
+	// incremented on every load, templates parsed with an older revision are outdated
+	revision uint64
+}
+
+// NewLibrary loads the library from cfg.Directory, which is created if missing.
+func NewLibrary(cfg Config) (*Library, error) {
+	funcs, err := Functions(cfg.Functions)
+	if err != nil {
+		return nil, err
+	}
+	l := &Library{
+		config:    cfg,
+		logger:    log.With().Str("module", "templates").Logger(),
+		funcs:     funcs,
+		sources:   make(map[string]string),
+		set:       template.New("").Funcs(funcs),
+		functions: make(map[string]bool),
+	}
+	if cfg.Directory == "" {
+		return l, nil
+	}
+	if err := os.MkdirAll(cfg.Directory, 0o755); err != nil {
+		return nil, err
+	}
+	if err := l.Load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Load (re)loads the library from its directory. On error, the previously loaded library stays in use.
+func (l *Library) Load() error {
+	sources := make(map[string]string)
+	err := filepath.WalkDir(l.config.Directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !strings.HasSuffix(d.Name(), Extension) || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(l.config.Directory, p)
+		if err != nil {
+			return err
+		}
+		sources[strings.TrimSuffix(filepath.ToSlash(rel), Extension)] = string(b)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	set, functions, err := l.parseLibrary(sources)
+	if err != nil {
+		return err
+	}
+
+	l.mutex.Lock()
+	l.sources = sources
+	l.set = set
+	l.functions = functions
+	l.revision++
+	l.mutex.Unlock()
+
+	l.logger.Info().
+		Str("directory", l.config.Directory).
+		Int("templates", len(sources)).
+		Msg("template library loaded")
+	return nil
+}
+
+// parseLibrary parses sources into an instrumented set and returns it with the names of functions it calls.
+func (l *Library) parseLibrary(sources map[string]string) (*template.Template, map[string]bool, error) {
+	set := template.New("").Funcs(l.funcs)
+	for name, text := range sources {
+		if _, err := set.New(name).Parse(text); err != nil {
+			return nil, nil, fmt.Errorf("cannot parse template %s: %w", name, err)
+		}
+	}
+	functions := make(map[string]bool)
+	for _, tmpl := range set.Templates() {
+		instrument(tmpl.Tree, functions)
+	}
+	return set, functions, nil
+}
+
+// Watch reloads the library whenever files in its directory change, until the directory is removed.
+func (l *Library) Watch() error {
+	if l.config.Directory == "" {
+		return nil
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := l.watchDirectories(watcher); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	go func() {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case _, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// editors write files in several steps, reload once they are done
+				if reload == nil {
+					reload = time.After(reloadDelay)
+				}
+			case <-reload:
+				reload = nil
+				// subdirectories may have been created meanwhile
+				if err := l.watchDirectories(watcher); err != nil {
+					l.logger.Error().
+						Err(err).
+						Msg("cannot watch template library")
+				}
+				if err := l.Load(); err != nil {
+					l.logger.Error().
+						Err(err).
+						Msg("cannot reload template library, keeping previous one")
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				l.logger.Error().
+					Err(err).
+					Msg("error watching template library")
+			}
+		}
+	}()
+	return nil
+}
+
+// watchDirectories adds the library directory and its subdirectories to watcher.
+func (l *Library) watchDirectories(watcher *fsnotify.Watcher) error {
+	return filepath.WalkDir(l.config.Directory, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(p)
+		}
+		return nil
+	})
+}
+
+// Revision identifies the currently loaded library, it changes whenever the library is reloaded.
+func (l *Library) Revision() uint64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return l.revision
+}
+
+// Names returns names of all templates in the library, sorted.
+func (l *Library) Names() []string {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	names := make([]string, 0, len(l.sources))
+	for name := range l.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Source returns the text of template name.
+func (l *Library) Source(name string) (string, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	text, ok := l.sources[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return text, nil
+}
+
+// ValidName reports whether name can be used for a template stored in the library directory.
+func ValidName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, "/") && path.Clean(name) == name &&
+		name != ".." && !strings.HasPrefix(name, "../") &&
+		!strings.HasPrefix(path.Base(name), ".")
+}
+
+// Put stores template name in the library directory and reloads the library.
+// Templates that do not parse are rejected.
+func (l *Library) Put(name, text string) error {
+	if l.config.Directory == "" {
+		return ErrNoDirectory
+	}
+	if !ValidName(name) {
+		return errors.New("invalid template name: " + name)
+	}
+
+	l.mutex.RLock()
+	sources := make(map[string]string, len(l.sources)+1)
+	for n, t := range l.sources {
+		sources[n] = t
+	}
+	l.mutex.RUnlock()
+	sources[name] = text
+	if _, _, err := l.parseLibrary(sources); err != nil {
+		return err
+	}
+
+	p := filepath.Join(l.config.Directory, filepath.FromSlash(name)+Extension)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	// written aside and renamed, so that the watcher never loads a partial file
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".put-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(text); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return err
+	}
+	return l.Load()
+}
+
+// Delete removes template name from the library directory and reloads the library.
+func (l *Library) Delete(name string) error {
+	if l.config.Directory == "" {
+		return ErrNoDirectory
+	}
+	if !ValidName(name) {
+		return ErrNotFound
+	}
+	err := os.Remove(filepath.Join(l.config.Directory, filepath.FromSlash(name)+Extension))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return l.Load()
+}
+
+// Template is content parsed together with the library it may reference.
+type Template struct {
+	tmpl *template.Template
+	// functions available and called by tmpl or the library
+	funcs     template.FuncMap
+	functions map[string]bool
+	timeout   time.Duration
+	maxSize   int64
+}
+
+// Parse parses text as template name, with access to templates of the library.
+func (l *Library) Parse(name, text string) (*Template, error) {
+	l.mutex.RLock()
+	set, err := l.set.Clone()
+	library := l.functions
+	l.mutex.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	// trees of the library are shared by clones and instrumented already
+	instrumented := make(map[*parse.Tree]bool)
+	for _, tmpl := range set.Templates() {
+		instrumented[tmpl.Tree] = true
+	}
+	tmpl, err := set.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	functions := make(map[string]bool, len(library))
+	for f := range library {
+		functions[f] = true
+	}
+	for _, t := range tmpl.Templates() {
+		if !instrumented[t.Tree] {
+			instrument(t.Tree, functions)
+		}
+	}
+	return &Template{tmpl: tmpl, funcs: l.funcs, functions: functions, timeout: l.config.Timeout, maxSize: l.config.MaxSize}, nil
+}
+
+// Execute applies the template to data, writing output to w. It may be called concurrently.
+// Output is written only once the execution succeeded within the limits of the library.
+// An execution that timed out stops at its next checkpoint, see instrument.
+func (t *Template) Execute(w io.Writer, data any) error {
+	// include has to execute templates of the same set, which differs for each execution
+	tmpl, err := t.tmpl.Clone()
+	if err != nil {
+		return err
+	}
+	e := &execution{maxSize: t.maxSize}
+	tmpl.Funcs(e.funcs(t.funcs, t.functions))
+	depth := 0
+	tmpl.Funcs(template.FuncMap{
+		"include": func(name string, data any) (string, error) {
+			if err := e.step(1); err != nil {
+				return "", err
+			}
+			if depth >= maxIncludeDepth {
+				return "", fmt.Errorf("include %s: exceeded maximum depth of %d", name, maxIncludeDepth)
+			}
+			depth++
+			defer func() { depth-- }()
+			buf := &limitedWriter{max: t.maxSize, aborted: &e.aborted}
+			err := tmpl.ExecuteTemplate(buf, name, data)
+			return string(buf.buf), err
+		},
+	})
+
+	out := &limitedWriter{max: t.maxSize, aborted: &e.aborted}
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("template panicked: %v", r)
+			}
+		}()
+		done <- tmpl.Execute(out, data)
+	}()
+
+	var timeout <-chan time.Time
+	if t.timeout > 0 {
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			return err
+		}
+	case <-timeout:
+		e.aborted.Store(true)
+		return ErrTimeout
+	}
+	_, err = w.Write(out.buf)
+	return err
+}
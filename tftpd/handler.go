@@ -2,27 +2,27 @@ package tftpd
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
-	"net/url"
 	"os"
-	"strconv"
-	"strings"
-	"text/template"
 
+	"github.com/DSpeichert/netbootd/archive"
+	"github.com/DSpeichert/netbootd/cache"
+	"github.com/DSpeichert/netbootd/checksum"
+	"github.com/DSpeichert/netbootd/initrd"
 	mfest "github.com/DSpeichert/netbootd/manifest"
 	"github.com/DSpeichert/netbootd/static"
-	"github.com/Masterminds/sprig/v3"
-	"github.com/pin/tftp"
+	"github.com/DSpeichert/netbootd/upstream"
 )
 
-func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
-	raddr := rf.(tftp.OutgoingTransfer).RemoteAddr() // net.UDPAddr
-	laddr := rf.(tftp.RequestPacketInfo).LocalIP()
+func (server *Server) tftpReadHandler(filename string, rf *transfer) error {
+	raddr := rf.RemoteAddr() // net.UDPAddr
+	laddr := rf.LocalIP()
 
 	server.logger.Info().
 		Str("path", filename).
@@ -35,9 +35,11 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 			Str("path", filename).
 			Str("client", raddr.IP.String()).
 			Msg("no manifest for client")
-		return errors.New("no manifest for client: " + raddr.IP.String())
+		return fmt.Errorf("%w: no manifest for client %s", errNotFound, raddr.IP)
 	}
 
+	rf.SetOptions(manifest.TFTP)
+
 	if manifest.Ipxe {
 		f, err := static.Files.Open(filename)
 		if err == nil {
@@ -47,70 +49,155 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 				Str("path", filename).
 				Str("client", raddr.IP.String()).
 				Int64("sent", n).
+				EmbedObject(rf.Stats()).
+				Msg("transfer finished")
+			return nil
+		}
+	}
+
+	if manifest.Grub {
+		f, err := server.grub.Open(filename)
+		if err == nil {
+			defer f.Close()
+			n, err := rf.ReadFrom(f)
+			server.logger.Info().
+				Err(err).
+				Str("path", filename).
+				Str("client", raddr.IP.String()).
+				Int64("sent", n).
+				EmbedObject(rf.Stats()).
 				Msg("transfer finished")
 			return nil
 		}
 	}
 
 	mount, err := manifest.GetMount(filename)
-	if err != nil {
+	if errors.Is(err, mfest.ErrNotServed) {
+		server.logger.Debug().
+			Str("path", filename).
+			Str("client", raddr.IP.String()).
+			Msg("configuration lookup not served")
+		return err
+	} else if err != nil {
 		server.logger.Error().
 			Err(err).
 			Str("path", filename).
 			Str("client", raddr.IP.String()).
 			Msg("cannot find mount")
-		return err
+		return fmt.Errorf("%w: %v", errNotFound, err)
 	}
 
 	server.logger.Trace().
 		Interface("mount", mount).
 		Msg("found mount")
 
-	if mount.Proxy != "" {
-		url := mount.Proxy
-		if mount.AppendSuffix {
-			url = url + strings.TrimPrefix(filename, mount.Path)
-		}
+	verifier := checksum.New(mount)
+	data := server.renderer.Context(manifest, mount, "tftp", filename, laddr, raddr.IP)
 
-		req, err := http.NewRequest("GET", url, nil)
+	if mount.Redirect != "" {
+		// TFTP clients can't be redirected, the target is proxied for them instead
+		mount.Proxy, err = server.renderer.Redirect(mount, data)
 		if err != nil {
 			server.logger.Error().
 				Err(err).
-				Msg("http request setup failed")
+				Msg("failed to render redirect for mount")
 			return err
 		}
-		req.Header.Add("X-Forwarded-For", raddr.IP.String())
-		req.Header.Add("X-TFTP-Port", fmt.Sprintf("%d", raddr.Port))
-		req.Header.Add("X-TFTP-File", filename)
-		resp, err := server.httpClient.Do(req)
+	}
+
+	if mount.Proxy != "" {
+		// responses of mirrors are cached and spooled under the URL at Proxy, as their content is the same
+		url := mount.ProxyURL(mount.Proxy, filename)
+
+		header, err := server.renderer.Headers(mount, data)
 		if err != nil {
 			server.logger.Error().
 				Err(err).
-				Msg("http request setup failed")
+				Msg("failed to render proxy headers for mount")
 			return err
 		}
-		defer resp.Body.Close()
 
-		if resp.StatusCode == http.StatusNotFound {
-			server.logger.Error().
-				Str("url", url).
-				Str("status", resp.Status).
-				Str("path", filename).
-				Str("client", raddr.IP.String()).
-				Msg("upstream: not found")
-			return errors.New("file not found")
-		} else if resp.StatusCode != http.StatusOK {
-			server.logger.Error().
-				Msgf("http request returned status %s", resp.Status)
-			return fmt.Errorf("HTTP request error: %s", resp.Status)
+		key := cache.Key{URL: url, Variant: upstream.Variant(mount, header)}
+
+		var body io.Reader
+		if mount.Cache && server.cache != nil {
+			obj, err := server.cache.Get(key, mount.CacheTTL, func(validators http.Header) (*http.Response, error) {
+				return server.proxyRequest(mount, filename, raddr, header, validators)
+			})
+			var serr *cache.StatusError
+			if errors.As(err, &serr) && serr.StatusCode == http.StatusNotFound {
+				server.logger.Error().
+					Str("url", url).
+					Str("status", serr.Status).
+					Str("path", filename).
+					Str("client", raddr.IP.String()).
+					Msg("upstream: not found")
+				return errNotFound
+			} else if err != nil {
+				server.logger.Error().
+					Err(err).
+					Str("url", url).
+					Msg("cannot get cached upstream response")
+				return err
+			}
+			defer obj.Close()
+
+			if verifier != nil {
+				if err := verifier.VerifyFile(obj.File); err != nil {
+					server.logChecksumFailure(err, filename, raddr)
+					return err
+				}
+			}
+
+			rf.SetSize(obj.Size)
+			body = obj
+		} else if mount.Spool {
+			e, err := server.spool.get(key, func() (io.ReadCloser, error) {
+				resp, err := server.proxyGet(mount, filename, raddr, header)
+				if err != nil {
+					return nil, err
+				}
+				return resp.Body, nil
+			})
+			if err != nil {
+				return err
+			}
+			defer e.release()
+
+			if verifier != nil {
+				if err := verifier.VerifyReader(e.Reader()); err != nil {
+					server.logChecksumFailure(err, filename, raddr)
+					return err
+				}
+			}
+
+			rf.SetSize(e.Size())
+			body = e.Reader()
+		} else {
+			resp, err := server.proxyGet(mount, filename, raddr, header)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			// Use ContentLength, if provided, to set TSize option
+			if resp.ContentLength >= 0 {
+				rf.SetSize(resp.ContentLength)
+			}
+			body = resp.Body
+			if verifier != nil {
+				// the final block is not sent unless the content matches
+				body = verifier.Reader(resp.Body, func(err error) {
+					server.logChecksumFailure(err, filename, raddr)
+				})
+			}
 		}
 
-		// Use ContentLength, if provided, to set TSize option
-		if resp.ContentLength >= 0 {
-			rf.(tftp.OutgoingTransfer).SetSize(resp.ContentLength)
+		if body, err = server.appendInitrdOverlay(rf, mount, data, body); err != nil {
+			return err
 		}
 
-		n, err := rf.ReadFrom(resp.Body)
+		n, err := rf.ReadFrom(body)
 		if err != nil {
 			server.logger.Error().
 				Msgf("ReadFrom failed: %v", err)
@@ -123,42 +210,49 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 			Str("url", url).
 			Str("client", raddr.IP.String()).
 			Int64("sent", n).
+			EmbedObject(rf.Stats()).
 			Msg("transfer finished")
 	} else if mount.Content != "" {
-		tmpl, err := template.New("").Funcs(sprig.TxtFuncMap()).Parse(mount.Content)
+		content, err := server.renderer.Content(mount, data)
 		if err != nil {
 			server.logger.Error().
 				Err(err).
-				Msg("failed to parse content template for mount")
+				Msg("failed to render content template for mount")
 			return err
 		}
+		buf := bytes.NewReader(content)
 
-		buf := new(bytes.Buffer)
+		rf.SetSize(buf.Size())
 
-		err = tmpl.Execute(buf, mfest.ContentContext{
-			LocalIP:  laddr,
-			RemoteIP: raddr.IP,
-			HttpBaseUrl: &url.URL{
-				Scheme: "http",
-				Host:   net.JoinHostPort(laddr.String(), strconv.Itoa(server.store.GlobalHints.HttpPort)),
-			},
-			ApiBaseUrl: &url.URL{
-				Scheme: "http",
-				Host:   net.JoinHostPort(laddr.String(), strconv.Itoa(server.store.GlobalHints.ApiPort)),
-			},
-			SyslogHost: net.JoinHostPort(laddr.String(), strconv.Itoa(server.store.GlobalHints.SyslogPort)),
-			Manifest:   manifest,
-		})
+		n, err := rf.ReadFrom(buf)
 		if err != nil {
 			server.logger.Error().
-				Err(err).
-				Msg("failed to parse content template for mount")
+				Msgf("ReadFrom failed: %v", err)
 			return err
 		}
 
-		rf.(tftp.OutgoingTransfer).SetSize(int64(buf.Len()))
+		server.logger.Info().
+			Err(err).
+			Str("path", filename).
+			Str("client", raddr.IP.String()).
+			Int64("sent", n).
+			EmbedObject(rf.Stats()).
+			Msg("transfer finished")
+	} else if mount.Exec != nil {
+		out, err := server.programs.Run(context.Background(), *mount.Exec, data)
+		if err != nil {
+			server.logger.Error().
+				Err(err).
+				Str("path", filename).
+				Str("client", raddr.IP.String()).
+				Msg("program of exec mount failed")
+			// details may be sensitive, they are logged only
+			return errors.New("program failed")
+		}
 
-		n, err := rf.ReadFrom(buf)
+		rf.SetSize(int64(len(out)))
+
+		n, err := rf.ReadFrom(bytes.NewReader(out))
 		if err != nil {
 			server.logger.Error().
 				Msgf("ReadFrom failed: %v", err)
@@ -170,6 +264,7 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 			Str("path", filename).
 			Str("client", raddr.IP.String()).
 			Int64("sent", n).
+			EmbedObject(rf.Stats()).
 			Msg("transfer finished")
 	} else if mount.LocalDir != "" {
 		path := mount.HostPath(server.rootPath, filename)
@@ -190,6 +285,7 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 
 			return err
 		}
+		defer f.Close()
 
 		stat, err := f.Stat()
 		if err != nil {
@@ -199,9 +295,21 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 			return err
 		}
 
-		rf.(tftp.OutgoingTransfer).SetSize(int64(stat.Size()))
+		if verifier != nil {
+			if err := verifier.VerifyFile(f); err != nil {
+				server.logChecksumFailure(err, filename, raddr)
+				return err
+			}
+		}
+
+		rf.SetSize(int64(stat.Size()))
+
+		body, err := server.appendInitrdOverlay(rf, mount, data, f)
+		if err != nil {
+			return err
+		}
 
-		n, err := rf.ReadFrom(f)
+		n, err := rf.ReadFrom(body)
 		if err != nil {
 			server.logger.Error().
 				Msgf("ReadFrom failed: %v", err)
@@ -213,6 +321,99 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 			Str("path", filename).
 			Str("client", raddr.IP.String()).
 			Int64("sent", n).
+			EmbedObject(rf.Stats()).
+			Msg("transfer finished")
+	} else if mount.ISO != "" || mount.Archive != "" {
+		arc, err := archive.Load(mount.ArchivePath(server.rootPath))
+		if err != nil {
+			server.logger.Error().
+				Err(err).
+				Str("archive", mount.ArchivePath(server.rootPath)).
+				Msg("cannot load archive")
+			return err
+		}
+
+		f, err := arc.Open(mount.MemberPath(filename))
+		if err != nil {
+			server.logger.Error().
+				Err(err).
+				Msgf("Could not get file from archive: %q", filename)
+			return err
+		}
+		defer f.Close()
+
+		rf.SetSize(f.Size)
+
+		body, err := server.appendInitrdOverlay(rf, mount, data, f)
+		if err != nil {
+			return err
+		}
+
+		n, err := rf.ReadFrom(body)
+		if err != nil {
+			server.logger.Error().
+				Msgf("ReadFrom failed: %v", err)
+			return err
+		}
+
+		server.logger.Info().
+			Err(err).
+			Str("path", filename).
+			Str("archive", mount.ArchivePath(server.rootPath)).
+			Str("client", raddr.IP.String()).
+			Int64("sent", n).
+			EmbedObject(rf.Stats()).
+			Msg("transfer finished")
+	} else if mount.Blob != "" {
+		if server.blobs == nil {
+			err := errors.New("blob store is disabled")
+			server.logger.Error().
+				Err(err).
+				Str("path", filename).
+				Str("mount", mount.Path).
+				Msg("blob mount requires blob store")
+			return err
+		}
+
+		f, err := server.blobs.Open(mount.BlobDigest())
+		if err != nil {
+			server.logger.Error().
+				Err(err).
+				Str("blob", mount.Blob).
+				Msgf("Could not get blob: %q", filename)
+			return err
+		}
+		defer f.Close()
+
+		stat, err := f.Stat()
+		if err != nil {
+			server.logger.Error().
+				Err(err).
+				Msgf("Could not stat blob: %q", mount.Blob)
+			return err
+		}
+
+		rf.SetSize(stat.Size())
+
+		body, err := server.appendInitrdOverlay(rf, mount, data, f)
+		if err != nil {
+			return err
+		}
+
+		n, err := rf.ReadFrom(body)
+		if err != nil {
+			server.logger.Error().
+				Msgf("ReadFrom failed: %v", err)
+			return err
+		}
+
+		server.logger.Info().
+			Err(err).
+			Str("path", filename).
+			Str("blob", mount.Blob).
+			Str("client", raddr.IP.String()).
+			Int64("sent", n).
+			EmbedObject(rf.Stats()).
 			Msg("transfer finished")
 	} else {
 		// mount has neither .Path nor .Proxy defined
@@ -226,3 +427,87 @@ func (server *Server) tftpReadHandler(filename string, rf io.ReaderFrom) error {
 
 	return nil
 }
+
+// proxyRequest requests filename from upstreams of mount on behalf of a TFTP client, failing over between them.
+// Additional request headers can be passed in headers.
+func (server *Server) proxyRequest(mount mfest.Mount, filename string, raddr net.UDPAddr, headers ...http.Header) (*http.Response, error) {
+	return server.upstreams.Get(mount, func(base string) (*http.Request, error) {
+		req, err := http.NewRequest("GET", mount.ProxyURL(base, filename), nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, header := range headers {
+			for name, values := range header {
+				req.Header[name] = values
+			}
+		}
+		req.Header.Add("X-Forwarded-For", raddr.IP.String())
+		req.Header.Add("X-TFTP-Port", fmt.Sprintf("%d", raddr.Port))
+		req.Header.Add("X-TFTP-File", filename)
+		return req, nil
+	})
+}
+
+// proxyGet requests filename from upstreams of mount on behalf of a TFTP client.
+// The response body must be closed by the caller unless an error is returned.
+func (server *Server) proxyGet(mount mfest.Mount, filename string, raddr net.UDPAddr, header http.Header) (*http.Response, error) {
+	resp, err := server.proxyRequest(mount, filename, raddr, header)
+	if err != nil {
+		server.logger.Error().
+			Err(err).
+			Msg("http request failed")
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		server.logger.Error().
+			Str("url", resp.Request.URL.String()).
+			Str("status", resp.Status).
+			Str("path", filename).
+			Str("client", raddr.IP.String()).
+			Msg("upstream: not found")
+		return nil, errNotFound
+	} else if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		server.logger.Error().
+			Msgf("http request returned status %s", resp.Status)
+		return nil, fmt.Errorf("HTTP request error: %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+// appendInitrdOverlay appends the initrd overlay of mount, if there is one, to body of the size set on rf,
+// and updates the size accordingly.
+func (server *Server) appendInitrdOverlay(rf *transfer, mount mfest.Mount, data mfest.ContentContext, body io.Reader) (io.Reader, error) {
+	if len(mount.InitrdOverlay) == 0 {
+		return body, nil
+	}
+	overlay, err := server.renderer.InitrdOverlay(mount, data)
+	if err != nil {
+		server.logger.Error().
+			Err(err).
+			Msg("failed to generate initrd overlay for mount")
+		return nil, err
+	}
+	body, size := initrd.Append(body, rf.size, overlay)
+	rf.SetSize(size)
+	return body, nil
+}
+
+// logChecksumFailure logs content that could not be verified against the checksum pinned on its mount.
+func (server *Server) logChecksumFailure(err error, filename string, raddr net.UDPAddr) {
+	event := server.logger.Error().
+		Err(err).
+		Str("path", filename).
+		Str("client", raddr.IP.String())
+	var cerr *checksum.Error
+	if errors.As(err, &cerr) {
+		event.Str("expected", cerr.Expected).
+			Str("actual", cerr.Actual).
+			Msg("checksum mismatch, refusing to serve content")
+		return
+	}
+	event.Msg("checksum verification failed")
+}
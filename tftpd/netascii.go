@@ -0,0 +1,50 @@
+package tftpd
+
+import (
+	"bufio"
+	"io"
+)
+
+// netasciiReader converts bytes read from the underlying reader to netascii,
+// i.e. LF becomes CR LF and CR becomes CR NUL.
+type netasciiReader struct {
+	r *bufio.Reader
+	// second byte of a translated pair that did not fit into the last Read
+	pending    byte
+	hasPending bool
+}
+
+func newNetasciiReader(r io.Reader) io.Reader {
+	return &netasciiReader{r: bufio.NewReader(r)}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		if n.hasPending {
+			p[i] = n.pending
+			n.hasPending = false
+			i++
+			continue
+		}
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if i > 0 {
+				return i, nil
+			}
+			return 0, err
+		}
+		switch c {
+		case '\n':
+			p[i] = '\r'
+			n.pending, n.hasPending = '\n', true
+		case '\r':
+			p[i] = '\r'
+			n.pending, n.hasPending = 0, true
+		default:
+			p[i] = c
+		}
+		i++
+	}
+	return i, nil
+}
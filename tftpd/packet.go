@@ -0,0 +1,137 @@
+package tftpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	opRRQ   = uint16(1) // Read request (RRQ)
+	opWRQ   = uint16(2) // Write request (WRQ)
+	opDATA  = uint16(3) // Data
+	opACK   = uint16(4) // Acknowledgement
+	opERROR = uint16(5) // Error
+	opOACK  = uint16(6) // Options Acknowledgment (RFC 2347)
+)
+
+// Error codes as defined in RFC 1350.
+const (
+	errCodeNotDefined = uint16(0)
+	errCodeNotFound   = uint16(1)
+	errCodeAccess     = uint16(2)
+	errCodeUnknownTID = uint16(5)
+)
+
+const (
+	defaultBlockSize = 512
+	minBlockSize     = 8     // RFC 2348
+	maxBlockSize     = 65464 // RFC 2348
+	maxWindowSize    = 65535 // RFC 7440
+	maxDatagram      = maxBlockSize + 4
+)
+
+// request is a parsed RRQ or WRQ packet.
+type request struct {
+	op       uint16
+	filename string
+	mode     string
+	// option names are lowercased, as they are case-insensitive
+	options map[string]string
+	// order in which the client listed options, used when building OACK
+	order []string
+}
+
+func isRequest(p []byte) bool {
+	if len(p) < 2 {
+		return false
+	}
+	op := binary.BigEndian.Uint16(p)
+	return op == opRRQ || op == opWRQ
+}
+
+func parseRequest(p []byte) (*request, error) {
+	if len(p) < 4 {
+		return nil, errors.New("short request packet")
+	}
+	op := binary.BigEndian.Uint16(p)
+	if op != opRRQ && op != opWRQ {
+		return nil, fmt.Errorf("unexpected opcode: %d", op)
+	}
+	fields := bytes.Split(p[2:], []byte{0})
+	// a well-formed request ends with NUL, so the last field is always empty
+	if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+		return nil, errors.New("malformed request packet")
+	}
+	fields = fields[:len(fields)-1]
+
+	req := &request{
+		op:       op,
+		filename: string(fields[0]),
+		mode:     strings.ToLower(string(fields[1])),
+		options:  make(map[string]string),
+	}
+	for i := 2; i+1 < len(fields); i += 2 {
+		name := strings.ToLower(string(fields[i]))
+		if _, ok := req.options[name]; !ok {
+			req.order = append(req.order, name)
+		}
+		req.options[name] = string(fields[i+1])
+	}
+	return req, nil
+}
+
+func packOACK(names []string, values map[string]string) []byte {
+	p := make([]byte, 2, 64)
+	binary.BigEndian.PutUint16(p, opOACK)
+	for _, name := range names {
+		p = append(p, name...)
+		p = append(p, 0)
+		p = append(p, values[name]...)
+		p = append(p, 0)
+	}
+	return p
+}
+
+func packERROR(code uint16, message string) []byte {
+	p := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(p, opERROR)
+	binary.BigEndian.PutUint16(p[2:], code)
+	p = append(p, message...)
+	return append(p, 0)
+}
+
+// packDATA writes the DATA header in front of payload, which must start at p[4:].
+func packDATA(p []byte, block uint16) {
+	binary.BigEndian.PutUint16(p, opDATA)
+	binary.BigEndian.PutUint16(p[2:], block)
+}
+
+// parseAck returns the block number of ACK packet, or an error if the client
+// sent an ERROR packet instead.
+func parseAck(p []byte) (block uint16, err error) {
+	if len(p) < 4 {
+		return 0, errors.New("short packet")
+	}
+	switch op := binary.BigEndian.Uint16(p); op {
+	case opACK:
+		return binary.BigEndian.Uint16(p[2:]), nil
+	case opERROR:
+		msg := string(bytes.TrimRight(p[4:], "\x00"))
+		return 0, &clientError{code: binary.BigEndian.Uint16(p[2:]), message: msg}
+	default:
+		return 0, fmt.Errorf("unexpected opcode: %d", op)
+	}
+}
+
+// clientError is returned when the client aborts a transfer with an ERROR packet.
+type clientError struct {
+	code    uint16
+	message string
+}
+
+func (e *clientError) Error() string {
+	return fmt.Sprintf("client error: code=%d, message: %s", e.code, e.message)
+}
@@ -1,37 +1,170 @@
 package tftpd
 
 import (
+	"errors"
 	"net"
-	"net/http"
 
+	"github.com/DSpeichert/netbootd/blob"
+	"github.com/DSpeichert/netbootd/cache"
+	"github.com/DSpeichert/netbootd/grub"
+	mfest "github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/program"
+	"github.com/DSpeichert/netbootd/render"
 	"github.com/DSpeichert/netbootd/store"
-	"github.com/pin/tftp"
+	"github.com/DSpeichert/netbootd/upstream"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/net/ipv4"
 )
 
+type Config struct {
+	// Transfer parameter defaults, each can be overridden by a manifest.
+	Transfer mfest.TFTPOptions
+
+	// SinglePort serves all transfers from the listening socket instead of an ephemeral port per transfer,
+	// so that only the listening port has to be reachable through firewalls and NAT.
+	SinglePort bool
+
+	// Proxy mounts with spooling enabled keep responses up to SpoolMemoryMax bytes in memory,
+	// larger ones are written to a temporary file in SpoolDir (system default if empty).
+	SpoolMemoryMax int64
+	SpoolDir       string
+}
+
+// Deps are the services mounts of manifests are served with.
+type Deps struct {
+	// Cache of proxy mounts, nil if caching is disabled.
+	Cache     *cache.Cache
+	Upstreams *upstream.Pool
+	Programs  *program.Runner
+	// Blobs is nil if the blob store is disabled.
+	Blobs    *blob.Store
+	Renderer *render.Renderer
+	Grub     *grub.Loader
+}
+
 type Server struct {
-	httpClient *http.Client
-	tftpServer *tftp.Server
+	logger    zerolog.Logger
+	store     *store.Store
+	rootPath  string
+	config    Config
+	cache     *cache.Cache
+	upstreams *upstream.Pool
+	programs  *program.Runner
+	blobs     *blob.Store
+	renderer  *render.Renderer
+	grub      *grub.Loader
 
-	logger   zerolog.Logger
-	store    *store.Store
-	rootPath string
+	// transfers in single-port mode
+	mux *mux
+
+	spool *spool
 }
 
-func NewServer(store *store.Store, rootPath string) (server *Server, err error) {
+func NewServer(store *store.Store, rootPath string, deps Deps, cfg Config) (server *Server, err error) {
 
 	server = &Server{
-		httpClient: &http.Client{},
-		logger:     log.With().Str("service", "tftp").Logger(),
-		store:      store,
-		rootPath:   rootPath,
+		logger:    log.With().Str("service", "tftp").Logger(),
+		store:     store,
+		rootPath:  rootPath,
+		config:    cfg,
+		cache:     deps.Cache,
+		upstreams: deps.Upstreams,
+		programs:  deps.Programs,
+		blobs:     deps.Blobs,
+		renderer:  deps.Renderer,
+		grub:      deps.Grub,
+		mux:       newMux(),
+		spool:     newSpool(cfg.SpoolMemoryMax, cfg.SpoolDir),
 	}
 
 	return server, nil
 }
 
 func (server *Server) Serve(conn *net.UDPConn) {
-	server.tftpServer = tftp.NewServer(server.tftpReadHandler, nil)
-	_ = server.tftpServer.Serve(conn)
+	pc := ipv4.NewPacketConn(conn)
+	// destination address and interface are needed to reply from the right address with the right block size
+	if err := pc.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+		server.logger.Warn().
+			Err(err).
+			Msg("cannot set control message, local address will be unknown")
+	}
+
+	buf := make([]byte, maxDatagram)
+	for {
+		n, cm, peer, err := pc.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			server.logger.Error().
+				Err(err).
+				Msg("error reading from connection")
+			continue
+		}
+		p := make([]byte, n)
+		copy(p, buf[:n])
+		raddr := peer.(*net.UDPAddr)
+
+		if !server.config.SinglePort {
+			go server.handleRequest(p, cm, raddr, nil)
+			continue
+		}
+		if server.mux.deliver(raddr, p) {
+			continue
+		}
+		if !isRequest(p) {
+			// most likely a late packet of a finished transfer
+			continue
+		}
+		var laddr net.IP
+		if cm != nil {
+			laddr = cm.Dst
+		}
+		go server.handleRequest(p, cm, raddr, server.mux.open(pc, laddr, raddr))
+	}
+}
+
+// handleRequest serves a single request. A transfer socket is opened unless c is provided.
+func (server *Server) handleRequest(p []byte, cm *ipv4.ControlMessage, raddr *net.UDPAddr, c conn) {
+	var laddr net.IP
+	mtuBlockSize := 0
+	if cm != nil {
+		laddr = cm.Dst
+		if ifi, err := net.InterfaceByIndex(cm.IfIndex); err == nil {
+			// MTU - IPv4 header - UDP header - TFTP header
+			mtuBlockSize = ifi.MTU - 20 - 8 - 4
+		}
+	}
+
+	if c == nil {
+		var err error
+		c, err = newUDPConn(laddr, raddr)
+		if err != nil {
+			server.logger.Error().
+				Err(err).
+				Str("client", raddr.String()).
+				Msg("cannot open transfer socket")
+			return
+		}
+	}
+	defer c.close()
+
+	req, err := parseRequest(p)
+	if err != nil {
+		server.logger.Debug().
+			Err(err).
+			Str("client", raddr.String()).
+			Msg("ignoring invalid packet")
+		return
+	}
+
+	if req.op == opWRQ {
+		_ = c.send(packERROR(errCodeAccess, "write requests are not supported"))
+		return
+	}
+
+	t := newTransfer(c, req, raddr, laddr, server.config.Transfer, mtuBlockSize)
+	if err := server.tftpReadHandler(req.filename, t); err != nil {
+		t.abort(err)
+	}
 }
@@ -0,0 +1,97 @@
+package tftpd
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// muxQueueLength is the number of datagrams queued per transfer in single-port mode.
+const muxQueueLength = 16
+
+// mux dispatches datagrams received on the listening socket to transfers in single-port mode,
+// where all transfers share the socket instead of using an ephemeral port each.
+// Transfers are keyed by client address and port.
+type mux struct {
+	mutex sync.Mutex
+	conns map[string]*muxConn
+}
+
+func newMux() *mux {
+	return &mux{
+		conns: make(map[string]*muxConn),
+	}
+}
+
+// deliver passes p to the transfer of raddr and reports whether such transfer exists.
+func (m *mux) deliver(raddr *net.UDPAddr, p []byte) bool {
+	m.mutex.Lock()
+	c, ok := m.conns[raddr.String()]
+	m.mutex.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case c.ch <- p:
+	default:
+		// transfer is not keeping up, treat as packet loss rather than blocking all transfers
+	}
+	return true
+}
+
+// open registers a new transfer of raddr, replies are sent from laddr if known.
+func (m *mux) open(pc *ipv4.PacketConn, laddr net.IP, raddr *net.UDPAddr) *muxConn {
+	c := &muxConn{
+		mux:    m,
+		pc:     pc,
+		remote: raddr,
+		ch:     make(chan []byte, muxQueueLength),
+	}
+	if laddr != nil {
+		c.cm = &ipv4.ControlMessage{Src: laddr}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.conns[raddr.String()] = c
+	return c
+}
+
+func (m *mux) remove(c *muxConn) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.conns[c.remote.String()] == c {
+		delete(m.conns, c.remote.String())
+	}
+}
+
+// muxConn is a conn sharing the listening socket with other transfers.
+type muxConn struct {
+	mux    *mux
+	pc     *ipv4.PacketConn
+	cm     *ipv4.ControlMessage
+	remote *net.UDPAddr
+	ch     chan []byte
+}
+
+func (c *muxConn) send(p []byte) error {
+	_, err := c.pc.WriteTo(p, c.cm, c.remote)
+	return err
+}
+
+func (c *muxConn) receive(p []byte, timeout time.Duration) (int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case data := <-c.ch:
+		return copy(p, data), nil
+	case <-timer.C:
+		return 0, errTimeout
+	}
+}
+
+func (c *muxConn) close() {
+	c.mux.remove(c)
+}
@@ -0,0 +1,174 @@
+package tftpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	mfest "github.com/DSpeichert/netbootd/manifest"
+	"github.com/DSpeichert/netbootd/static"
+	"github.com/DSpeichert/netbootd/store"
+	"golang.org/x/net/ipv4"
+)
+
+// startServer serves TFTP on the loopback interface to a manifest of 127.0.0.1 with iPXE enabled,
+// returning the listening address.
+func startServer(t *testing.T, cfg Config) (*Server, *net.UDPAddr) {
+	t.Helper()
+	s, err := store.NewStore(store.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := mfest.ManifestFromYaml([]byte("id: local\nipv4: 127.0.0.1/8\nipxe: true\n"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutManifest(m); err != nil {
+		t.Fatal(err)
+	}
+	server, err := NewServer(s, "", Deps{}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go server.Serve(conn)
+	return server, conn.LocalAddr().(*net.UDPAddr)
+}
+
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn}
+}
+
+func TestSinglePort(t *testing.T) {
+	server, addr := startServer(t, Config{SinglePort: true})
+	f, err := static.Files.Open("undionly.kpxe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two transfers interleaved block by block, both from the listening port
+	clients := []*testClient{newTestClient(t), newTestClient(t)}
+	got := make([][]byte, len(clients))
+	done := make([]bool, len(clients))
+	for _, c := range clients {
+		if _, err := c.conn.WriteToUDP(rrq("undionly.kpxe", "octet"), addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for finished := 0; finished < len(clients); {
+		for i, c := range clients {
+			if done[i] {
+				continue
+			}
+			p := c.receive(5 * time.Second)
+			if op := binary.BigEndian.Uint16(p); op != opDATA || c.server.String() != addr.String() {
+				t.Fatalf("client %d got opcode %d from %s, want DATA from %s", i, op, c.server, addr)
+			}
+			if int(blockNumber(p)) != len(got[i])/defaultBlockSize+1 {
+				t.Fatalf("client %d got block %d after %d bytes", i, blockNumber(p), len(got[i]))
+			}
+			got[i] = append(got[i], p[4:]...)
+			c.ack(blockNumber(p))
+			if len(p)-4 < defaultBlockSize {
+				done[i] = true
+				finished++
+			}
+		}
+	}
+	for i := range got {
+		if !bytes.Equal(got[i], want) {
+			t.Errorf("client %d got %d bytes, want %d", i, len(got[i]), len(want))
+		}
+	}
+
+	// finished transfers are removed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		server.mux.mutex.Lock()
+		n := len(server.mux.conns)
+		server.mux.mutex.Unlock()
+		if n == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("%d transfers left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// packets of unknown clients other than requests are ignored, requests still served
+	c := newTestClient(t)
+	c.server = addr
+	c.ack(1)
+	if p, ok := c.tryReceive(200 * time.Millisecond); ok {
+		t.Fatalf("got %q for ACK of unknown transfer", p)
+	}
+	if _, err := c.conn.WriteToUDP(rrq("missing", "octet"), addr); err != nil {
+		t.Fatal(err)
+	}
+	if p := c.receive(5 * time.Second); binary.BigEndian.Uint16(p) != opERROR || c.server.String() != addr.String() {
+		t.Errorf("got %q from %s, want ERROR", p, c.server)
+	}
+}
+
+func TestMux(t *testing.T) {
+	m := newMux()
+	raddr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 10), Port: 2000}
+	if m.deliver(raddr, []byte("early")) {
+		t.Error("delivered to unknown transfer")
+	}
+
+	var pc *ipv4.PacketConn
+	c := m.open(pc, nil, raddr)
+	// another port of the same client is another transfer
+	if m.deliver(&net.UDPAddr{IP: raddr.IP, Port: 2001}, []byte("other")) {
+		t.Error("delivered to transfer of another port")
+	}
+
+	// a transfer not keeping up loses packets beyond its queue, without blocking others
+	for i := 0; i < muxQueueLength+1; i++ {
+		if !m.deliver(raddr, []byte{byte(i)}) {
+			t.Fatal("not delivered to open transfer")
+		}
+	}
+	buf := make([]byte, 10)
+	for i := 0; i < muxQueueLength; i++ {
+		if n, err := c.receive(buf, time.Second); err != nil || n != 1 || buf[0] != byte(i) {
+			t.Fatalf("received %v, %v, want [%d]", buf[:n], err, i)
+		}
+	}
+	if _, err := c.receive(buf, 10*time.Millisecond); err != errTimeout {
+		t.Errorf("received dropped packet: %v", err)
+	}
+
+	// a new transfer of the same client replaces the old one, which doesn't remove it when closed
+	next := m.open(pc, nil, raddr)
+	c.close()
+	if !m.deliver(raddr, []byte("new")) {
+		t.Fatal("new transfer removed")
+	}
+	if n, err := next.receive(buf, time.Second); err != nil || string(buf[:n]) != "new" {
+		t.Errorf("received %q, %v", buf[:n], err)
+	}
+	next.close()
+	if m.deliver(raddr, []byte("late")) {
+		t.Error("delivered to closed transfer")
+	}
+}
@@ -0,0 +1,156 @@
+package tftpd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/DSpeichert/netbootd/cache"
+)
+
+// spool buffers upstream responses before they are sent over TFTP.
+// This provides an exact tsize even when upstream does not send Content-Length, and decouples
+// upstream latency from TFTP timing. Responses are kept in memory up to memoryMax bytes, then on disk.
+// Concurrent requests for the same URL, with the same rendered headers and credentials,
+// share a single entry and upstream request.
+type spool struct {
+	mutex   sync.Mutex
+	entries map[cache.Key]*spoolEntry
+
+	memoryMax int64
+	dir       string
+}
+
+func newSpool(memoryMax int64, dir string) *spool {
+	return &spool{
+		entries:   make(map[cache.Key]*spoolEntry),
+		memoryMax: memoryMax,
+		dir:       dir,
+	}
+}
+
+type spoolEntry struct {
+	spool *spool
+	key   cache.Key
+	refs  int
+
+	// closed when the entry is filled or failed
+	ready chan struct{}
+	err   error
+
+	data []byte
+	file *os.File
+	size int64
+}
+
+// get returns the spooled response for key, calling fetch to obtain it unless another request is already doing so.
+// The entry must be released once it's no longer used.
+func (s *spool) get(key cache.Key, fetch func() (io.ReadCloser, error)) (*spoolEntry, error) {
+	s.mutex.Lock()
+	e, ok := s.entries[key]
+	if ok {
+		e.refs++
+		s.mutex.Unlock()
+		<-e.ready
+		if e.err != nil {
+			e.release()
+			return nil, e.err
+		}
+		return e, nil
+	}
+	e = &spoolEntry{
+		spool: s,
+		key:   key,
+		refs:  1,
+		ready: make(chan struct{}),
+	}
+	s.entries[key] = e
+	s.mutex.Unlock()
+
+	e.err = e.fill(fetch)
+	if e.err != nil {
+		// let subsequent requests try again
+		s.mutex.Lock()
+		if s.entries[key] == e {
+			delete(s.entries, key)
+		}
+		s.mutex.Unlock()
+	}
+	close(e.ready)
+
+	if e.err != nil {
+		e.release()
+		return nil, e.err
+	}
+	return e, nil
+}
+
+func (e *spoolEntry) fill(fetch func() (io.ReadCloser, error)) error {
+	body, err := fetch()
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	buf := new(bytes.Buffer)
+	n, err := io.CopyN(buf, body, e.spool.memoryMax+1)
+	if err == io.EOF {
+		e.data = buf.Bytes()
+		e.size = n
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// response does not fit into memory
+	f, err := os.CreateTemp(e.spool.dir, "netbootd-spool-")
+	if err != nil {
+		return err
+	}
+	// the file stays accessible through the open descriptor
+	_ = os.Remove(f.Name())
+
+	if _, err = buf.WriteTo(f); err == nil {
+		_, err = io.Copy(f, body)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	e.file = f
+	e.size = stat.Size()
+	return nil
+}
+
+// Size returns the size of the spooled response.
+func (e *spoolEntry) Size() int64 {
+	return e.size
+}
+
+// Reader returns a new reader of the spooled response.
+func (e *spoolEntry) Reader() io.ReadSeeker {
+	if e.file != nil {
+		return io.NewSectionReader(e.file, 0, e.size)
+	}
+	return bytes.NewReader(e.data)
+}
+
+func (e *spoolEntry) release() {
+	e.spool.mutex.Lock()
+	e.refs--
+	refs := e.refs
+	if refs == 0 && e.spool.entries[e.key] == e {
+		delete(e.spool.entries, e.key)
+	}
+	e.spool.mutex.Unlock()
+
+	if refs == 0 && e.file != nil {
+		e.file.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package tftpd
+
+import (
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/netbootd/cache"
+)
+
+func TestSpool(t *testing.T) {
+	s := newSpool(4, t.TempDir())
+	fetch := func(content string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) {
+			return io.NopCloser(strings.NewReader(content)), nil
+		}
+	}
+	read := func(e *spoolEntry) string {
+		t.Helper()
+		b, err := io.ReadAll(e.Reader())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// entries in use are shared by requests of the same key only
+	url := "http://upstream/vmlinuz"
+	keys := []cache.Key{{URL: url}, {URL: url, Variant: "host-1"}, {URL: url, Variant: "host-2"}}
+	var entries []*spoolEntry
+	for i, key := range keys {
+		// on disk beyond 4 bytes
+		content := strings.Repeat(key.Variant, i)
+		e, err := s.get(key, fetch(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+		if got := read(e); got != content || e.Size() != int64(len(content)) {
+			t.Errorf("%+v: got %q, size %d", key, got, e.Size())
+		}
+	}
+	for i, key := range keys {
+		e, err := s.get(key, fetch("refetched"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e != entries[i] {
+			t.Errorf("%+v: not shared", key)
+		}
+		e.release()
+	}
+
+	// released once unused
+	for _, e := range entries {
+		e.release()
+	}
+	if len(s.entries) != 0 {
+		t.Errorf("%d entries left", len(s.entries))
+	}
+}
+
+func TestSpoolConcurrent(t *testing.T) {
+	s := newSpool(1<<20, t.TempDir())
+	release := make(chan struct{})
+	var fetches int
+	fetch := func() (io.ReadCloser, error) {
+		fetches++
+		<-release
+		return io.NopCloser(strings.NewReader("content")), nil
+	}
+
+	got := make([]string, 5)
+	var wg sync.WaitGroup
+	for i := range got {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, err := s.get(cache.Key{URL: "http://upstream/a"}, fetch)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer e.release()
+			b, _ := io.ReadAll(e.Reader())
+			got[i] = string(b)
+		}()
+	}
+	for {
+		s.mutex.Lock()
+		e := s.entries[cache.Key{URL: "http://upstream/a"}]
+		waiting := e != nil && e.refs == len(got)
+		s.mutex.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	for i, content := range got {
+		if content != "content" {
+			t.Errorf("request %d got %q", i, content)
+		}
+	}
+	if fetches != 1 {
+		t.Errorf("%d fetches, want 1", fetches)
+	}
+}
@@ -0,0 +1,451 @@
+package tftpd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strconv"
+	"time"
+
+	mfest "github.com/DSpeichert/netbootd/manifest"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultTimeout    = 5 * time.Second
+	defaultRetries    = 5
+	defaultWindowSize = 16
+)
+
+var (
+	errTimeout = errors.New("timeout")
+	// errNotFound is returned by handlers for files that don't exist, reported to clients as such.
+	errNotFound = errors.New("file not found")
+)
+
+// conn is the transport of a single transfer, bound to a single client address.
+type conn interface {
+	send(p []byte) error
+	// receive waits for the next datagram from the client until timeout passes.
+	// It returns errTimeout if nothing arrives in time.
+	receive(p []byte, timeout time.Duration) (int, error)
+	close()
+}
+
+// TransferStats contains details about a single TFTP transfer.
+type TransferStats struct {
+	BlockSize   int
+	WindowSize  int
+	Bytes       int64
+	Datagrams   int
+	Retransmits int
+	Timeouts    int
+	Duration    time.Duration
+}
+
+// Throughput returns the average transfer rate in bytes per second.
+func (s TransferStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Duration.Seconds()
+}
+
+// MarshalZerologObject implements zerolog.LogObjectMarshaler.
+func (s TransferStats) MarshalZerologObject(e *zerolog.Event) {
+	e.Int("blksize", s.BlockSize).
+		Int("windowsize", s.WindowSize).
+		Int("datagrams", s.Datagrams).
+		Int("retransmits", s.Retransmits).
+		Int("timeouts", s.Timeouts).
+		Dur("duration", s.Duration).
+		Float64("throughput", s.Throughput())
+}
+
+// transfer is an outgoing (read request) transfer.
+// It negotiates RFC 2347 options (blksize, tsize, timeout, windowsize) when ReadFrom is called.
+type transfer struct {
+	conn    conn
+	request *request
+	remote  *net.UDPAddr
+	local   net.IP
+
+	// limits applied during option negotiation
+	options mfest.TFTPOptions
+	// largest blksize that fits the interface MTU, 0 if unknown
+	mtuBlockSize int
+	// transfer size, -1 if unknown
+	size int64
+
+	blockSize  int
+	windowSize int
+	timeout    time.Duration
+	retries    int
+
+	stats TransferStats
+}
+
+func newTransfer(c conn, req *request, remote *net.UDPAddr, local net.IP, options mfest.TFTPOptions, mtuBlockSize int) *transfer {
+	return &transfer{
+		conn:         c,
+		request:      req,
+		remote:       remote,
+		local:        local,
+		options:      options,
+		mtuBlockSize: mtuBlockSize,
+		size:         -1,
+	}
+}
+
+// RemoteAddr returns the remote peer's IP address and port.
+func (t *transfer) RemoteAddr() net.UDPAddr { return *t.remote }
+
+// LocalIP returns the IP address the request was received on, or nil if it could not be determined.
+func (t *transfer) LocalIP() net.IP { return t.local }
+
+// SetSize sets the size reported to the client with the tsize option (RFC 2349).
+// When the io.Reader passed to ReadFrom is an io.Seeker, the size is determined automatically.
+func (t *transfer) SetSize(n int64) {
+	t.size = n
+}
+
+// SetOptions overrides transfer parameter limits with non-zero values from o.
+// It must be called before ReadFrom.
+func (t *transfer) SetOptions(o mfest.TFTPOptions) {
+	if o.BlksizeMax != 0 {
+		t.options.BlksizeMax = o.BlksizeMax
+	}
+	if o.WindowsizeMax != 0 {
+		t.options.WindowsizeMax = o.WindowsizeMax
+	}
+	if o.Timeout != 0 {
+		t.options.Timeout = o.Timeout
+	}
+	if o.Retries != 0 {
+		t.options.Retries = o.Retries
+	}
+}
+
+// Stats returns statistics of the transfer, complete once ReadFrom returns.
+func (t *transfer) Stats() TransferStats {
+	return t.stats
+}
+
+// ReadFrom negotiates transfer options and sends everything read from r to the client.
+func (t *transfer) ReadFrom(r io.Reader) (n int64, err error) {
+	start := time.Now()
+	defer func() {
+		t.stats.Bytes = n
+		t.stats.Duration = time.Since(start)
+	}()
+
+	if t.request.mode == "netascii" {
+		// converted size is not known upfront
+		r = newNetasciiReader(r)
+		t.size = -1
+	} else if rs, ok := r.(io.Seeker); ok && t.size < 0 {
+		if t.size, err = seekerSize(rs); err != nil {
+			return 0, err
+		}
+	}
+
+	if err = t.negotiate(); err != nil {
+		return 0, err
+	}
+	return t.send(r)
+}
+
+func seekerSize(rs io.Seeker) (int64, error) {
+	pos, err := rs.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	end, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = rs.Seek(pos, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return end - pos, nil
+}
+
+// negotiate processes options requested by the client and sends an OACK if any were accepted.
+func (t *transfer) negotiate() error {
+	t.blockSize = defaultBlockSize
+	t.windowSize = 1
+	t.timeout = t.options.Timeout
+	if t.timeout <= 0 {
+		t.timeout = defaultTimeout
+	}
+	t.retries = t.options.Retries
+	if t.retries <= 0 {
+		t.retries = defaultRetries
+	}
+	windowSizeMax := t.options.WindowsizeMax
+	if windowSizeMax <= 0 {
+		windowSizeMax = defaultWindowSize
+	}
+
+	var accepted []string
+	values := make(map[string]string)
+	for _, name := range t.request.order {
+		value := t.request.options[name]
+		switch name {
+		case "blksize":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < minBlockSize {
+				continue
+			}
+			n = min(n, maxBlockSize)
+			if t.options.BlksizeMax > 0 {
+				n = min(n, t.options.BlksizeMax)
+			}
+			if t.mtuBlockSize > 0 {
+				n = min(n, t.mtuBlockSize)
+			}
+			t.blockSize = n
+			values[name] = strconv.Itoa(n)
+		case "windowsize":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > maxWindowSize {
+				continue
+			}
+			n = min(n, windowSizeMax)
+			t.windowSize = n
+			values[name] = strconv.Itoa(n)
+		case "timeout":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || n > 255 {
+				continue
+			}
+			t.timeout = time.Duration(n) * time.Second
+			values[name] = value
+		case "tsize":
+			if t.size < 0 {
+				continue
+			}
+			values[name] = strconv.FormatInt(t.size, 10)
+		default:
+			continue
+		}
+		accepted = append(accepted, name)
+	}
+
+	t.stats.BlockSize = t.blockSize
+	t.stats.WindowSize = t.windowSize
+
+	if len(accepted) == 0 {
+		return nil
+	}
+
+	// OACK is acknowledged with ACK of block 0
+	oack := packOACK(accepted, values)
+	buf := make([]byte, maxDatagram)
+	var deadline time.Time
+	for attempt := 0; ; {
+		if deadline.IsZero() {
+			if err := t.conn.send(oack); err != nil {
+				return err
+			}
+			t.stats.Datagrams++
+			deadline = time.Now().Add(t.timeout)
+		}
+		block, err := t.waitAck(buf, deadline)
+		if err == errTimeout {
+			t.stats.Timeouts++
+			if attempt++; attempt > t.retries {
+				return fmt.Errorf("%w waiting for OACK acknowledgement", errTimeout)
+			}
+			t.stats.Retransmits++
+			deadline = time.Time{}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if block == 0 {
+			return nil
+		}
+		// stale ACK, keep waiting until the deadline
+	}
+}
+
+// send transmits data in windows of t.windowSize blocks (RFC 7440).
+// A window of 1 is the classic lock-step transfer of RFC 1350.
+func (t *transfer) send(r io.Reader) (n int64, err error) {
+	var (
+		seq     uint64   // sequence number of the last block read, block numbers wrap around
+		window  [][]byte // blocks sent but not yet acknowledged, oldest first
+		free    [][]byte
+		sent    int // number of blocks in window already sent
+		retries int
+		eof     bool
+		// acknowledgement of the window is awaited until deadline, set whenever blocks are sent,
+		// so that stale ACKs can't keep the transfer alive
+		deadline time.Time
+	)
+	buf := make([]byte, maxDatagram)
+	for {
+		for len(window) < t.windowSize && !eof {
+			var p []byte
+			if len(free) > 0 {
+				p, free = free[len(free)-1], free[:len(free)-1]
+			} else {
+				p = make([]byte, 4+t.blockSize)
+			}
+			l, err := io.ReadFull(r, p[4:4+t.blockSize])
+			n += int64(l)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return n, err
+			}
+			seq++
+			packDATA(p, uint16(seq))
+			window = append(window, p[:4+l])
+		}
+
+		if sent < len(window) {
+			for ; sent < len(window); sent++ {
+				if err := t.conn.send(window[sent]); err != nil {
+					return n, err
+				}
+				t.stats.Datagrams++
+			}
+			deadline = time.Now().Add(t.timeout)
+		}
+
+		block, err := t.waitAck(buf, deadline)
+		if err == errTimeout {
+			t.stats.Timeouts++
+			retries++
+			if retries > t.retries {
+				return n, fmt.Errorf("%w waiting for ACK of block %d", errTimeout, blockNumber(window[0]))
+			}
+			// retransmit the whole window
+			t.stats.Retransmits += len(window)
+			sent = 0
+			continue
+		} else if err != nil {
+			return n, err
+		}
+
+		acked := -1
+		for i, p := range window {
+			if blockNumber(p) == block {
+				acked = i
+				break
+			}
+		}
+		if acked < 0 {
+			// duplicate or stale ACK, let the deadline handle retransmission
+			continue
+		}
+		retries = 0
+		for _, p := range window[:acked+1] {
+			free = append(free, p[:cap(p)])
+		}
+		window = window[acked+1:]
+		sent -= acked + 1
+		if sent > 0 {
+			// client acknowledged only part of the window, the rest has to be sent again
+			t.stats.Retransmits += sent
+			sent = 0
+		}
+		if len(window) == 0 && eof {
+			return n, nil
+		}
+	}
+}
+
+func blockNumber(p []byte) uint16 {
+	return uint16(p[2])<<8 | uint16(p[3])
+}
+
+// waitAck waits for ACK from the client until deadline, ignoring unrelated packets.
+func (t *transfer) waitAck(buf []byte, deadline time.Time) (uint16, error) {
+	for {
+		timeout := time.Until(deadline)
+		if timeout <= 0 {
+			return 0, errTimeout
+		}
+		n, err := t.conn.receive(buf, timeout)
+		if err != nil {
+			return 0, err
+		}
+		block, err := parseAck(buf[:n])
+		var cerr *clientError
+		if errors.As(err, &cerr) {
+			return 0, err
+		} else if err != nil {
+			continue
+		}
+		return block, nil
+	}
+}
+
+// abort terminates the transfer with an ERROR packet, unless the client aborted it already.
+// Errors other than missing or inaccessible files, e.g. timeouts, are sent as not defined, explained by their message.
+func (t *transfer) abort(err error) {
+	var cerr *clientError
+	if errors.As(err, &cerr) {
+		return
+	}
+	code := errCodeNotDefined
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, fs.ErrNotExist), errors.Is(err, mfest.ErrNotServed):
+		code = errCodeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		code = errCodeAccess
+	}
+	_ = t.conn.send(packERROR(code, err.Error()))
+}
+
+// udpConn is a conn using a dedicated socket with an ephemeral port, as described in RFC 1350.
+type udpConn struct {
+	conn   *net.UDPConn
+	remote *net.UDPAddr
+}
+
+func newUDPConn(local net.IP, remote *net.UDPAddr) (*udpConn, error) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: local})
+	if err != nil {
+		return nil, err
+	}
+	return &udpConn{conn: c, remote: remote}, nil
+}
+
+func (c *udpConn) send(p []byte) error {
+	_, err := c.conn.WriteToUDP(p, c.remote)
+	return err
+}
+
+func (c *udpConn) receive(p []byte, timeout time.Duration) (int, error) {
+	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+	for {
+		n, addr, err := c.conn.ReadFromUDP(p)
+		var nerr net.Error
+		if errors.As(err, &nerr) && nerr.Timeout() {
+			return 0, errTimeout
+		} else if err != nil {
+			return 0, err
+		}
+		if !addr.IP.Equal(c.remote.IP) {
+			continue
+		}
+		if addr.Port != c.remote.Port {
+			// RFC 1350: packet from unexpected TID must not disturb the transfer
+			_, _ = c.conn.WriteToUDP(packERROR(errCodeUnknownTID, "unknown transfer ID"), addr)
+			continue
+		}
+		return n, nil
+	}
+}
+
+func (c *udpConn) close() {
+	c.conn.Close()
+}
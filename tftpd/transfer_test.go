@@ -0,0 +1,445 @@
+package tftpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	mfest "github.com/DSpeichert/netbootd/manifest"
+)
+
+// testClient is the client side of a transfer over the loopback interface.
+type testClient struct {
+	t    *testing.T
+	conn *net.UDPConn
+	// transfer socket of the server, known once it sent something
+	server *net.UDPAddr
+}
+
+// startTransfer starts serving data to a new client for request packet p, returning the client
+// and the result of ReadFrom once it's done.
+func startTransfer(t *testing.T, p []byte, options mfest.TFTPOptions, data io.Reader) (*testClient, *transfer, <-chan error) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	req, err := parseRequest(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := conn.LocalAddr().(*net.UDPAddr)
+	sc, err := newUDPConn(remote.IP, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newTransfer(sc, req, remote, remote.IP, options, 0)
+	done := make(chan error, 1)
+	go func() {
+		defer sc.close()
+		_, err := tr.ReadFrom(data)
+		if err != nil {
+			tr.abort(err)
+		}
+		done <- err
+	}()
+	return &testClient{t: t, conn: conn}, tr, done
+}
+
+func rrq(filename, mode string, options ...string) []byte {
+	p := binary.BigEndian.AppendUint16(nil, opRRQ)
+	for _, f := range append([]string{filename, mode}, options...) {
+		p = append(p, f...)
+		p = append(p, 0)
+	}
+	return p
+}
+
+// receive returns the next packet from the server, failing the test if none arrives within timeout.
+func (c *testClient) receive(timeout time.Duration) []byte {
+	c.t.Helper()
+	p, ok := c.tryReceive(timeout)
+	if !ok {
+		c.t.Fatal("no packet from server")
+	}
+	return p
+}
+
+func (c *testClient) tryReceive(timeout time.Duration) ([]byte, bool) {
+	c.t.Helper()
+	buf := make([]byte, maxDatagram)
+	c.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, addr, err := c.conn.ReadFromUDP(buf)
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return nil, false
+	} else if err != nil {
+		c.t.Fatal(err)
+	}
+	c.server = addr
+	return buf[:n], true
+}
+
+func (c *testClient) ack(block uint16) {
+	c.t.Helper()
+	p := binary.BigEndian.AppendUint16(nil, opACK)
+	p = binary.BigEndian.AppendUint16(p, block)
+	if _, err := c.conn.WriteToUDP(p, c.server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// download receives DATA until the last block, acknowledging every windowSize blocks unless drop
+// returns true for the number of the acknowledgement.
+func (c *testClient) download(blockSize, windowSize int, drop func(ack int) bool) []byte {
+	c.t.Helper()
+	var (
+		data     []byte
+		next     = uint16(1)
+		received int
+		acks     int
+	)
+	for {
+		p := c.receive(5 * time.Second)
+		if op := binary.BigEndian.Uint16(p); op != opDATA {
+			c.t.Fatalf("got opcode %d, want DATA", op)
+		}
+		if blockNumber(p) != next {
+			// retransmitted block, the server missed the ACK if it's the last one received
+			if blockNumber(p) == next-1 {
+				c.ack(next - 1)
+			}
+			continue
+		}
+		data = append(data, p[4:]...)
+		next++
+		received++
+		last := len(p)-4 < blockSize
+		if received%windowSize == 0 || last {
+			acks++
+			if drop == nil || !drop(acks) {
+				c.ack(next - 1)
+			}
+		}
+		if last {
+			return data
+		}
+	}
+}
+
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func wait(t *testing.T, done <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("transfer did not finish")
+		return nil
+	}
+}
+
+func TestTransferLockStep(t *testing.T) {
+	for _, size := range []int{0, 1, 511, 512, 1024, 1500} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			data := testData(size)
+			c, tr, done := startTransfer(t, rrq("file", "octet"), mfest.TFTPOptions{}, bytes.NewReader(data))
+			got := c.download(defaultBlockSize, 1, nil)
+			if err := wait(t, done); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("got %d bytes, want %d", len(got), len(data))
+			}
+			// files of whole blocks end with an empty one
+			if want := size/defaultBlockSize + 1; tr.Stats().Datagrams != want {
+				t.Errorf("sent %d datagrams, want %d", tr.Stats().Datagrams, want)
+			}
+		})
+	}
+}
+
+func TestTransferNegotiation(t *testing.T) {
+	data := testData(5000)
+	p := rrq("file", "octet", "BLKSIZE", "2048", "tsize", "0", "foo", "bar", "windowsize", "64", "timeout", "3", "blksize", "1024")
+	c, tr, done := startTransfer(t, p, mfest.TFTPOptions{BlksizeMax: 1400, WindowsizeMax: 4}, bytes.NewReader(data))
+
+	oack := c.receive(time.Second)
+	// listed in the order of the request, unknown options omitted, values limited
+	want := packOACK([]string{"blksize", "tsize", "windowsize", "timeout"},
+		map[string]string{"blksize": "1024", "tsize": "5000", "windowsize": "4", "timeout": "3"})
+	if !bytes.Equal(oack, want) {
+		t.Fatalf("got OACK %q, want %q", oack, want)
+	}
+	c.ack(0)
+	got := c.download(1024, 4, nil)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want %d", len(got), len(data))
+	}
+	if s := tr.Stats(); s.BlockSize != 1024 || s.WindowSize != 4 || s.Retransmits != 0 {
+		t.Errorf("got stats %+v", s)
+	}
+}
+
+func TestTransferInvalidOptions(t *testing.T) {
+	p := rrq("file", "octet", "blksize", "4", "windowsize", "0", "timeout", "256")
+	c, _, done := startTransfer(t, p, mfest.TFTPOptions{}, bytes.NewReader(testData(100)))
+
+	// no option accepted, so no OACK
+	got := c.download(defaultBlockSize, 1, nil)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 100 {
+		t.Errorf("got %d bytes, want 100", len(got))
+	}
+}
+
+func TestTransferOACKRetransmit(t *testing.T) {
+	data := testData(100)
+	c, tr, done := startTransfer(t, rrq("file", "octet", "tsize", "0"),
+		mfest.TFTPOptions{Timeout: 100 * time.Millisecond}, bytes.NewReader(data))
+
+	first := c.receive(time.Second)
+	// a stale ACK does not make the server send the OACK again
+	c.ack(7)
+	start := time.Now()
+	again := c.receive(time.Second)
+	if !bytes.Equal(first, again) {
+		t.Fatalf("got %q after timeout, want OACK %q again", again, first)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("OACK retransmitted after %s, before the timeout", d)
+	}
+	c.ack(0)
+	got := c.download(defaultBlockSize, 1, nil)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want %d", len(got), len(data))
+	}
+	if s := tr.Stats(); s.Retransmits != 1 || s.Timeouts != 1 {
+		t.Errorf("got stats %+v, want 1 retransmit", s)
+	}
+}
+
+func TestTransferOACKTimeout(t *testing.T) {
+	c, _, done := startTransfer(t, rrq("file", "octet", "tsize", "0"),
+		mfest.TFTPOptions{Timeout: 50 * time.Millisecond, Retries: 2}, bytes.NewReader(testData(100)))
+
+	for i := 0; i < 3; i++ {
+		if p := c.receive(time.Second); binary.BigEndian.Uint16(p) != opOACK {
+			t.Fatalf("got opcode %d, want OACK", binary.BigEndian.Uint16(p))
+		}
+	}
+	if err := wait(t, done); !errors.Is(err, errTimeout) {
+		t.Fatalf("got %v, want timeout", err)
+	}
+	// timeouts are not reported as missing files
+	p := c.receive(time.Second)
+	if code := binary.BigEndian.Uint16(p[2:]); binary.BigEndian.Uint16(p) != opERROR || code != errCodeNotDefined {
+		t.Errorf("got %q, want ERROR with code 0", p)
+	}
+}
+
+func TestTransferWindowRetransmit(t *testing.T) {
+	data := testData(512 * 10)
+	c, tr, done := startTransfer(t, rrq("file", "octet", "windowsize", "4"),
+		mfest.TFTPOptions{Timeout: 100 * time.Millisecond}, bytes.NewReader(data))
+
+	oack := c.receive(time.Second)
+	if binary.BigEndian.Uint16(oack) != opOACK {
+		t.Fatalf("got %q, want OACK", oack)
+	}
+	c.ack(0)
+	// the ACK of the first window gets lost, so the server sends it again
+	got := c.download(defaultBlockSize, 4, func(ack int) bool { return ack == 1 })
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want %d", len(got), len(data))
+	}
+	if s := tr.Stats(); s.Retransmits != 4 || s.Timeouts != 1 {
+		t.Errorf("got stats %+v, want the window of 4 blocks retransmitted once", s)
+	}
+}
+
+func TestTransferPartialWindow(t *testing.T) {
+	data := testData(512 * 6)
+	c, tr, done := startTransfer(t, rrq("file", "octet", "windowsize", "4"),
+		mfest.TFTPOptions{Timeout: time.Second}, bytes.NewReader(data))
+
+	c.receive(time.Second) // OACK
+	c.ack(0)
+	for block := uint16(1); block <= 4; block++ {
+		if p := c.receive(time.Second); blockNumber(p) != block {
+			t.Fatalf("got block %d, want %d", blockNumber(p), block)
+		}
+	}
+	// block 3 was lost, so the client acknowledges 2 and the server continues from 3
+	c.ack(2)
+	var blocks []uint16
+	for i := 0; i < 4; i++ {
+		blocks = append(blocks, blockNumber(c.receive(time.Second)))
+	}
+	if fmt.Sprint(blocks) != "[3 4 5 6]" {
+		t.Errorf("got blocks %v after partial ACK, want [3 4 5 6]", blocks)
+	}
+	c.ack(6)
+	// files of whole blocks end with an empty one
+	if p := c.receive(time.Second); blockNumber(p) != 7 || len(p) != 4 {
+		t.Errorf("got block %d of %d bytes, want empty block 7", blockNumber(p), len(p)-4)
+	}
+	c.ack(7)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if s := tr.Stats(); s.Retransmits != 2 {
+		t.Errorf("got %d retransmits, want 2", s.Retransmits)
+	}
+}
+
+func TestTransferStaleAcks(t *testing.T) {
+	c, _, done := startTransfer(t, rrq("file", "octet"),
+		mfest.TFTPOptions{Timeout: 100 * time.Millisecond, Retries: 1}, bytes.NewReader(testData(2000)))
+
+	// duplicate ACKs of block 0 arriving faster than the timeout must not keep the transfer alive
+	start := time.Now()
+	for {
+		select {
+		case err := <-done:
+			if !errors.Is(err, errTimeout) {
+				t.Fatalf("got %v, want timeout", err)
+			}
+			if d := time.Since(start); d > time.Second {
+				t.Errorf("transfer aborted after %s", d)
+			}
+			return
+		default:
+		}
+		if _, ok := c.tryReceive(20 * time.Millisecond); ok || c.server != nil {
+			c.ack(0)
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("transfer kept alive by stale ACKs")
+		}
+	}
+}
+
+func TestTransferWraparound(t *testing.T) {
+	// block numbers wrap around after 65535 blocks of 8 bytes
+	data := testData(8*70000 + 3)
+	c, _, done := startTransfer(t, rrq("file", "octet", "blksize", "8", "windowsize", "16"),
+		mfest.TFTPOptions{}, bytes.NewReader(data))
+
+	c.receive(time.Second) // OACK
+	c.ack(0)
+	got := c.download(8, 16, nil)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("got %d bytes, want %d", len(got), len(data))
+	}
+}
+
+func TestTransferNetascii(t *testing.T) {
+	c, _, done := startTransfer(t, rrq("file", "NetASCII", "tsize", "0"), mfest.TFTPOptions{},
+		strings.NewReader("line 1\nline 2\r\nbare\rcr\n"))
+
+	// the size after conversion is unknown, so tsize is declined
+	got := c.download(defaultBlockSize, 1, nil)
+	if err := wait(t, done); err != nil {
+		t.Fatal(err)
+	}
+	if want := "line 1\r\nline 2\r\x00\r\nbare\r\x00cr\r\n"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNetasciiReader(t *testing.T) {
+	in := strings.Repeat("a\nb\r", 100)
+	want := strings.Repeat("a\r\nb\r\x00", 100)
+	// reads of a single byte split every translated pair
+	for _, size := range []int{1, 2, 3, 512} {
+		r := newNetasciiReader(strings.NewReader(in))
+		var got []byte
+		buf := make([]byte, size)
+		for {
+			n, err := r.Read(buf)
+			got = append(got, buf[:n]...)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(got) != want {
+			t.Errorf("reads of %d bytes: got %q, want %q", size, got, want)
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	c := &testClient{t: t, conn: client}
+	sc, err := newUDPConn(net.IPv4(127, 0, 0, 1), client.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.close()
+	tr := &transfer{conn: sc}
+
+	tests := []struct {
+		err  error
+		code uint16
+	}{
+		{errNotFound, errCodeNotFound},
+		{fmt.Errorf("%w: no mount matches path", errNotFound), errCodeNotFound},
+		{mfest.ErrNotServed, errCodeNotFound},
+		{&fs.PathError{Op: "open", Path: "file", Err: fs.ErrNotExist}, errCodeNotFound},
+		{&fs.PathError{Op: "open", Path: "file", Err: fs.ErrPermission}, errCodeAccess},
+		{fmt.Errorf("%w waiting for ACK of block 1", errTimeout), errCodeNotDefined},
+		{errors.New("program failed"), errCodeNotDefined},
+	}
+	for _, tt := range tests {
+		tr.abort(tt.err)
+		p := c.receive(time.Second)
+		if op, code := binary.BigEndian.Uint16(p), binary.BigEndian.Uint16(p[2:]); op != opERROR || code != tt.code {
+			t.Errorf("abort(%v) sent opcode %d code %d, want ERROR code %d", tt.err, op, code, tt.code)
+		}
+		if msg := string(p[4 : len(p)-1]); msg != tt.err.Error() {
+			t.Errorf("abort(%v) sent message %q", tt.err, msg)
+		}
+	}
+
+	// the client aborted the transfer itself
+	tr.abort(&clientError{code: 0, message: "cancelled"})
+	if p, ok := c.tryReceive(100 * time.Millisecond); ok {
+		t.Errorf("sent %q after client error", p)
+	}
+}
@@ -0,0 +1,112 @@
+package upstream
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+// Variant identifies what requests of mount with rendered header send to upstreams besides the URL:
+// the headers, and credentials and client certificate used. Responses may differ between variants,
+// so they must not be shared. It's empty for requests without any of them.
+func Variant(mount manifest.Mount, header http.Header) string {
+	if len(header) == 0 && mount.ProxyAuth == nil && (mount.ProxyTLS == nil || mount.ProxyTLS.CertFile == "") {
+		return ""
+	}
+
+	h := sha256.New()
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "%q: %q\n", http.CanonicalHeaderKey(name), header[name])
+	}
+	if auth := mount.ProxyAuth; auth != nil {
+		fmt.Fprintf(h, "auth: %q %q %q\n", auth.Username, auth.PasswordFile, auth.TokenFile)
+	}
+	if cfg := mount.ProxyTLS; cfg != nil && cfg.CertFile != "" {
+		fmt.Fprintf(h, "cert: %q %q\n", cfg.CertFile, cfg.KeyFile)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// authorize adds credentials of mount to req.
+func (p *Pool) authorize(mount manifest.Mount, req *http.Request) error {
+	auth := mount.ProxyAuth
+	if auth == nil {
+		return nil
+	}
+	if auth.TokenFile != "" {
+		token, err := p.readSecret(auth.TokenFile)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		return nil
+	}
+	password, err := p.readSecret(auth.PasswordFile)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(auth.Username, password)
+	return nil
+}
+
+// readSecret reads a credential from file in the secrets directory, without the trailing newline most editors add.
+// Manifests may be submitted through the API, so credentials are never read from elsewhere.
+func (p *Pool) readSecret(file string) (string, error) {
+	if p.config.SecretsDirectory == "" {
+		return "", errors.New("cannot read credentials: no secrets directory configured")
+	}
+	if !manifest.IsSecretPath(file) {
+		return "", fmt.Errorf("cannot read credentials: invalid secret path: %s", file)
+	}
+	b, err := os.ReadFile(filepath.Join(p.config.SecretsDirectory, file))
+	if err != nil {
+		return "", fmt.Errorf("cannot read credentials: %w", err)
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// newTransport returns a transport using TLS settings cfg.
+func newTransport(cfg manifest.ProxyTLS) (*http.Transport, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg == (manifest.ProxyTLS{}) {
+		return transport, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CA bundle: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in CA bundle " + cfg.CAFile)
+		}
+	}
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
+}
@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+func TestAuthorize(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "artifacts"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"artifacts/password": "secret\n", "token": "t0ken\r\n"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// outside the secrets directory
+	outside := filepath.Join(filepath.Dir(dir), "outside")
+	if err := os.WriteFile(outside, []byte("outside"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(outside) })
+
+	tests := []struct {
+		auth *manifest.ProxyAuth
+		want string
+	}{
+		{nil, ""},
+		{&manifest.ProxyAuth{Username: "netboot", PasswordFile: "artifacts/password"}, "Basic bmV0Ym9vdDpzZWNyZXQ="},
+		{&manifest.ProxyAuth{TokenFile: "token"}, "Bearer t0ken"},
+	}
+	p := NewPool(Config{SecretsDirectory: dir})
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "http://upstream/", nil)
+		if err := p.authorize(manifest.Mount{ProxyAuth: tt.auth}, req); err != nil || req.Header.Get("Authorization") != tt.want {
+			t.Errorf("authorize(%+v) = %q, %v, want %q", tt.auth, req.Header.Get("Authorization"), err, tt.want)
+		}
+	}
+
+	for _, file := range []string{outside, "../outside", "artifacts/../token", "./token", "missing"} {
+		req, _ := http.NewRequest("GET", "http://upstream/", nil)
+		if err := p.authorize(manifest.Mount{ProxyAuth: &manifest.ProxyAuth{TokenFile: file}}, req); err == nil || req.Header.Get("Authorization") != "" {
+			t.Errorf("authorize with token file %s = %q, %v", file, req.Header.Get("Authorization"), err)
+		}
+	}
+
+	// without secrets directory
+	req, _ := http.NewRequest("GET", "http://upstream/", nil)
+	if err := NewPool(Config{}).authorize(manifest.Mount{ProxyAuth: &manifest.ProxyAuth{TokenFile: "token"}}, req); err == nil {
+		t.Error("credentials read without secrets directory")
+	}
+}
+
+func TestVariant(t *testing.T) {
+	auth := &manifest.ProxyAuth{Username: "netboot", PasswordFile: "password"}
+	tests := []struct {
+		mount  manifest.Mount
+		header http.Header
+		same   int
+	}{
+		{manifest.Mount{}, nil, 0},
+		{manifest.Mount{ProxyTLS: &manifest.ProxyTLS{CAFile: "ca.pem"}}, http.Header{}, 0},
+		{manifest.Mount{}, http.Header{"X-Host": {"host-1"}}, 2},
+		// regardless of order and case of header names
+		{manifest.Mount{}, http.Header{"x-host": {"host-1"}}, 2},
+		{manifest.Mount{}, http.Header{"X-Host": {"host-2"}}, 4},
+		{manifest.Mount{}, http.Header{"X-Host": {"host-1", "host-2"}}, 5},
+		{manifest.Mount{}, http.Header{"X-Host": {"host-1"}, "X-Serial": {"1"}}, 6},
+		{manifest.Mount{ProxyAuth: auth}, nil, 7},
+		{manifest.Mount{ProxyAuth: &manifest.ProxyAuth{Username: "other", PasswordFile: "password"}}, nil, 8},
+		{manifest.Mount{ProxyAuth: auth}, http.Header{"X-Host": {"host-1"}}, 9},
+		{manifest.Mount{ProxyTLS: &manifest.ProxyTLS{CertFile: "client.pem", KeyFile: "client.key"}}, nil, 10},
+	}
+	variants := make([]string, len(tests))
+	for i, tt := range tests {
+		variants[i] = Variant(tt.mount, tt.header)
+	}
+	if variants[0] != "" || variants[1] != "" {
+		t.Errorf("variants of requests without headers and credentials: %q, %q", variants[0], variants[1])
+	}
+	for i, tt := range tests {
+		for j := range tests {
+			if (tests[j].same == tt.same) != (variants[j] == variants[i]) {
+				t.Errorf("Variant(%+v, %v) = %q, Variant(%+v, %v) = %q", tt.mount, tt.header, variants[i], tests[j].mount, tests[j].header, variants[j])
+			}
+		}
+	}
+}
@@ -0,0 +1,330 @@
+// Package upstream sends requests of proxy mounts to their upstreams (Proxy and Mirrors),
+// failing over between them and keeping track of their health.
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+type Config struct {
+	// Default time each attempt may wait for response headers, can be overridden per mount.
+	Timeout time.Duration
+	// How long a failed upstream is tried only after the healthy ones.
+	UnhealthyFor time.Duration
+	// Directory with credential files of proxyAuth, which are relative to it. proxyAuth fails if empty.
+	SecretsDirectory string
+}
+
+// NewRequestFunc builds a request of upstream, which is either Proxy or one of Mirrors of a mount.
+type NewRequestFunc func(upstream string) (*http.Request, error)
+
+type Pool struct {
+	config Config
+	logger zerolog.Logger
+
+	mutex sync.Mutex
+	// keyed by TLS settings of mounts, mounts without them use the zero value
+	clients map[manifest.ProxyTLS]*client
+	// keyed by upstream URL
+	upstreams map[string]*upstream
+	// next round-robin position, keyed by the list of upstreams of a mount
+	next map[string]int
+}
+
+type client struct {
+	transport *http.Transport
+	client    *http.Client
+}
+
+type upstream struct {
+	url                 string
+	requests            int64
+	failures            int64
+	consecutiveFailures int
+	lastError           string
+	lastFailure         time.Time
+	unhealthyUntil      time.Time
+}
+
+// Health is a snapshot of the state of an upstream.
+type Health struct {
+	URL                 string    `json:"url" yaml:"url"`
+	Healthy             bool      `json:"healthy" yaml:"healthy"`
+	Requests            int64     `json:"requests" yaml:"requests"`
+	Failures            int64     `json:"failures" yaml:"failures"`
+	ConsecutiveFailures int       `json:"consecutiveFailures" yaml:"consecutiveFailures"`
+	LastError           string    `json:"lastError,omitempty" yaml:"lastError,omitempty"`
+	LastFailure         time.Time `json:"lastFailure,omitempty" yaml:"lastFailure,omitempty"`
+	UnhealthyUntil      time.Time `json:"unhealthyUntil,omitempty" yaml:"unhealthyUntil,omitempty"`
+}
+
+func NewPool(cfg Config) *Pool {
+	return &Pool{
+		config:    cfg,
+		logger:    log.With().Str("module", "upstream").Logger(),
+		clients:   make(map[manifest.ProxyTLS]*client),
+		upstreams: make(map[string]*upstream),
+		next:      make(map[string]int),
+	}
+}
+
+// Get sends requests built by newRequest to upstreams of mount, until one of them responds
+// with a status other than 5xx. Credentials and TLS settings of mount are applied and redirects are followed.
+// If all attempts fail, the last 5xx response is returned if there's one, otherwise an error.
+func (p *Pool) Get(mount manifest.Mount, newRequest NewRequestFunc) (*http.Response, error) {
+	c, err := p.client(mount)
+	if err != nil {
+		return nil, err
+	}
+	return p.do(mount, newRequest, c.client.Do)
+}
+
+// Transport returns a http.RoundTripper for reverse proxying requests of mount, adding header to them.
+// Each attempt clones the original request and rewrites it with ProxyDirectorFor of the upstream,
+// so the reverse proxy's Director must not rewrite the URL. Redirects are not followed.
+func (p *Pool) Transport(mount manifest.Mount, header http.Header) http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		c, err := p.client(mount)
+		if err != nil {
+			return nil, err
+		}
+		return p.do(mount, func(base string) (*http.Request, error) {
+			d, err := mount.ProxyDirectorFor(base)
+			if err != nil {
+				return nil, err
+			}
+			out := req.Clone(req.Context())
+			for name, values := range header {
+				out.Header[name] = values
+			}
+			d(out)
+			return out, nil
+		}, c.transport.RoundTrip)
+	})
+}
+
+// client returns the client for TLS settings of mount.
+func (p *Pool) client(mount manifest.Mount) (*client, error) {
+	var cfg manifest.ProxyTLS
+	if mount.ProxyTLS != nil {
+		cfg = *mount.ProxyTLS
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if c, ok := p.clients[cfg]; ok {
+		return c, nil
+	}
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("mount %s: %w", mount.Path, err)
+	}
+	c := &client{
+		transport: transport,
+		client:    &http.Client{Transport: transport},
+	}
+	p.clients[cfg] = c
+	return c, nil
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func (p *Pool) do(mount manifest.Mount, newRequest NewRequestFunc, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	candidates := p.order(mount)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("mount %s has no upstream", mount.Path)
+	}
+	attempts := len(candidates)
+	if mount.ProxyRetries > 0 {
+		attempts = mount.ProxyRetries + 1
+	}
+	timeout := mount.ProxyTimeout
+	if timeout <= 0 {
+		timeout = p.config.Timeout
+	}
+
+	var (
+		lastResp *http.Response
+		lastErr  error
+	)
+	for i := 0; i < attempts; i++ {
+		base := candidates[i%len(candidates)]
+		req, err := newRequest(base)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.authorize(mount, req); err != nil {
+			return nil, err
+		}
+
+		resp, err := p.attempt(req, timeout, send)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			p.succeeded(base)
+			if lastResp != nil {
+				lastResp.Body.Close()
+			}
+			return resp, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("upstream returned status %s", resp.Status)
+			if lastResp != nil {
+				lastResp.Body.Close()
+			}
+			lastResp = resp
+		}
+		lastErr = err
+		p.failed(base, err)
+		p.logger.Warn().
+			Err(err).
+			Str("upstream", base).
+			Str("url", req.URL.Redacted()).
+			Int("attempt", i+1).
+			Int("attempts", attempts).
+			Msg("upstream attempt failed")
+	}
+
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// attempt sends req, failing if response headers do not arrive within timeout.
+// Reading the body is not limited, as large files may take a long time to transfer.
+func (p *Pool) attempt(req *http.Request, timeout time.Duration, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	if timeout <= 0 {
+		return send(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := send(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("no response within %s", timeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// order returns upstreams of mount in the order they should be tried.
+func (p *Pool) order(mount manifest.Mount) []string {
+	upstreams := mount.Upstreams()
+	if len(upstreams) < 2 {
+		return upstreams
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	start := 0
+	if mount.MirrorPolicy == manifest.MirrorPolicyRoundRobin {
+		key := strings.Join(upstreams, " ")
+		start = p.next[key] % len(upstreams)
+		p.next[key] = start + 1
+	}
+	ordered := append(append([]string{}, upstreams[start:]...), upstreams[:start]...)
+
+	now := time.Now()
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return p.healthy(ordered[i], now) && !p.healthy(ordered[j], now)
+	})
+	return ordered
+}
+
+// healthy must be called with mutex held.
+func (p *Pool) healthy(url string, now time.Time) bool {
+	u, ok := p.upstreams[url]
+	return !ok || !now.Before(u.unhealthyUntil)
+}
+
+// get must be called with mutex held.
+func (p *Pool) get(url string) *upstream {
+	u, ok := p.upstreams[url]
+	if !ok {
+		u = &upstream{url: url}
+		p.upstreams[url] = u
+	}
+	return u
+}
+
+func (p *Pool) succeeded(url string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	u := p.get(url)
+	u.requests++
+	u.consecutiveFailures = 0
+	u.unhealthyUntil = time.Time{}
+}
+
+func (p *Pool) failed(url string, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	u := p.get(url)
+	u.requests++
+	u.failures++
+	u.consecutiveFailures++
+	u.lastError = err.Error()
+	u.lastFailure = time.Now()
+	u.unhealthyUntil = u.lastFailure.Add(p.config.UnhealthyFor)
+}
+
+// Health returns state of all upstreams used so far, sorted by URL.
+func (p *Pool) Health() []Health {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	health := make([]Health, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		health = append(health, Health{
+			URL:                 u.url,
+			Healthy:             !now.Before(u.unhealthyUntil),
+			Requests:            u.requests,
+			Failures:            u.failures,
+			ConsecutiveFailures: u.consecutiveFailures,
+			LastError:           u.lastError,
+			LastFailure:         u.lastFailure,
+			UnhealthyUntil:      u.unhealthyUntil,
+		})
+	}
+	sort.Slice(health, func(i, j int) bool {
+		return health[i].URL < health[j].URL
+	})
+	return health
+}
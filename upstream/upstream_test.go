@@ -0,0 +1,228 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DSpeichert/netbootd/manifest"
+)
+
+// testUpstream is a HTTP server recording the requests it got.
+type testUpstream struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests int
+}
+
+func newTestUpstream(t *testing.T, handler http.HandlerFunc) *testUpstream {
+	t.Helper()
+	u := &testUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mutex.Lock()
+		u.requests++
+		u.mutex.Unlock()
+		handler(w, r)
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func (u *testUpstream) count() int {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.requests
+}
+
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+// unreachable returns the URL of a server that is not listening anymore.
+func unreachable() string {
+	s := httptest.NewServer(http.NotFoundHandler())
+	s.Close()
+	return s.URL
+}
+
+func get(t *testing.T, p *Pool, mount manifest.Mount) (int, string, error) {
+	t.Helper()
+	resp, err := p.Get(mount, func(base string) (*http.Request, error) {
+		return http.NewRequest("GET", base+"/file", nil)
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b), err
+}
+
+func TestFailover(t *testing.T) {
+	failing := newTestUpstream(t, respond(http.StatusServiceUnavailable, "unavailable"))
+	down := unreachable()
+	mirror := newTestUpstream(t, respond(http.StatusOK, "mirror"))
+	p := NewPool(Config{UnhealthyFor: time.Hour})
+	mount := manifest.Mount{Path: "/file", Proxy: failing.URL, Mirrors: []string{down, mirror.URL}}
+
+	if status, body, err := get(t, p, mount); err != nil || status != http.StatusOK || body != "mirror" {
+		t.Fatalf("got %d %q, %v", status, body, err)
+	}
+	health := make(map[string]Health)
+	for _, h := range p.Health() {
+		health[h.URL] = h
+	}
+	if h := health[failing.URL]; h.Healthy || h.Failures != 1 || h.LastError != "upstream returned status 503 Service Unavailable" {
+		t.Errorf("health of failing upstream %+v", h)
+	}
+	if h := health[down]; h.Healthy || h.Failures != 1 {
+		t.Errorf("health of unreachable upstream %+v", h)
+	}
+	if h := health[mirror.URL]; !h.Healthy || h.Requests != 1 || h.Failures != 0 {
+		t.Errorf("health of mirror %+v", h)
+	}
+
+	// failed upstreams are tried last while unhealthy
+	if status, body, err := get(t, p, mount); err != nil || status != http.StatusOK || body != "mirror" {
+		t.Fatalf("got %d %q, %v", status, body, err)
+	}
+	if failing.count() != 1 || mirror.count() != 2 {
+		t.Errorf("%d requests to failing upstream, %d to mirror", failing.count(), mirror.count())
+	}
+
+	// and first again once healthy
+	p = NewPool(Config{UnhealthyFor: 10 * time.Millisecond})
+	get(t, p, mount)
+	time.Sleep(20 * time.Millisecond)
+	get(t, p, mount)
+	if failing.count() != 3 || mirror.count() != 4 {
+		t.Errorf("%d requests to failing upstream, %d to mirror", failing.count(), mirror.count())
+	}
+}
+
+func TestFailoverExhausted(t *testing.T) {
+	first := newTestUpstream(t, respond(http.StatusBadGateway, "first"))
+	last := newTestUpstream(t, respond(http.StatusServiceUnavailable, "last"))
+	p := NewPool(Config{})
+
+	// the last 5xx response is returned
+	mount := manifest.Mount{Path: "/file", Proxy: first.URL, Mirrors: []string{last.URL}}
+	if status, body, err := get(t, p, mount); err != nil || status != http.StatusServiceUnavailable || body != "last" {
+		t.Errorf("got %d %q, %v", status, body, err)
+	}
+
+	// other statuses are not retried
+	notFound := newTestUpstream(t, respond(http.StatusNotFound, "not found"))
+	mount = manifest.Mount{Path: "/file", Proxy: notFound.URL, Mirrors: []string{last.URL}}
+	if status, _, err := get(t, p, mount); err != nil || status != http.StatusNotFound || notFound.count() != 1 || last.count() != 1 {
+		t.Errorf("got %d, %v after %d, %d requests", status, err, notFound.count(), last.count())
+	}
+
+	// an error without any response
+	mount = manifest.Mount{Path: "/file", Proxy: unreachable(), Mirrors: []string{unreachable()}}
+	if _, _, err := get(t, p, mount); err == nil {
+		t.Error("no error from unreachable upstreams")
+	}
+	if _, _, err := get(t, p, manifest.Mount{Path: "/file"}); err == nil {
+		t.Error("no error without upstreams")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	failing := newTestUpstream(t, respond(http.StatusInternalServerError, "failing"))
+	mirror := newTestUpstream(t, respond(http.StatusInternalServerError, "mirror"))
+	p := NewPool(Config{})
+
+	// retries cycle through the upstreams
+	mount := manifest.Mount{Path: "/file", Proxy: failing.URL, Mirrors: []string{mirror.URL}, ProxyRetries: 4}
+	get(t, p, mount)
+	if failing.count() != 3 || mirror.count() != 2 {
+		t.Errorf("%d requests to failing upstream, %d to mirror", failing.count(), mirror.count())
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	slow := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	defer close(release)
+	// headers in time, the body may take longer
+	mirror := newTestUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(w, "mirror")
+	})
+	p := NewPool(Config{Timeout: time.Hour, UnhealthyFor: time.Hour})
+
+	mount := manifest.Mount{Path: "/file", Proxy: slow.URL, Mirrors: []string{mirror.URL}, ProxyTimeout: 50 * time.Millisecond}
+	if status, body, err := get(t, p, mount); err != nil || status != http.StatusOK || body != "mirror" {
+		t.Errorf("got %d %q, %v", status, body, err)
+	}
+	for _, h := range p.Health() {
+		if h.URL == slow.URL && (h.Healthy || h.LastError != "no response within 50ms") {
+			t.Errorf("health of slow upstream %+v", h)
+		}
+	}
+}
+
+func TestRoundRobin(t *testing.T) {
+	upstreams := []*testUpstream{
+		newTestUpstream(t, respond(http.StatusOK, "0")),
+		newTestUpstream(t, respond(http.StatusOK, "1")),
+		newTestUpstream(t, respond(http.StatusOK, "2")),
+	}
+	p := NewPool(Config{UnhealthyFor: time.Hour})
+	mount := manifest.Mount{
+		Path:         "/file",
+		Proxy:        upstreams[0].URL,
+		Mirrors:      []string{upstreams[1].URL, upstreams[2].URL},
+		MirrorPolicy: manifest.MirrorPolicyRoundRobin,
+	}
+
+	var got string
+	for i := 0; i < 6; i++ {
+		_, body, err := get(t, p, mount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += body
+	}
+	if got != "012012" {
+		t.Errorf("served by %s, want 012012", got)
+	}
+
+	// upstreams that failed are skipped, their turns go to the next one
+	upstreams[1].Close()
+	got = ""
+	for i := 0; i < 6; i++ {
+		_, body, err := get(t, p, mount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got += body
+	}
+	if got != "022022" {
+		t.Errorf("served by %s, want 022022", got)
+	}
+
+	// failover policy always starts with Proxy
+	mount.MirrorPolicy = manifest.MirrorPolicyFailover
+	mount.Proxy, mount.Mirrors = upstreams[2].URL, []string{upstreams[0].URL}
+	for i := 0; i < 3; i++ {
+		if _, body, err := get(t, p, mount); err != nil || body != "2" {
+			t.Errorf("served by %q, %v, want 2", body, err)
+		}
+	}
+}